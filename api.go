@@ -14,6 +14,18 @@
 
 package sonic
 
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"time"
+)
+
+// ErrDuration is returned when a target duration cannot be reached.
+var ErrDuration = errors.New("invalid target duration")
+
 // ChangeSpeed modifies the speed, pitch, rate, and volume of the provided int16 samples.
 // It returns the modified int16 samples and any encountered error.
 func ChangeSpeed(sampleRate, numChannels int, speed, pitch, rate, volume float64, samples []int16) ([]int16, error) {
@@ -28,7 +40,7 @@ func ChangeSpeed(sampleRate, numChannels int, speed, pitch, rate, volume float64
 	if err := stream.Flush(); err != nil {
 		return samples, err
 	}
-	out, err := stream.ReadAll()
+	out, err := stream.outputBuffer.Flush()
 	if err != nil {
 		return samples, err
 	}
@@ -43,6 +55,120 @@ func ChangeSpeed(sampleRate, numChannels int, speed, pitch, rate, volume float64
 	return samples, nil
 }
 
+// ChangeSpeedToDuration modifies the pitch, rate, and volume of the provided int16 samples and
+// changes their speed so that the output lasts exactly target. The speed is computed from the
+// input length; if PICOLA's accumulated timeError leaves the output off by more than a maximal
+// pitch period, a second pass with a corrected speed is made. The result is then trimmed or padded
+// with silence to the exact number of samples.
+// It returns the modified int16 samples and any encountered error.
+func ChangeSpeedToDuration(sampleRate, numChannels int, pitch, rate, volume float64, samples []int16, target time.Duration) ([]int16, error) {
+	if numChannels < 1 || len(samples)%numChannels != 0 {
+		return samples, ErrChannels
+	}
+	targetLen := int(math.Round(target.Seconds() * float64(sampleRate)))
+	out, _, err := fitLength(sampleRate, numChannels, pitch, rate, volume, samples, targetLen)
+	if err != nil {
+		return samples, err
+	}
+
+	n := targetLen * numChannels
+	if cap(samples) < n {
+		samples = make([]int16, n)
+	} else {
+		samples = samples[:n]
+	}
+	m := copy(samples, out)
+	clear(samples[m:])
+
+	return samples, nil
+}
+
+// maxDurationSpeed bounds the speed ChangeSpeedToDuration may use in either direction: fitting
+// the input into a target more than this many times shorter or longer is rejected. At speeds beyond
+// twice the shortest pitch period in samples, 40 at 8 kHz, PICOLA would keep nothing of a period
+// and stall.
+const maxDurationSpeed = 20
+
+// fitLength changes the speed of samples so that the output lasts about targetLen frames, and
+// returns the output before it is trimmed or padded and the number of passes it took.
+func fitLength(sampleRate, numChannels int, pitch, rate, volume float64, samples []int16, targetLen int) ([]int16, int, error) {
+	inputLen := len(samples) / numChannels
+	if inputLen == 0 || targetLen <= 0 || !(rate > 0) || math.IsInf(rate, 1) {
+		return nil, 0, ErrDuration
+	}
+
+	speed := float64(inputLen) / (float64(targetLen) * rate)
+	if err := checkDurationSpeed(speed); err != nil {
+		return nil, 0, err
+	}
+	out, err := changeSpeedOnce(sampleRate, numChannels, speed, pitch, rate, volume, samples)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	maxPeriod := sampleRate / MinPitch
+	outputLen := len(out) / numChannels
+	if outputLen == 0 || abs(outputLen-targetLen) <= maxPeriod {
+		return out, 1, nil
+	}
+	speed *= float64(outputLen) / float64(targetLen)
+	if err := checkDurationSpeed(speed); err != nil {
+		return nil, 1, err
+	}
+	second, err := changeSpeedOnce(sampleRate, numChannels, speed, pitch, rate, volume, samples)
+	if err != nil {
+		return nil, 2, err
+	}
+	// The period choices shift with the speed, so the correction can overshoot; keep the closer
+	// output.
+	if abs(len(second)/numChannels-targetLen) < abs(outputLen-targetLen) {
+		out = second
+	}
+	return out, 2, nil
+}
+
+// checkDurationSpeed returns ErrDuration if speed is not finite or beyond maxDurationSpeed.
+func checkDurationSpeed(speed float64) error {
+	if math.IsNaN(speed) || speed > maxDurationSpeed || speed < 1.0/maxDurationSpeed {
+		return fmt.Errorf("%w: speed %v is out of range", ErrDuration, speed)
+	}
+	return nil
+}
+
+// changeSpeedOnce runs samples through a new Stream and returns the stream's output without
+// touching the input slice.
+func changeSpeedOnce(sampleRate, numChannels int, speed, pitch, rate, volume float64, samples []int16) ([]int16, error) {
+	stream := NewSonicStream(sampleRate, numChannels)
+	stream.SetSpeed(speed)
+	stream.SetPitch(pitch)
+	stream.SetRate(rate)
+	stream.SetVolume(volume)
+	return stream.processAll(samples)
+}
+
+// processAll runs samples through the stream, flushes it and returns its whole output.
+func (stream *Stream) processAll(samples []int16) ([]int16, error) {
+	if err := stream.AddSamples(samples); err != nil {
+		return nil, err
+	}
+	if err := stream.Flush(); err != nil {
+		return nil, err
+	}
+	out, err := stream.outputBuffer.Flush()
+	if err == io.EOF {
+		return nil, nil
+	}
+	return out, err
+}
+
+// abs returns the absolute value of an int.
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
 // ChangeFloatSpeed modifies the speed, pitch, rate, and volume of the provided float64 samples.
 // It returns the modified float64 samples and any encountered error.
 func ChangeFloatSpeed(sampleRate, numChannels int, speed, pitch, rate, volume float64, samples []float64) ([]float64, error) {
@@ -57,7 +183,7 @@ func ChangeFloatSpeed(sampleRate, numChannels int, speed, pitch, rate, volume fl
 	if err := stream.Flush(); err != nil {
 		return samples, err
 	}
-	out, err := stream.ReadAll()
+	out, err := stream.outputBuffer.Flush()
 	if err != nil {
 		return samples, err
 	}
@@ -90,7 +216,7 @@ func ChangeByteSpeed(sampleRate, numChannels int, speed, pitch, rate, volume flo
 		return samples, err
 	}
 
-	out, err := stream.ReadAll()
+	out, err := stream.outputBuffer.Flush()
 	if err != nil {
 		return samples, err
 	}
@@ -137,12 +263,31 @@ func (stream *Stream) WriteBytes(samples []uint8) error {
 
 // Read reads a slice wih a len n from the outputBuffer
 func (stream *Stream) Read(n int) ([]int16, error) {
-	return stream.outputBuffer.ReadSlice(n)
+	return stream.readOutput(n)
+}
+
+// readOutput reads up to n frames from the outputBuffer and folds the timestamp jumps the
+// output has reached into the timestamp base.
+func (stream *Stream) readOutput(n int) ([]int16, error) {
+	out, err := stream.outputBuffer.ReadSlice(n)
+	stream.prunePTS()
+	return out, err
 }
 
-// ReadAll flushes and returns slice with all the data in the outputBuffer
+// ReadAll flushes and returns a new slice with all the data in the outputBuffer.
+// Use ReadAllTo to reuse a slice instead.
 func (stream *Stream) ReadAll() ([]int16, error) {
-	return stream.outputBuffer.Flush()
+	return stream.ReadAllTo(nil)
+}
+
+// ReadAllTo reads all the data in the outputBuffer into s, growing it only if its capacity is
+// too small, and returns the resulting slice.
+func (stream *Stream) ReadAllTo(s []int16) ([]int16, error) {
+	data, err := stream.readOutput(stream.outputBuffer.Len())
+	if err != nil {
+		return s[:0], err
+	}
+	return append(s[:0], data...), nil
 }
 
 // ReadTo reads data from the outputBuffer to a slice
@@ -152,7 +297,7 @@ func (stream *Stream) ReadTo(s []int16) ([]int16, error) {
 		return s[:0], nil
 	}
 
-	data, err := stream.outputBuffer.ReadSlice(n)
+	data, err := stream.readOutput(n)
 	if err != nil {
 		return s[:0], err
 	}
@@ -172,16 +317,99 @@ func (stream *Stream) NumOutputSamples() int {
 	return stream.outputBuffer.Len()
 }
 
+// Clone returns a new stream with the same format, backend, parameters, pitch estimator, window
+// and clip mode, but no observer. The auto-tune, harmony and loudness stages are set up the same
+// way but start empty.
+// If withState is true, the buffered samples and all processing state are copied as well, so that
+// the clone continues exactly where the original is.
+func (stream *Stream) Clone(withState bool) *Stream {
+	clone := NewSonicStreamWithBackend(stream.sampleRate, stream.numChannels, stream.backend)
+	clone.speed = stream.speed
+	clone.pitch = stream.pitch
+	clone.rate = stream.rate
+	clone.volume = stream.volume
+	clone.volumeDB = stream.volumeDB
+	clone.quality = stream.quality
+	clone.pitchTracking = stream.pitchTracking
+	clone.estimator = stream.estimator
+	clone.clipMode = stream.clipMode
+	clone.window = stream.window
+	clone.maxInput = stream.maxInput
+	clone.maxOutput = stream.maxOutput
+	if stream.tune != nil {
+		clone.tune = stream.tune.clone(withState)
+	}
+	if stream.harmony != nil {
+		clone.harmony = stream.harmony.clone(withState)
+	}
+	if stream.loudness != nil {
+		clone.loudness = stream.loudness.clone(withState)
+	}
+	if !withState {
+		return clone
+	}
+
+	clone.inputPlaytime = stream.inputPlaytime
+	clone.timeError = stream.timeError
+	clone.oldRatePosition = stream.oldRatePosition
+	clone.newRatePosition = stream.newRatePosition
+	clone.prevPeriod = stream.prevPeriod
+	clone.prevMinDiff = stream.prevMinDiff
+	clone.trackMinDiff = stream.trackMinDiff
+	clone.trackMaxDiff = stream.trackMaxDiff
+	clone.tracked = stream.tracked
+	clone.seekTail = slices.Clone(stream.seekTail)
+	clone.seekHistory = append(clone.seekHistory, stream.seekHistory...)
+	clone.seekFaded = stream.seekFaded
+	clone.seekSkip = stream.seekSkip
+	clone.discard = stream.discard
+	clone.ptsBase, clone.ptsIn, clone.ptsInFrames = stream.ptsBase, stream.ptsIn, stream.ptsInFrames
+	clone.ptsJumps = slices.Clone(stream.ptsJumps)
+	clone.produced, clone.timed = stream.produced, stream.timed
+	clone.markersIn, clone.markersOut = slices.Clone(stream.markersIn), slices.Clone(stream.markersOut)
+	clone.written = stream.written
+	clone.stats, clone.pitchSum, clone.pitchCount = stream.stats, stream.pitchSum, stream.pitchCount
+	clone.consumed = stream.consumed
+	dst := clone.buffers()
+	for i, b := range stream.buffers() {
+		// Both buffers have the same number of channels, so this cannot fail.
+		_ = dst[i].WriteSlice(b.Buffer.Buffer())
+	}
+	return clone
+}
+
 // Reset instantly resets internal state and clears all buffers
 func (stream *Stream) Reset() {
 	stream.prevPeriod = 0
+	stream.trackMinDiff = 0
+	stream.trackMaxDiff = 0
+	stream.tracked = 0
 	stream.oldRatePosition = 0
 	stream.newRatePosition = 0
 	stream.timeError = 0
 	stream.inputPlaytime = 0
+	stream.seekTail, stream.seekFaded = stream.seekTail[:0], 0
+	stream.seekHistory = stream.seekHistory[:0]
+	stream.seekSkip = 0
+	stream.discard = 0
+	stream.ptsBase, stream.ptsIn, stream.ptsInFrames = 0, 0, 0
+	stream.ptsJumps = stream.ptsJumps[:0]
+	stream.produced, stream.timed = 0, false
+	stream.markersIn, stream.markersOut = stream.markersIn[:0], stream.markersOut[:0]
+	stream.written = 0
+	stream.stats, stream.pitchSum, stream.pitchCount, stream.consumed = Stats{}, 0, 0, 0
 
 	stream.inputBuffer.Reset()
 	stream.outputBuffer.Reset()
 	stream.downSampleBuffer.Reset()
 	stream.pitchBuffer.Reset()
+	if stream.tune != nil {
+		stream.tune.reset()
+	}
+	if stream.harmony != nil {
+		stream.harmony.reset()
+	}
+	if stream.loudness != nil {
+		stream.loudness.reset()
+	}
 }
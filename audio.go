@@ -0,0 +1,192 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonic
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/go-audio/audio"
+)
+
+// ErrFormat is returned when an audio buffer does not match the stream format.
+var ErrFormat = errors.New("audio buffer format does not match the stream")
+
+// WriteAudioBuffer converts a go-audio buffer to int16 samples, writes them to the Stream and processes data.
+// IntBuffer data is scaled according to its SourceBitDepth (8-bit data is unsigned, as produced by
+// the wav decoder; a zero depth is treated as 16-bit). FloatBuffer and Float32Buffer data is
+// expected in the [-1, 1] range and is clipped outside of it.
+func (stream *Stream) WriteAudioBuffer(buf audio.Buffer) error {
+	if buf == nil {
+		return audio.ErrInvalidBuffer
+	}
+	if f := buf.PCMFormat(); f != nil {
+		if f.NumChannels != 0 && f.NumChannels != stream.numChannels {
+			return fmt.Errorf("%w: %d channels", ErrFormat, f.NumChannels)
+		}
+		if f.SampleRate != 0 && f.SampleRate != stream.sampleRate {
+			return fmt.Errorf("%w: sample rate %d", ErrFormat, f.SampleRate)
+		}
+	}
+
+	samples, err := AppendAudioBuffer(stream.conv[:0], buf)
+	stream.conv = samples[:0]
+	if err != nil {
+		return err
+	}
+	return stream.Write(samples)
+}
+
+// AppendAudioBuffer converts the data of a go-audio buffer to int16 samples the way
+// WriteAudioBuffer does, appends them to dst and returns the extended slice.
+func AppendAudioBuffer(dst []int16, buf audio.Buffer) ([]int16, error) {
+	switch b := buf.(type) {
+	case nil:
+		return dst, audio.ErrInvalidBuffer
+	case *audio.IntBuffer:
+		return appendInts(dst, b.Data, b.SourceBitDepth)
+	case *audio.FloatBuffer:
+		for _, v := range b.Data {
+			dst = append(dst, floatToInt16(v))
+		}
+	case *audio.Float32Buffer:
+		for _, v := range b.Data {
+			dst = append(dst, floatToInt16(float64(v)))
+		}
+	default:
+		ib := buf.AsIntBuffer()
+		return appendInts(dst, ib.Data, ib.SourceBitDepth)
+	}
+	return dst, nil
+}
+
+// AppendIntSamples converts int16 samples to integer samples of the given bit depth (8, 16, 24
+// or 32; 8-bit data is unsigned) the way ReadIntBuffer does, appends them to dst and returns the
+// extended slice.
+func AppendIntSamples(dst []int, samples []int16, bitDepth int) ([]int, error) {
+	shift, err := bitDepthShift(bitDepth)
+	if err != nil {
+		return dst, err
+	}
+	for _, v := range samples {
+		if bitDepth == 8 {
+			dst = append(dst, int(v>>8)+128)
+		} else {
+			dst = append(dst, int(v)<<shift)
+		}
+	}
+	return dst, nil
+}
+
+// ReadIntBuffer reads up to n samples from the outputBuffer into a go-audio IntBuffer.
+// If buf is nil a new buffer is allocated, otherwise its Data slice is reused. The samples
+// are scaled to buf.SourceBitDepth (8, 16, 24 or 32); a zero depth means 16-bit. Format is
+// set to the stream's sample rate and number of channels. io.EOF is returned if there is no output.
+func (stream *Stream) ReadIntBuffer(buf *audio.IntBuffer, n int) (*audio.IntBuffer, error) {
+	if buf == nil {
+		buf = &audio.IntBuffer{}
+	}
+	if buf.SourceBitDepth == 0 {
+		buf.SourceBitDepth = 16
+	}
+	buf.Data = buf.Data[:0]
+	if _, err := bitDepthShift(buf.SourceBitDepth); err != nil {
+		return buf, err
+	}
+	stream.setAudioFormat(&buf.Format)
+
+	out, err := stream.readOutput(n)
+	if err != nil {
+		return buf, err
+	}
+	buf.Data, err = AppendIntSamples(buf.Data, out, buf.SourceBitDepth)
+	return buf, err
+}
+
+// ReadFloat32Buffer reads up to n samples from the outputBuffer into a go-audio Float32Buffer
+// with data in the [-1, 1] range. If buf is nil a new buffer is allocated, otherwise its Data
+// slice is reused. SourceBitDepth is set to 16 and Format to the stream's sample rate and
+// number of channels. io.EOF is returned if there is no output.
+func (stream *Stream) ReadFloat32Buffer(buf *audio.Float32Buffer, n int) (*audio.Float32Buffer, error) {
+	if buf == nil {
+		buf = &audio.Float32Buffer{}
+	}
+	buf.SourceBitDepth = 16
+	stream.setAudioFormat(&buf.Format)
+
+	out, err := stream.readOutput(n)
+	buf.Data = buf.Data[:0]
+	if err != nil {
+		return buf, err
+	}
+	for _, v := range out {
+		buf.Data = append(buf.Data, float32(v)/32767.0)
+	}
+	return buf, nil
+}
+
+// setAudioFormat points f at a Format describing the stream, reusing an existing one.
+func (stream *Stream) setAudioFormat(f **audio.Format) {
+	if *f == nil {
+		*f = &audio.Format{}
+	}
+	(*f).NumChannels = stream.numChannels
+	(*f).SampleRate = stream.sampleRate
+}
+
+// bitDepthShift returns how far 16-bit samples have to be shifted left to reach the bit depth.
+func bitDepthShift(bitDepth int) (int, error) {
+	switch bitDepth {
+	case 8, 16, 24, 32:
+		return bitDepth - 16, nil
+	}
+	return 0, fmt.Errorf("%w: unsupported bit depth %d", ErrFormat, bitDepth)
+}
+
+// appendInts converts integer samples of the given bit depth to int16 and appends them to dst.
+// A zero depth means 16-bit.
+func appendInts(dst []int16, src []int, bitDepth int) ([]int16, error) {
+	if bitDepth == 0 {
+		bitDepth = 16
+	}
+	shift, err := bitDepthShift(bitDepth)
+	if err != nil {
+		return dst, err
+	}
+	for _, v := range src {
+		switch {
+		case bitDepth == 8:
+			dst = append(dst, int16(v-128)<<8)
+		case shift > 0:
+			dst = append(dst, int16(v>>shift))
+		default:
+			dst = append(dst, int16(v))
+		}
+	}
+	return dst, nil
+}
+
+// floatToInt16 converts a sample in the [-1, 1] range to int16, clipping values outside of it.
+// Values are rounded so that ReadFloat32Buffer output converts back to the same samples.
+func floatToInt16(v float64) int16 {
+	v = math.Round(v * 32767.0)
+	if v > ShrtMax {
+		return ShrtMax
+	} else if v < ShrtMin {
+		return ShrtMin
+	}
+	return int16(v)
+}
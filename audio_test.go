@@ -0,0 +1,139 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonic
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/go-audio/audio"
+)
+
+func TestWriteAudioBuffer(t *testing.T) {
+	want := []int16{0, 1000, -1000, 32767, -32768, 256, -256, 12345}
+	format := &audio.Format{NumChannels: 2, SampleRate: 8000}
+
+	ints := func(shift int) []int {
+		out := make([]int, len(want))
+		for i, v := range want {
+			out[i] = int(v) << shift
+		}
+		return out
+	}
+	floats := make([]float64, len(want))
+	floats32 := make([]float32, len(want))
+	for i, v := range want {
+		floats[i] = float64(v) / 32767.0
+		floats32[i] = float32(v) / 32767.0
+	}
+
+	tests := []struct {
+		name string
+		buf  audio.Buffer
+		want []int16
+	}{
+		{"int16", &audio.IntBuffer{Format: format, SourceBitDepth: 16, Data: ints(0)}, want},
+		{"int default depth", &audio.IntBuffer{Format: format, Data: ints(0)}, want},
+		{"int24", &audio.IntBuffer{Format: format, SourceBitDepth: 24, Data: ints(8)}, want},
+		{"int32", &audio.IntBuffer{Format: format, SourceBitDepth: 32, Data: ints(16)}, want},
+		{"int8", &audio.IntBuffer{Format: format, SourceBitDepth: 8, Data: []int{128, 255, 0, 129}}, []int16{0, 32512, -32768, 256}},
+		{"float64", &audio.FloatBuffer{Format: format, Data: floats}, want},
+		{"float32", &audio.Float32Buffer{Format: format, Data: floats32}, want},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := NewSonicStream(8000, 2)
+			if err := stream.WriteAudioBuffer(tt.buf); err != nil {
+				t.Fatal(err)
+			}
+			got, err := stream.ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteAudioBufferFormat(t *testing.T) {
+	stream := NewSonicStream(8000, 1)
+	err := stream.WriteAudioBuffer(&audio.IntBuffer{Format: &audio.Format{NumChannels: 2, SampleRate: 8000}, Data: []int{1, 2}})
+	if !errors.Is(err, ErrFormat) {
+		t.Errorf("expected ErrFormat for a channel mismatch, got %v", err)
+	}
+	err = stream.WriteAudioBuffer(&audio.IntBuffer{Format: &audio.Format{NumChannels: 1, SampleRate: 44100}, Data: []int{1, 2}})
+	if !errors.Is(err, ErrFormat) {
+		t.Errorf("expected ErrFormat for a sample rate mismatch, got %v", err)
+	}
+	err = stream.WriteAudioBuffer(&audio.IntBuffer{SourceBitDepth: 12, Data: []int{1, 2}})
+	if !errors.Is(err, ErrFormat) {
+		t.Errorf("expected ErrFormat for a 12-bit buffer, got %v", err)
+	}
+}
+
+func TestReadAudioBuffers(t *testing.T) {
+	stream := NewSonicStream(16000, 2)
+	if err := stream.Write([]int16{100, -100, 200, -200, 300, -300}); err != nil {
+		t.Fatal(err)
+	}
+
+	ib, err := stream.ReadIntBuffer(&audio.IntBuffer{SourceBitDepth: 24}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ib.Format.SampleRate != 16000 || ib.Format.NumChannels != 2 || ib.SourceBitDepth != 24 {
+		t.Errorf("unexpected format %+v depth %d", *ib.Format, ib.SourceBitDepth)
+	}
+	if !reflect.DeepEqual(ib.Data, []int{100 << 8, -100 << 8, 200 << 8, -200 << 8}) {
+		t.Errorf("unexpected data %v", ib.Data)
+	}
+	if ib.NumFrames() != 2 {
+		t.Errorf("NumFrames %d, want 2", ib.NumFrames())
+	}
+
+	fb, err := stream.ReadFloat32Buffer(nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fb.Format.SampleRate != 16000 || fb.Format.NumChannels != 2 || fb.SourceBitDepth != 16 {
+		t.Errorf("unexpected format %+v depth %d", *fb.Format, fb.SourceBitDepth)
+	}
+	if len(fb.Data) != 2 || fb.Data[0] != 300/32767.0 || fb.Data[1] != -300/32767.0 {
+		t.Errorf("unexpected data %v", fb.Data)
+	}
+
+	if _, err := stream.ReadIntBuffer(ib, 2); err != io.EOF {
+		t.Errorf("expected io.EOF on an empty stream, got %v", err)
+	}
+}
+
+func TestAppendSamples(t *testing.T) {
+	samples, err := AppendAudioBuffer([]int16{7}, &audio.IntBuffer{SourceBitDepth: 24, Data: []int{100 << 8, -100 << 8}})
+	if err != nil || !reflect.DeepEqual(samples, []int16{7, 100, -100}) {
+		t.Errorf("AppendAudioBuffer returned %v, %v", samples, err)
+	}
+	ints, err := AppendIntSamples(nil, samples[1:], 8)
+	if err != nil || !reflect.DeepEqual(ints, []int{128, 127}) {
+		t.Errorf("AppendIntSamples returned %v, %v", ints, err)
+	}
+	if _, err := AppendIntSamples(nil, samples, 12); !errors.Is(err, ErrFormat) {
+		t.Errorf("expected ErrFormat for 12-bit samples, got %v", err)
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonic
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// ConcertPitch is the frequency of A4 the auto-tune scales are tuned to.
+const ConcertPitch = 440.0
+
+// ErrAutoTune is returned by SetAutoTune for an invalid key, scale or correction speed.
+var ErrAutoTune = errors.New("invalid auto-tune settings")
+
+// Scale is a set of pitch classes relative to the key: bit i is set if the note i semitones
+// above the key is in the scale.
+type Scale uint16
+
+const (
+	// ScaleChromatic holds all twelve notes, so it only corrects the intonation.
+	ScaleChromatic Scale = 0xfff
+	// ScaleMajor is the major scale.
+	ScaleMajor Scale = 1<<0 | 1<<2 | 1<<4 | 1<<5 | 1<<7 | 1<<9 | 1<<11
+	// ScaleMinor is the natural minor scale.
+	ScaleMinor Scale = 1<<0 | 1<<2 | 1<<3 | 1<<5 | 1<<7 | 1<<8 | 1<<10
+	// ScaleMajorPentatonic is the major scale without its fourth and seventh.
+	ScaleMajorPentatonic Scale = 1<<0 | 1<<2 | 1<<4 | 1<<7 | 1<<9
+	// ScaleMinorPentatonic is the natural minor scale without its second and sixth.
+	ScaleMinorPentatonic Scale = 1<<0 | 1<<3 | 1<<5 | 1<<7 | 1<<10
+)
+
+// nearest returns the note of the scale in the given key closest to note, both in semitones as
+// MIDI note numbers.
+func (s Scale) nearest(key int, note float64) float64 {
+	best := math.Inf(1)
+	for n := math.Round(note) - 6; n <= math.Round(note)+6; n++ {
+		class := ((int(n)-key)%12 + 12) % 12
+		if s&(1<<class) != 0 && math.Abs(n-note) < math.Abs(best-note) {
+			best = n
+		}
+	}
+	return best
+}
+
+// AutoTune configures the auto-tune stage.
+type AutoTune struct {
+	// Key is the pitch class of the key, from 0 for C to 11 for B.
+	Key int
+	// Scale holds the notes the output is pulled to.
+	Scale Scale
+	// Speed is the time constant of the correction. Zero snaps every period to the scale at once,
+	// which gives the robotic effect; some 50ms keep the glides and vibrato of the voice.
+	Speed time.Duration
+}
+
+// valid reports whether the key, scale and speed are in range.
+func (t AutoTune) valid() bool {
+	return t.Key >= 0 && t.Key <= 11 && t.Scale&ScaleChromatic != 0 && t.Speed >= 0
+}
+
+// pitchCorrector turns the pitch periods the time stretch uses into pitch ratios for the
+// auto-tune stage. cents is the current correction.
+type pitchCorrector struct {
+	AutoTune
+	sampleRate int
+	cents      float64
+
+	// found holds the periods the time stretch used for the current input, at the frame of the
+	// output buffer they start at, and periods those placed at positions of the stage, in order.
+	found   []tunePeriod
+	periods []tunePeriod
+}
+
+// tunePeriod is a pitch period of the time stretch, refined to a fraction of a sample, at a
+// position, and whether the input was voiced there.
+type tunePeriod struct {
+	pos    int
+	period float64
+	voiced bool
+}
+
+// place moves the periods found since the last call to the stage positions from end on, where
+// the output produced since position at of the output buffer goes after the rate stage. rate
+// scales the periods and positions like that stage does.
+func (p *pitchCorrector) place(end, at int, rate float64) {
+	for _, f := range p.found {
+		f.pos = end + max(int(math.Round(float64(f.pos-at)/rate)), 0)
+		f.period /= rate
+		if n := len(p.periods); n > 0 {
+			f.pos = max(f.pos, p.periods[n-1].pos)
+		}
+		p.periods = append(p.periods, f)
+	}
+	p.found = p.found[:0]
+}
+
+// periodAt returns the period of the time stretch at position pos: the last one placed at or
+// before it, or the first one if pos comes before all of them. Without any periods it returns
+// maxPeriod, unvoiced.
+func (p *pitchCorrector) periodAt(pos, maxPeriod int) (float64, bool) {
+	if len(p.periods) == 0 {
+		return float64(maxPeriod), false
+	}
+	i := max(p.last(pos), 0)
+	return p.periods[i].period, p.periods[i].voiced
+}
+
+// last returns the index of the last period placed at or before pos, or -1.
+func (p *pitchCorrector) last(pos int) int {
+	i := len(p.periods) - 1
+	for i >= 0 && p.periods[i].pos > pos {
+		i--
+	}
+	return i
+}
+
+// prune drops the periods that positions from pos on do not need anymore.
+func (p *pitchCorrector) prune(pos int) {
+	if i := p.last(pos); i > 0 {
+		p.periods = p.periods[:copy(p.periods, p.periods[i:])]
+	}
+}
+
+// reset drops the correction and all periods.
+func (p *pitchCorrector) reset() {
+	p.cents = 0
+	p.found = p.found[:0]
+	p.periods = p.periods[:0]
+}
+
+// correct returns the pitch ratio of the period after the one of the previous call. The
+// correction moves towards the nearest note of the scale in voiced periods and back to none in
+// unvoiced ones.
+func (p *pitchCorrector) correct(period float64, voiced bool) float64 {
+	target := 0.0
+	if voiced {
+		note := 69 + 12*math.Log2(float64(p.sampleRate)/period/ConcertPitch)
+		target = 100 * (p.Scale.nearest(p.Key, note) - note)
+	}
+	alpha := 1.0
+	if p.Speed > 0 {
+		alpha = -math.Expm1(-period / (p.Speed.Seconds() * float64(p.sampleRate)))
+	}
+	p.cents += alpha * (target - p.cents)
+	return math.Exp2(p.cents / 1200)
+}
+
+// newTuneStage creates the auto-tune stage: a harmony stage with a single unshifted voice whose
+// grains are placed by the corrector.
+func newTuneStage(sampleRate, ch int, t AutoTune) *harmonyStage {
+	h := newHarmonyStage(sampleRate, ch)
+	h.tuner = &pitchCorrector{AutoTune: t, sampleRate: sampleRate}
+	h.setVoices(0, []Voice{{Gain: 1}})
+	return h
+}
+
+// SetAutoTune enables the auto-tune stage, which pulls the pitch of every voiced period of the
+// output to the nearest note of a scale. It takes the pitch from the periods the pitch period
+// search of the time stretch finds, which also searches the input it copies while auto-tune is
+// on, and shifts each period by its own ratio, so it works at any speed and pitch. The stage
+// delays the output by about five periods of the lowest pitch; Flush drains it.
+func (stream *Stream) SetAutoTune(t AutoTune) error {
+	if !t.valid() {
+		return ErrAutoTune
+	}
+	if stream.tune == nil {
+		stream.tune = newTuneStage(stream.sampleRate, stream.numChannels, t)
+		return nil
+	}
+	stream.tune.tuner.AutoTune = t
+	return nil
+}
+
+// tunePitchPeriod finds the pitch period of input the time stretch copies unmodified and hands it
+// to the auto-tune stage. Without auto-tune the time stretch does not search there, so the
+// tracking state is restored and the previous period left alone: auto-tune does not change the
+// periods the time stretch picks.
+func (stream *Stream) tunePitchPeriod() (int, error) {
+	trackMinDiff, trackMaxDiff, tracked := stream.trackMinDiff, stream.trackMaxDiff, stream.tracked
+	period, minDiff, maxDiff, err := stream.measurePitchPeriod()
+	stream.trackMinDiff, stream.trackMaxDiff, stream.tracked = trackMinDiff, trackMaxDiff, tracked
+	if err != nil {
+		return 0, err
+	}
+	stream.noteTunePeriod(period, minDiff, maxDiff)
+	return period, nil
+}
+
+// noteTunePeriod hands a pitch period the time stretch uses to the auto-tune stage. The input
+// counts as voiced where the period matches clearly, as in prevPeriodBetter.
+func (stream *Stream) noteTunePeriod(period, minDiff, maxDiff int) {
+	if stream.tune == nil {
+		return
+	}
+	t := stream.tune.tuner
+	t.found = append(t.found, tunePeriod{stream.outputBuffer.Len(), stream.refinePeriod(period), maxDiff > minDiff*3})
+}
+
+// refinePeriod turns a pitch period of the time stretch into the period of the fundamental,
+// refined to a fraction of a sample. The time stretch gets away with a multiple of the period,
+// but a multiple other than a power of two is off the notes of the scale, so the shortest part
+// of it that still matches like a period does, by the YIN threshold, is taken instead. The
+// parabola through the squared differences around it then gets within a few cents at low sample
+// rates and high pitches.
+func (stream *Stream) refinePeriod(period int) float64 {
+	samples, err := stream.inputBuffer.GetSlice(2*period + 2)
+	if err != nil || len(samples) < (2*period+2)*stream.numChannels {
+		return float64(period)
+	}
+	for k := period / stream.minPeriod; k > 1; k-- {
+		if p := (period + k/2) / k; p > stream.minPeriod && stream.periodDiff(samples, p, true) < DefaultYINThreshold {
+			period = p
+			break
+		}
+	}
+	if period <= stream.minPeriod || period >= stream.maxPeriod {
+		return float64(period)
+	}
+	var d [3]float64
+	for k := range d {
+		d[k] = stream.periodDiff(samples, period+k-1, false)
+	}
+	if d[1] >= d[0] || d[1] >= d[2] {
+		return float64(period)
+	}
+	return float64(period) + 0.5*(d[0]-d[2])/(d[0]-2*d[1]+d[2])
+}
+
+// periodDiff returns the mean squared difference of the samples, mixed to mono, and the samples
+// period frames later. normalized divides it by their mean energy instead, which makes it 1 for
+// uncorrelated samples.
+func (stream *Stream) periodDiff(samples []int16, period int, normalized bool) float64 {
+	ch := stream.numChannels
+	sum, energy := 0.0, 0.0
+	for i := 0; i < period; i++ {
+		a, b := 0, 0
+		for c := 0; c < ch; c++ {
+			a += int(samples[i*ch+c])
+			b += int(samples[(i+period)*ch+c])
+		}
+		sum += float64(a-b) * float64(a-b)
+		energy += float64(a)*float64(a) + float64(b)*float64(b)
+	}
+	if !normalized {
+		return sum / float64(period)
+	}
+	if energy == 0 {
+		return 1
+	}
+	return sum / energy
+}
+
+// GetAutoTune returns the auto-tune settings and whether the stage is enabled.
+func (stream *Stream) GetAutoTune() (AutoTune, bool) {
+	if stream.tune == nil {
+		return AutoTune{}, false
+	}
+	return stream.tune.tuner.AutoTune, true
+}
+
+// DisableAutoTune removes the auto-tune stage. Samples held by it are lost, so call Flush first
+// to keep them.
+func (stream *Stream) DisableAutoTune() {
+	stream.tune = nil
+}
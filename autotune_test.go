@@ -0,0 +1,226 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonic
+
+import (
+	"math"
+	"slices"
+	"testing"
+	"time"
+)
+
+// sineF0 returns the frequency of a sine from its interpolated upward zero crossings.
+func sineF0(samples []int16, sampleRate int) float64 {
+	first, last, n := 0.0, 0.0, 0
+	for i := 1; i < len(samples); i++ {
+		a, b := float64(samples[i-1]), float64(samples[i])
+		if a < 0 && b >= 0 {
+			last = float64(i-1) + a/(a-b)
+			if n == 0 {
+				first = last
+			}
+			n++
+		}
+	}
+	return float64(n-1) * float64(sampleRate) / (last - first)
+}
+
+// cents returns the interval from b to a in cents.
+func cents(a, b float64) float64 {
+	return 1200 * math.Log2(a/b)
+}
+
+func TestPitchSemitones(t *testing.T) {
+	stream := NewSonicStream(16000, 1)
+	stream.SetPitchSemitones(12)
+	if got := stream.GetPitch(); math.Abs(got-2) > 1e-12 {
+		t.Errorf("12 semitones: pitch %v", got)
+	}
+	stream.SetPitchCents(-1200)
+	if got := stream.GetPitch(); math.Abs(got-0.5) > 1e-12 {
+		t.Errorf("-1200 cents: pitch %v", got)
+	}
+	stream.SetPitch(1.5)
+	if got := stream.GetPitchSemitones(); math.Abs(got-7.01955) > 1e-5 {
+		t.Errorf("pitch 1.5: %v semitones", got)
+	}
+	if got := stream.GetPitchCents(); math.Abs(got-701.955) > 1e-3 {
+		t.Errorf("pitch 1.5: %v cents", got)
+	}
+}
+
+func TestScaleNearest(t *testing.T) {
+	for _, tc := range []struct {
+		scale Scale
+		key   int
+		note  float64
+		want  float64
+	}{
+		{ScaleChromatic, 0, 60.4, 60},
+		{ScaleChromatic, 0, 60.6, 61},
+		{ScaleMajor, 0, 61.1, 62}, // C#+10 to D in C major
+		{ScaleMajor, 0, 60.9, 60}, // C#-10 to C
+		{ScaleMajor, 7, 65.6, 66}, // F+60 to F# in G major
+		{ScaleMinor, 9, 67.6, 67}, // G#-40 to G in A minor
+		{ScaleMajorPentatonic, 0, 65.4, 64},
+		{ScaleMinorPentatonic, 9, 58.4, 57}, // B flat-60 to A in A minor pentatonic
+		{ScaleMajor, 11, 63.2, 63},          // D# is in B major
+	} {
+		if got := tc.scale.nearest(tc.key, tc.note); got != tc.want {
+			t.Errorf("%012b in %d: %v to %v, want %v", tc.scale, tc.key, tc.note, got, tc.want)
+		}
+	}
+}
+
+func TestAutoTunePitch(t *testing.T) {
+	const sampleRate = 44100
+	for _, tc := range []struct {
+		name     string
+		tune     AutoTune
+		in, want float64
+	}{
+		{"chromatic", AutoTune{Scale: ScaleChromatic}, 220 * math.Exp2(35.0/1200), 220},
+		{"flat", AutoTune{Scale: ScaleChromatic}, 220 * math.Exp2(-40.0/1200), 220},
+		{"major", AutoTune{Key: 0, Scale: ScaleMajor}, 207.65 * math.Exp2(10.0/1200), 220},
+		{"minor", AutoTune{Key: 9, Scale: ScaleMinor, Speed: 20 * time.Millisecond}, 185, 196},
+	} {
+		in := harmonic(sampleRate, tc.in, 1, 1.5*tc.in, 0, sampleRate)
+		plain := processChunks(t, NewSonicStream(sampleRate, 1), in, 882)
+		stream := NewSonicStream(sampleRate, 1)
+		if err := stream.SetAutoTune(tc.tune); err != nil {
+			t.Fatal(err)
+		}
+		out := processChunks(t, stream, in, 882)
+		if len(out) != len(plain) {
+			t.Errorf("%s: %d samples, want %d", tc.name, len(out), len(plain))
+		}
+		got := sineF0(out[sampleRate/4:len(out)-sampleRate/4], sampleRate)
+		t.Logf("%s: %.2f Hz to %.2f Hz", tc.name, tc.in, got)
+		if d := cents(got, tc.want); math.Abs(d) > 2 {
+			t.Errorf("%s: %.2f Hz to %.2f Hz, %.1f cents off %.2f Hz", tc.name, tc.in, got, d, tc.want)
+		}
+	}
+}
+
+func TestAutoTuneSpeed(t *testing.T) {
+	const sampleRate, period = 44100, 200.0 // 220.5 Hz, 7.9 cents above A3
+	p := pitchCorrector{AutoTune: AutoTune{Scale: ScaleChromatic, Speed: 50 * time.Millisecond}, sampleRate: sampleRate}
+	target := cents(220, float64(sampleRate)/period)
+
+	// After one time constant the correction has made 63% of its way.
+	var ratio float64
+	for elapsed := period; elapsed <= sampleRate/20; elapsed += period {
+		ratio = p.correct(period, true)
+	}
+	if got := cents(ratio, 1) / target; got < 0.6 || got > 0.65 {
+		t.Errorf("after 50ms the correction is at %.2f of the target", got)
+	}
+
+	// Unvoiced periods let it go again.
+	for i := 0; i < 100; i++ {
+		ratio = p.correct(period, false)
+	}
+	if math.Abs(cents(ratio, 1)) > 0.01 {
+		t.Errorf("unvoiced correction %.2f cents", cents(ratio, 1))
+	}
+
+	p.Speed = 0
+	if got := cents(p.correct(period, true), 1); math.Abs(got-target) > 1e-9 {
+		t.Errorf("immediate correction %.2f cents, want %.2f", got, target)
+	}
+}
+
+func TestAutoTuneTimeStretch(t *testing.T) {
+	w, sampleRate, channels, err := readWAV("./testdata/OSR_us_000_0010_8k.wav")
+	if err != nil {
+		t.Fatalf("reading error: %v", err)
+	}
+	w = w[:len(w)/4]
+
+	// Auto-tune also searches the input the time stretch copies between periods, which must not
+	// change the periods the time stretch picks.
+	plain, tuned := NewSonicStream(sampleRate, channels), NewSonicStream(sampleRate, channels)
+	if err := tuned.SetAutoTune(AutoTune{Scale: ScaleChromatic}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i*1000 < len(w); i++ {
+		for _, s := range []*Stream{plain, tuned} {
+			s.SetSpeed([]float64{1.4, 0.7}[i/10%2])
+			s.SetPitchTracking(i/20%2 == 1)
+			if err := s.Write(w[i*1000 : min((i+1)*1000, len(w))]); err != nil {
+				t.Fatal(err)
+			}
+			_, _ = s.ReadAll()
+		}
+		if plain.prevPeriod != tuned.prevPeriod || plain.prevMinDiff != tuned.prevMinDiff ||
+			plain.trackMinDiff != tuned.trackMinDiff || plain.trackMaxDiff != tuned.trackMaxDiff ||
+			plain.tracked != tuned.tracked || plain.inputBuffer.Len() != tuned.inputBuffer.Len() {
+			t.Fatalf("time stretch state differs after %d samples", (i+1)*1000)
+		}
+	}
+}
+
+func TestAutoTuneState(t *testing.T) {
+	w, sampleRate, channels, err := readWAV("./testdata/OSR_us_000_0010_8k.wav")
+	if err != nil {
+		t.Fatalf("reading error: %v", err)
+	}
+	w = w[:len(w)/4]
+
+	// Speech keeps its length and stays close to the original in level.
+	plain := processChunks(t, NewSonicStream(sampleRate, channels), w, 1000)
+	stream := NewSonicStream(sampleRate, channels)
+	tune := AutoTune{Key: 2, Scale: ScaleMajor, Speed: 30 * time.Millisecond}
+	if err := stream.SetAutoTune(tune); err != nil {
+		t.Fatal(err)
+	}
+	if got := processChunks(t, stream, w, 1000); len(got) != len(plain) {
+		t.Errorf("%d samples, want %d", len(got), len(plain))
+	}
+
+	stream.SetSpeed(1.3)
+	_ = stream.SetHarmony(0.8, Voice{Semitones: 4, Gain: 0.4})
+	half := len(w) / 2
+	if err := stream.Write(w[:half]); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = stream.ReadAll()
+	data, _ := stream.MarshalBinary()
+	restored := &Stream{}
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	clone := stream.Clone(true)
+	var outs [3][]int16
+	for i, s := range []*Stream{stream, restored, clone} {
+		outs[i] = processChunks(t, s, w[half:], 1000)
+	}
+	if !slices.Equal(outs[0], outs[1]) || !slices.Equal(outs[0], outs[2]) {
+		t.Error("restored or cloned stream output differs")
+	}
+
+	if got, ok := restored.GetAutoTune(); !ok || got != tune {
+		t.Errorf("auto-tune %+v %v, want %+v", got, ok, tune)
+	}
+	for _, bad := range []AutoTune{{Key: 12, Scale: ScaleMajor}, {Key: -1, Scale: ScaleMajor}, {}, {Scale: ScaleMajor, Speed: -1}} {
+		if err := stream.SetAutoTune(bad); err != ErrAutoTune {
+			t.Errorf("%+v: %v", bad, err)
+		}
+	}
+	stream.DisableAutoTune()
+	if _, ok := stream.GetAutoTune(); ok {
+		t.Error("auto-tune still enabled")
+	}
+}
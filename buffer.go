@@ -65,48 +65,142 @@ var ErrTooLarge = errors.New("media.Buffer: too large")
 const maxInt = int(^uint(0) >> 1)
 
 // Buffer is a generic variable-sized buffer for storing arbitrary data types.
+// It keeps its elements in a Storage: a SliceBuffer by default, or another Storage, such as a
+// RingBuffer, given to NewBufferWithStorage. The zero value is an empty Buffer backed by a
+// SliceBuffer.
 type Buffer[T any] struct {
-	buf []T // contents are the elements buf[off : len(buf)]
-	off int // read at &buf[off], write at &buf[len(buf)]
+	store Storage[T]
 }
 
 // NewBuffer creates and initializes a new Buffer using Type and Len
 func NewBuffer[T any](initialCap int) *Buffer[T] {
-	return &Buffer[T]{buf: make([]T, 0, initialCap)}
+	return &Buffer[T]{store: NewSliceBuffer[T](initialCap)}
+}
+
+// NewBufferWithStorage creates a Buffer that keeps its elements in s.
+func NewBufferWithStorage[T any](s Storage[T]) *Buffer[T] {
+	return &Buffer[T]{store: s}
+}
+
+// storage returns the Storage of the buffer, giving the zero value an empty SliceBuffer.
+func (b *Buffer[T]) storage() Storage[T] {
+	if b.store == nil {
+		b.store = &SliceBuffer[T]{}
+	}
+	return b.store
+}
+
+// Buffer returns a slice of length b.Len() holding the unread portion of the buffer.
+func (b *Buffer[T]) Buffer() []T { return b.storage().Buffer() }
+
+// AvailableBuffer returns an empty buffer with b.Available() capacity, or nil if the storage
+// has no contiguous free space.
+func (b *Buffer[T]) AvailableBuffer() []T { return b.storage().AvailableBuffer() }
+
+// Len returns the number of elements in the unread portion of the buffer.
+func (b *Buffer[T]) Len() int { return b.storage().Len() }
+
+// Cap returns the capacity of the buffer's storage.
+func (b *Buffer[T]) Cap() int { return b.storage().Cap() }
+
+// Available returns how many elements are unused in the buffer.
+func (b *Buffer[T]) Available() int { return b.storage().Available() }
+
+// Truncate discards all but the first n unread elements from the buffer.
+func (b *Buffer[T]) Truncate(n int) { b.storage().Truncate(n) }
+
+// Reset resets the buffer to be empty.
+func (b *Buffer[T]) Reset() { b.storage().Reset() }
+
+// Grow grows the buffer's capacity to guarantee space for another n elements.
+func (b *Buffer[T]) Grow(n int) { b.storage().Grow(n) }
+
+// Write appends the element v to the buffer, growing the buffer as needed.
+func (b *Buffer[T]) Write(v T) error { return b.storage().Write(v) }
+
+// WriteAt rewrites the element v in the buffer at position At
+func (b *Buffer[T]) WriteAt(n int, v T) { b.storage().WriteAt(n, v) }
+
+// WriteSlice appends the elements of the slice to the buffer, growing the buffer as needed.
+func (b *Buffer[T]) WriteSlice(slice []T) error { return b.storage().WriteSlice(slice) }
+
+// WriteZero appends n zero elements to the buffer, growing the buffer as needed.
+func (b *Buffer[T]) WriteZero(n int) { b.storage().WriteZero(n) }
+
+// Read reads the next element from the buffer.
+func (b *Buffer[T]) Read() (T, error) { return b.storage().Read() }
+
+// At peeks the element of the Buffer at n position
+func (b *Buffer[T]) At(n int) (T, error) { return b.storage().At(n) }
+
+// DropSlice drops the next n elements from the buffer.
+func (b *Buffer[T]) DropSlice(n int) error { return b.storage().DropSlice(n) }
+
+// ReadSlice reads the next n elements from the buffer.
+func (b *Buffer[T]) ReadSlice(n int) ([]T, error) { return b.storage().ReadSlice(n) }
+
+// ReadSliceAt reads slice from position at
+func (b *Buffer[T]) ReadSliceAt(at int) ([]T, error) { return b.storage().ReadSliceAt(at) }
+
+// GetSlice gets the next n elements from the buffer without removing them from a buffer
+func (b *Buffer[T]) GetSlice(n int) ([]T, error) { return b.storage().GetSlice(n) }
+
+// GetSliceAtN gets a slice of N elements from a buffer position at certain position
+func (b *Buffer[T]) GetSliceAtN(at, n int) ([]T, error) { return b.storage().GetSliceAtN(at, n) }
+
+// MoveTo reads data from n position to the end of the original buffer and writes it to dest buffer
+func (b *Buffer[T]) MoveTo(a *Buffer[T], n int) error { return b.storage().MoveTo(a, n) }
+
+// MoveAllTo transfers all elements from the current Buffer to another Buffer.
+func (b *Buffer[T]) MoveAllTo(a *Buffer[T]) error { return b.storage().MoveAllTo(a) }
+
+// CopyTo gets data from n position to the end of the original buffer and writes it to dest buffer
+func (b *Buffer[T]) CopyTo(dest *Buffer[T], n int) error { return b.storage().CopyTo(dest, n) }
+
+// SliceBuffer is the default Storage of a Buffer. It keeps its elements in a slice and slides
+// them to the front when it runs out of room at the end.
+type SliceBuffer[T any] struct {
+	buf []T // contents are the elements buf[off : len(buf)]
+	off int // read at &buf[off], write at &buf[len(buf)]
+}
+
+// NewSliceBuffer creates an empty SliceBuffer with room for initialCap elements.
+func NewSliceBuffer[T any](initialCap int) *SliceBuffer[T] {
+	return &SliceBuffer[T]{buf: make([]T, 0, initialCap)}
 }
 
 // Buffer returns a slice of length b.Len() holding the unread portion of the buffer.
-func (b *Buffer[T]) Buffer() []T {
+func (b *SliceBuffer[T]) Buffer() []T {
 	return b.buf[b.off:]
 }
 
 // AvailableBuffer returns an empty buffer with b.Available() capacity.
-func (b *Buffer[T]) AvailableBuffer() []T {
+func (b *SliceBuffer[T]) AvailableBuffer() []T {
 	return b.buf[len(b.buf):]
 }
 
 // Len returns the number of elements in the unread portion of the buffer.
-func (b *Buffer[T]) Len() int {
+func (b *SliceBuffer[T]) Len() int {
 	return len(b.buf) - b.off
 }
 
-// Cap returns the capacity of the buffer's underlying slice.
-func (b *Buffer[T]) Cap() int {
+// Cap returns the capacity of the buffer's slice.
+func (b *SliceBuffer[T]) Cap() int {
 	return cap(b.buf)
 }
 
 // Available returns how many elements are unused in the buffer.
-func (b *Buffer[T]) Available() int {
+func (b *SliceBuffer[T]) Available() int {
 	return cap(b.buf) - len(b.buf)
 }
 
 // isEmpty reports whether the unread portion of the buffer is empty.
-func (b *Buffer[T]) isEmpty() bool {
+func (b *SliceBuffer[T]) isEmpty() bool {
 	return len(b.buf) <= b.off
 }
 
 // Truncate discards all but the first n unread elements from the buffer.
-func (b *Buffer[T]) Truncate(n int) {
+func (b *SliceBuffer[T]) Truncate(n int) {
 	if n == 0 {
 		b.Reset()
 		return
@@ -118,13 +212,13 @@ func (b *Buffer[T]) Truncate(n int) {
 }
 
 // Reset resets the buffer to be empty.
-func (b *Buffer[T]) Reset() {
+func (b *SliceBuffer[T]) Reset() {
 	b.buf = b.buf[:0]
 	b.off = 0
 }
 
 // Write appends the element v to the buffer, growing the buffer as needed.
-func (b *Buffer[T]) Write(v T) error {
+func (b *SliceBuffer[T]) Write(v T) error {
 	m, ok := b.tryGrowByReslice(1)
 	if !ok {
 		m = b.grow(1)
@@ -134,7 +228,7 @@ func (b *Buffer[T]) Write(v T) error {
 }
 
 // WriteAt rewrites the element v in the buffer at position At
-func (b *Buffer[T]) WriteAt(n int, v T) {
+func (b *SliceBuffer[T]) WriteAt(n int, v T) {
 	if b.Len() < n {
 		panic("media.Buffer: wrong position to write at")
 	}
@@ -142,7 +236,7 @@ func (b *Buffer[T]) WriteAt(n int, v T) {
 }
 
 // WriteSlice appends the elements of the slice to the buffer, growing the buffer as needed.
-func (b *Buffer[T]) WriteSlice(slice []T) error {
+func (b *SliceBuffer[T]) WriteSlice(slice []T) error {
 	if len(slice) == 0 {
 		return nil
 	}
@@ -156,8 +250,17 @@ func (b *Buffer[T]) WriteSlice(slice []T) error {
 	return nil
 }
 
+// WriteZero appends n zero elements to the buffer, growing the buffer as needed.
+func (b *SliceBuffer[T]) WriteZero(n int) {
+	m, ok := b.tryGrowByReslice(n)
+	if !ok {
+		m = b.grow(n)
+	}
+	clear(b.buf[m : m+n])
+}
+
 // Read reads the next element from the buffer.
-func (b *Buffer[T]) Read() (T, error) {
+func (b *SliceBuffer[T]) Read() (T, error) {
 	if b.isEmpty() {
 		var zeroValue T
 		b.Reset()
@@ -169,7 +272,7 @@ func (b *Buffer[T]) Read() (T, error) {
 }
 
 // DropSlice drops the next n elements from the buffer.
-func (b *Buffer[T]) DropSlice(n int) error {
+func (b *SliceBuffer[T]) DropSlice(n int) error {
 	if b.isEmpty() {
 		b.Reset()
 		return io.EOF
@@ -183,7 +286,7 @@ func (b *Buffer[T]) DropSlice(n int) error {
 }
 
 // ReadSlice reads the next n elements from the buffer.
-func (b *Buffer[T]) ReadSlice(n int) ([]T, error) {
+func (b *SliceBuffer[T]) ReadSlice(n int) ([]T, error) {
 	if b.isEmpty() {
 		b.Reset()
 		return nil, io.EOF
@@ -198,7 +301,7 @@ func (b *Buffer[T]) ReadSlice(n int) ([]T, error) {
 }
 
 // ReadSliceAt reads slice from position at
-func (b *Buffer[T]) ReadSliceAt(at int) ([]T, error) {
+func (b *SliceBuffer[T]) ReadSliceAt(at int) ([]T, error) {
 	if b.isEmpty() {
 		b.Reset()
 		return nil, io.EOF
@@ -215,7 +318,7 @@ func (b *Buffer[T]) ReadSliceAt(at int) ([]T, error) {
 }
 
 // GetSlice gets the next n elements from the buffer without removing them from a buffer
-func (b *Buffer[T]) GetSlice(n int) ([]T, error) {
+func (b *SliceBuffer[T]) GetSlice(n int) ([]T, error) {
 	if b.isEmpty() {
 		b.Reset()
 		return nil, io.EOF
@@ -229,7 +332,7 @@ func (b *Buffer[T]) GetSlice(n int) ([]T, error) {
 }
 
 // GetSliceAtN gets a slice of N elements from a buffer position at certain position
-func (b *Buffer[T]) GetSliceAtN(at, n int) ([]T, error) {
+func (b *SliceBuffer[T]) GetSliceAtN(at, n int) ([]T, error) {
 	if b.isEmpty() {
 		b.Reset()
 		return nil, io.EOF
@@ -244,7 +347,7 @@ func (b *Buffer[T]) GetSliceAtN(at, n int) ([]T, error) {
 }
 
 // MoveTo reads data from n position to the end of the original buffer and writes it to dest buffer
-func (b *Buffer[T]) MoveTo(a *Buffer[T], n int) error {
+func (b *SliceBuffer[T]) MoveTo(a *Buffer[T], n int) error {
 	if b.isEmpty() {
 		return nil
 	}
@@ -258,7 +361,7 @@ func (b *Buffer[T]) MoveTo(a *Buffer[T], n int) error {
 // MoveAllTo transfers all elements from the current Buffer to another Buffer.
 // If the current Buffer is empty, it returns nil. It reads a slice from
 // the current Buffer and writes it to the specified destination Buffer (a).
-func (b *Buffer[T]) MoveAllTo(a *Buffer[T]) error {
+func (b *SliceBuffer[T]) MoveAllTo(a *Buffer[T]) error {
 	if b.isEmpty() {
 		return nil
 	}
@@ -270,7 +373,7 @@ func (b *Buffer[T]) MoveAllTo(a *Buffer[T]) error {
 }
 
 // CopyTo gets data from n position to the end of the original buffer and writes it to dest buffer
-func (b *Buffer[T]) CopyTo(dest *Buffer[T], n int) error {
+func (b *SliceBuffer[T]) CopyTo(dest *Buffer[T], n int) error {
 	if b.isEmpty() {
 		return nil
 	}
@@ -282,7 +385,7 @@ func (b *Buffer[T]) CopyTo(dest *Buffer[T], n int) error {
 }
 
 // At peeks the element of the Buffer at n position
-func (b *Buffer[T]) At(n int) (T, error) {
+func (b *SliceBuffer[T]) At(n int) (T, error) {
 	if len(b.buf)-b.off < n {
 		var zeroValue T
 		return zeroValue, io.EOF
@@ -291,7 +394,7 @@ func (b *Buffer[T]) At(n int) (T, error) {
 }
 
 // Grow grows the buffer's capacity to guarantee space for another n elements.
-func (b *Buffer[T]) Grow(n int) {
+func (b *SliceBuffer[T]) Grow(n int) {
 	if n < 0 {
 		panic("media.Buffer.Grow: negative count")
 	}
@@ -304,7 +407,7 @@ func (b *Buffer[T]) Grow(n int) {
 
 // tryGrowByReslice is an inlineable version of grow for the fast-case where the
 // internal buffer only needs to be resliced.
-func (b *Buffer[T]) tryGrowByReslice(n int) (int, bool) {
+func (b *SliceBuffer[T]) tryGrowByReslice(n int) (int, bool) {
 	if l := len(b.buf); n <= cap(b.buf)-l {
 		b.buf = b.buf[:l+n]
 		return l, true
@@ -329,7 +432,7 @@ func growSlice[T any](b []T, n int) []T {
 }
 
 // grow grows the buffer to guarantee space for n more elements.
-func (b *Buffer[T]) grow(n int) int {
+func (b *SliceBuffer[T]) grow(n int) int {
 	m := b.Len()
 	if m == 0 && b.off != 0 {
 		b.Reset()
@@ -21,7 +21,7 @@ import (
 )
 
 func TestBuffer_Write(t *testing.T) {
-	b := &Buffer[int]{} // Assuming int for simplicity. You can change the type as needed.
+	b := &SliceBuffer[int]{} // Assuming int for simplicity. You can change the type as needed.
 	values := []int{1, 2, 3, 4, 5}
 
 	for _, v := range values {
@@ -40,7 +40,7 @@ func TestBuffer_Write(t *testing.T) {
 }
 
 func TestBuffer_WriteSlice(t *testing.T) {
-	b := &Buffer[int]{} // Assuming int for simplicity. You can change the type as needed.
+	b := &SliceBuffer[int]{} // Assuming int for simplicity. You can change the type as needed.
 	slice := []int{1, 2, 3, 4, 5}
 
 	err := b.WriteSlice(slice)
@@ -57,7 +57,7 @@ func TestBuffer_WriteSlice(t *testing.T) {
 }
 
 func TestBuffer_Read(t *testing.T) {
-	b := &Buffer[int]{} // Assuming int for simplicity. You can change the type as needed.
+	b := &SliceBuffer[int]{} // Assuming int for simplicity. You can change the type as needed.
 	values := []int{1, 2, 3, 4, 5}
 
 	b.buf = values
@@ -81,7 +81,7 @@ func TestBuffer_Read(t *testing.T) {
 }
 
 func TestBuffer_ReadSlice(t *testing.T) {
-	b := &Buffer[int]{} // Assuming int for simplicity. You can change the type as needed.
+	b := &SliceBuffer[int]{} // Assuming int for simplicity. You can change the type as needed.
 	slice := []int{1, 2, 3, 4, 5}
 
 	b.buf = slice
@@ -0,0 +1,208 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/alttagil/sonic-go"
+)
+
+// The wav package reads cue points but does not write them and skips the labels, so the tool
+// copies the cue and LIST chunks of the input by itself, moving their positions with the markers
+// of the stream.
+
+// cuePointSize is the size of a cue point in a cue chunk.
+const cuePointSize = 24
+
+// wavMarkers holds the cue points and the LIST chunks, INFO and adtl, of a WAV file.
+type wavMarkers struct {
+	cues  [][]byte
+	lists [][]byte
+	// ltxt are the offsets of the labelled text entries in lists, as pairs of list index and
+	// offset of the entry data.
+	ltxt [][2]int
+}
+
+// readWAVMarkers reads the cue and LIST chunks of the WAV file r and leaves r at its start.
+func readWAVMarkers(r io.ReadSeeker) (*wavMarkers, error) {
+	m := &wavMarkers{}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var riff [12]byte
+	if _, err := io.ReadFull(r, riff[:]); err != nil || string(riff[0:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		return nil, errNotWAV
+	}
+
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			break
+		}
+		id := string(hdr[0:4])
+		size := int64(binary.LittleEndian.Uint32(hdr[4:8]))
+		if id != "cue " && id != "LIST" {
+			if _, err := r.Seek(size+size&1, io.SeekCurrent); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		chunk := make([]byte, size+size&1)
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		chunk = chunk[:size]
+		if id == "cue " {
+			m.readCues(chunk)
+		} else {
+			m.readList(chunk)
+		}
+	}
+
+	_, err := r.Seek(0, io.SeekStart)
+	return m, err
+}
+
+// readCues adds the cue points of a cue chunk.
+func (m *wavMarkers) readCues(chunk []byte) {
+	if len(chunk) < 4 {
+		return
+	}
+	n := int(binary.LittleEndian.Uint32(chunk[0:4]))
+	for i := 0; i < n && 4+(i+1)*cuePointSize <= len(chunk); i++ {
+		m.cues = append(m.cues, chunk[4+i*cuePointSize:4+(i+1)*cuePointSize])
+	}
+}
+
+// readList adds a LIST chunk and notes the labelled text entries of an adtl list.
+func (m *wavMarkers) readList(chunk []byte) {
+	list := len(m.lists)
+	m.lists = append(m.lists, chunk)
+	if len(chunk) < 4 || string(chunk[0:4]) != "adtl" {
+		return
+	}
+	for off := 4; off+8 <= len(chunk); {
+		size := int(binary.LittleEndian.Uint32(chunk[off+4 : off+8]))
+		if string(chunk[off:off+4]) == "ltxt" && size >= 8 && off+8+size <= len(chunk) {
+			m.ltxt = append(m.ltxt, [2]int{list, off + 8})
+		}
+		off += 8 + size + size&1
+	}
+}
+
+// markers returns a stream marker for each cue point, with the index of the cue point as its ID,
+// and one for the end of each labelled text entry, with IDs after those of the cue points.
+func (m *wavMarkers) markers() []sonic.Marker {
+	var markers []sonic.Marker
+	for i, cue := range m.cues {
+		markers = append(markers, sonic.Marker{Pos: cueOffset(cue), ID: i})
+	}
+	for i, e := range m.ltxt {
+		data := m.lists[e[0]][e[1]:]
+		if start, ok := m.cueAt(data[0:4]); ok {
+			end := start + int(binary.LittleEndian.Uint32(data[4:8]))
+			markers = append(markers, sonic.Marker{Pos: end, ID: len(m.cues) + i})
+		}
+	}
+	return markers
+}
+
+// cueAt returns the position of the cue point with the given ID.
+func (m *wavMarkers) cueAt(id []byte) (int, bool) {
+	for _, cue := range m.cues {
+		if bytes.Equal(cue[0:4], id) {
+			return cueOffset(cue), true
+		}
+	}
+	return 0, false
+}
+
+// cueOffset returns the frame position of a cue point in uncompressed PCM data.
+func cueOffset(cue []byte) int {
+	return int(binary.LittleEndian.Uint32(cue[20:24]))
+}
+
+// move sets the cue points and the lengths of the labelled text entries to the positions of the
+// output markers. Cue points whose marker is missing keep their position.
+func (m *wavMarkers) move(out []sonic.Marker) {
+	pos := make(map[int]int, len(out))
+	for _, marker := range out {
+		pos[marker.ID] = marker.Pos
+	}
+
+	for i, cue := range m.cues {
+		p, ok := pos[i]
+		if !ok {
+			continue
+		}
+		// Without a play list the play position is 0; otherwise it follows the sample offset.
+		if binary.LittleEndian.Uint32(cue[4:8]) != 0 {
+			binary.LittleEndian.PutUint32(cue[4:8], uint32(p))
+		}
+		binary.LittleEndian.PutUint32(cue[20:24], uint32(p))
+	}
+	for i, e := range m.ltxt {
+		data := m.lists[e[0]][e[1]:]
+		end, ok := pos[len(m.cues)+i]
+		start, found := m.cueAt(data[0:4])
+		if ok && found {
+			binary.LittleEndian.PutUint32(data[4:8], uint32(max(end-start, 0)))
+		}
+	}
+}
+
+// write appends the cue and LIST chunks to the complete WAV file w and updates its RIFF size.
+func (m *wavMarkers) write(w io.WriteSeeker) error {
+	if len(m.cues) == 0 && len(m.lists) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	if len(m.cues) > 0 {
+		buf.WriteString("cue ")
+		_ = binary.Write(&buf, binary.LittleEndian, uint32(4+len(m.cues)*cuePointSize))
+		_ = binary.Write(&buf, binary.LittleEndian, uint32(len(m.cues)))
+		for _, cue := range m.cues {
+			buf.Write(cue)
+		}
+	}
+	for _, list := range m.lists {
+		buf.WriteString("LIST")
+		_ = binary.Write(&buf, binary.LittleEndian, uint32(len(list)))
+		buf.Write(list)
+		if len(list)%2 != 0 {
+			buf.WriteByte(0)
+		}
+	}
+
+	end, err := w.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if _, err := w.Seek(4, io.SeekStart); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(end+int64(buf.Len())-8)); err != nil {
+		return err
+	}
+	_, err = w.Seek(0, io.SeekEnd)
+	return err
+}
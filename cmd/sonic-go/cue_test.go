@@ -0,0 +1,166 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alttagil/sonic-go"
+	"github.com/go-audio/audio"
+	"github.com/go-audio/wav"
+)
+
+// cuePoint returns a cue point without a play list at a frame.
+func cuePoint(id string, frame int) []byte {
+	cue := make([]byte, cuePointSize)
+	copy(cue[0:4], id)
+	copy(cue[8:12], "data")
+	binary.LittleEndian.PutUint32(cue[20:24], uint32(frame))
+	return cue
+}
+
+// subChunk returns a RIFF chunk with a padded body.
+func subChunk(id string, body []byte) []byte {
+	out := append([]byte(id), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...)
+	out = append(out, body...)
+	if len(body)%2 != 0 {
+		out = append(out, 0)
+	}
+	return out
+}
+
+// writeTestWAV writes a mono 16-bit WAV file of a sine with the given cue and LIST chunks.
+func writeTestWAV(t *testing.T, path string, sampleRate, frames int, m *wavMarkers) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	enc := wav.NewEncoder(f, sampleRate, 16, 1, 1)
+	pcm := sinePCM(sampleRate, frames)
+	buf := &audio.IntBuffer{Format: &audio.Format{SampleRate: sampleRate, NumChannels: 1}, SourceBitDepth: 16}
+	for i := 0; i < len(pcm); i += 2 {
+		buf.Data = append(buf.Data, int(int16(binary.LittleEndian.Uint16(pcm[i:]))))
+	}
+	if err := enc.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.write(f); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWAVMarkers(t *testing.T) {
+	const sampleRate, frames = 16000, 32000
+	dir := t.TempDir()
+	in, out := filepath.Join(dir, "in.wav"), filepath.Join(dir, "out.wav")
+
+	ltxt := append([]byte("2\x00\x00\x00"), binary.LittleEndian.AppendUint32(nil, 8000)...)
+	ltxt = append(ltxt, "rgn 0000"...)
+	adtl := append([]byte("adtl"), subChunk("labl", []byte("1\x00\x00\x00verse\x00"))...)
+	adtl = append(adtl, subChunk("ltxt", ltxt)...)
+	info := append([]byte("INFO"), subChunk("INAM", []byte("test\x00"))...)
+	writeTestWAV(t, in, sampleRate, frames, &wavMarkers{
+		cues:  [][]byte{cuePoint("1\x00\x00\x00", 4000), cuePoint("2\x00\x00\x00", 16000)},
+		lists: [][]byte{adtl, info},
+	})
+
+	f, err := os.Open(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	meta, err := readWAVMarkers(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meta.cues) != 2 || len(meta.lists) != 2 || len(meta.ltxt) != 1 {
+		t.Fatalf("%d cue points, %d lists and %d labelled texts", len(meta.cues), len(meta.lists), len(meta.ltxt))
+	}
+
+	// Process at double speed like the command does.
+	decoder := wav.NewDecoder(f)
+	decoder.ReadInfo()
+	stream := sonic.NewSonicStream(sampleRate, 1)
+	stream.SetSpeed(2)
+	for _, m := range meta.markers() {
+		stream.AddMarker(m)
+	}
+	of, err := os.Create(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer of.Close()
+	enc := wav.NewEncoder(of, sampleRate, 16, 1, 1)
+	markers := processStream(decoder, stream, enc, &audio.IntBuffer{SourceBitDepth: 16}, 1024)
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	meta.move(markers)
+	if err := meta.write(of); err != nil {
+		t.Fatal(err)
+	}
+
+	// The wav package reads the moved cue points and the samples.
+	if _, err := of.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	d := wav.NewDecoder(of)
+	d.ReadMetadata()
+	if d.Err() != nil || d.Metadata == nil || len(d.Metadata.CuePoints) != 2 || d.Metadata.Title != "test" {
+		t.Fatalf("metadata %+v, %v", d.Metadata, d.Err())
+	}
+	maxPeriod := uint32(sampleRate / sonic.MinPitch)
+	for i, want := range []uint32{2000, 8000} {
+		if got := d.Metadata.CuePoints[i].SampleOffset; got+maxPeriod < want || got > want+maxPeriod {
+			t.Errorf("cue point %d at %d, want about %d", i, got, want)
+		}
+	}
+	if _, err := of.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	d = wav.NewDecoder(of)
+	pcm, err := d.FullPCMBuffer()
+	if err != nil || abs(len(pcm.Data)-frames/2) > 1 {
+		t.Errorf("%d frames, %v", len(pcm.Data), err)
+	}
+
+	moved, err := readWAVMarkers(of)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(moved.lists[1], info) || !bytes.Contains(moved.lists[0], []byte("verse")) {
+		t.Error("LIST chunks not copied")
+	}
+	e := moved.ltxt[0]
+	if got := binary.LittleEndian.Uint32(moved.lists[e[0]][e[1]+4:]); got+maxPeriod < 4000 || got > 4000+maxPeriod {
+		t.Errorf("labelled text length %d, want about 4000", got)
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
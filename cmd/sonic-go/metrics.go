@@ -0,0 +1,113 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the request duration histogram.
+var durationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// metrics collects service counters and exposes them in the Prometheus text format.
+type metrics struct {
+	inFlight      atomic.Int64
+	inputSamples  atomic.Int64
+	outputSamples atomic.Int64
+
+	mu       sync.Mutex
+	requests map[int]int64
+	buckets  []int64
+	durSum   float64
+	durCount int64
+}
+
+// newMetrics creates an empty metrics set.
+func newMetrics() *metrics {
+	return &metrics{
+		requests: make(map[int]int64),
+		buckets:  make([]int64, len(durationBuckets)),
+	}
+}
+
+// countRequest counts a finished request by its status code.
+func (m *metrics) countRequest(code int) {
+	m.mu.Lock()
+	m.requests[code]++
+	m.mu.Unlock()
+}
+
+// observeDuration records the processing time of a request.
+func (m *metrics) observeDuration(d time.Duration) {
+	sec := d.Seconds()
+	m.mu.Lock()
+	for i, le := range durationBuckets {
+		if sec <= le {
+			m.buckets[i]++
+		}
+	}
+	m.durSum += sec
+	m.durCount++
+	m.mu.Unlock()
+}
+
+// handle writes all metrics in the Prometheus text exposition format.
+func (m *metrics) handle(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+
+	m.mu.Lock()
+	codes := make([]int, 0, len(m.requests))
+	for code := range m.requests {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+
+	b.WriteString("# HELP sonic_http_requests_total Processed HTTP requests by status code.\n")
+	b.WriteString("# TYPE sonic_http_requests_total counter\n")
+	for _, code := range codes {
+		fmt.Fprintf(&b, "sonic_http_requests_total{code=\"%d\"} %d\n", code, m.requests[code])
+	}
+
+	b.WriteString("# HELP sonic_request_duration_seconds Time spent processing audio requests.\n")
+	b.WriteString("# TYPE sonic_request_duration_seconds histogram\n")
+	for i, le := range durationBuckets {
+		fmt.Fprintf(&b, "sonic_request_duration_seconds_bucket{le=\"%g\"} %d\n", le, m.buckets[i])
+	}
+	fmt.Fprintf(&b, "sonic_request_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.durCount)
+	fmt.Fprintf(&b, "sonic_request_duration_seconds_sum %g\n", m.durSum)
+	fmt.Fprintf(&b, "sonic_request_duration_seconds_count %d\n", m.durCount)
+	m.mu.Unlock()
+
+	b.WriteString("# HELP sonic_requests_in_flight Requests currently being processed.\n")
+	b.WriteString("# TYPE sonic_requests_in_flight gauge\n")
+	fmt.Fprintf(&b, "sonic_requests_in_flight %d\n", m.inFlight.Load())
+
+	b.WriteString("# HELP sonic_input_samples_total Input frames received.\n")
+	b.WriteString("# TYPE sonic_input_samples_total counter\n")
+	fmt.Fprintf(&b, "sonic_input_samples_total %d\n", m.inputSamples.Load())
+
+	b.WriteString("# HELP sonic_output_samples_total Output frames sent.\n")
+	b.WriteString("# TYPE sonic_output_samples_total counter\n")
+	fmt.Fprintf(&b, "sonic_output_samples_total %d\n", m.outputSamples.Load())
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write([]byte(b.String()))
+}
@@ -0,0 +1,423 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alttagil/sonic-go"
+)
+
+// serveFrames is the number of frames read from a request body per processing step.
+const serveFrames = 4096
+
+// The formats the service accepts, for raw PCM parameters and WAV headers alike.
+const (
+	minSampleRate = 1000
+	maxSampleRate = 384000
+	maxChannels   = 32
+)
+
+// The connection timeouts of the service. Reading the body is bounded by the processing timeout.
+const (
+	readHeaderTimeout = 10 * time.Second
+	idleTimeout       = 2 * time.Minute
+)
+
+// serverConfig holds the limits and the listen address of the HTTP service.
+type serverConfig struct {
+	addr          string
+	maxBodyBytes  int64
+	maxConcurrent int
+	maxDuration   time.Duration
+	timeout       time.Duration
+}
+
+// server processes audio posted over HTTP with a sonic Stream per request.
+type server struct {
+	cfg     serverConfig
+	sem     chan struct{}
+	metrics *metrics
+}
+
+// errTooLong is returned when the posted audio is longer than the configured maximum duration.
+var errTooLong = errors.New("audio is longer than the allowed duration")
+
+// serve parses the serve subcommand flags and runs the HTTP service until it fails.
+func serve(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	cfg := serverConfig{}
+	fs.StringVar(&cfg.addr, "addr", ":8080", "Listen address.")
+	fs.Int64Var(&cfg.maxBodyBytes, "max-body", 64<<20, "Maximum request body size in bytes.")
+	fs.IntVar(&cfg.maxConcurrent, "max-concurrent", 16, "Maximum number of requests processed at once.")
+	fs.DurationVar(&cfg.maxDuration, "max-duration", 30*time.Minute, "Maximum duration of the posted audio.")
+	fs.DurationVar(&cfg.timeout, "timeout", 5*time.Minute, "Maximum time spent processing a single request.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	srv := newServer(cfg)
+	log.Println("Listening on", cfg.addr)
+	return srv.httpServer().ListenAndServe()
+}
+
+// httpServer returns an http.Server for the service, with timeouts so that slow clients cannot
+// hold a concurrency slot indefinitely.
+func (s *server) httpServer() *http.Server {
+	return &http.Server{
+		Addr:              s.cfg.addr,
+		Handler:           s.routes(),
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       s.cfg.timeout,
+		IdleTimeout:       idleTimeout,
+	}
+}
+
+// newServer creates a server with the given limits.
+func newServer(cfg serverConfig) *server {
+	if cfg.maxConcurrent < 1 {
+		cfg.maxConcurrent = 1
+	}
+	return &server{
+		cfg:     cfg,
+		sem:     make(chan struct{}, cfg.maxConcurrent),
+		metrics: newMetrics(),
+	}
+}
+
+// routes returns the handler serving the processing, health and metrics endpoints.
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/process", s.handleProcess)
+	mux.HandleFunc("/healthz", s.handleHealth)
+	mux.HandleFunc("/metrics", s.metrics.handle)
+	return mux
+}
+
+// handleHealth reports that the service is up.
+func (s *server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = io.WriteString(w, "ok\n")
+}
+
+// processParams holds the query parameters of a processing request.
+type processParams struct {
+	speed, pitch, rate, volume float64
+	quality                    bool
+
+	// sampleRate and channels describe raw PCM bodies. They are ignored for WAV.
+	sampleRate, channels int
+}
+
+// parseProcessParams reads and validates the query parameters of a processing request.
+func parseProcessParams(r *http.Request) (processParams, error) {
+	q := r.URL.Query()
+	p := processParams{sampleRate: 16000, channels: 1}
+
+	var err error
+	if p.speed, err = floatParam(q.Get("speed"), "speed", false); err != nil {
+		return p, err
+	}
+	if p.pitch, err = floatParam(q.Get("pitch"), "pitch", false); err != nil {
+		return p, err
+	}
+	if p.rate, err = floatParam(q.Get("rate"), "rate", false); err != nil {
+		return p, err
+	}
+	if p.volume, err = floatParam(q.Get("volume"), "volume", true); err != nil {
+		return p, err
+	}
+	if v := q.Get("quality"); v != "" {
+		if p.quality, err = strconv.ParseBool(v); err != nil {
+			return p, fmt.Errorf("invalid quality %q", v)
+		}
+	}
+	if v := q.Get("sample_rate"); v != "" {
+		if p.sampleRate, err = strconv.Atoi(v); err != nil || p.sampleRate < minSampleRate || p.sampleRate > maxSampleRate {
+			return p, fmt.Errorf("invalid sample_rate %q", v)
+		}
+	}
+	if v := q.Get("channels"); v != "" {
+		if p.channels, err = strconv.Atoi(v); err != nil || p.channels < 1 || p.channels > maxChannels {
+			return p, fmt.Errorf("invalid channels %q", v)
+		}
+	}
+	return p, nil
+}
+
+// validFormat reports whether the service accepts a PCM format.
+func validFormat(format pcmFormat) bool {
+	return format.sampleRate >= minSampleRate && format.sampleRate <= maxSampleRate &&
+		format.channels >= 1 && format.channels <= maxChannels
+}
+
+// floatParam parses an optional positive float parameter defaulting to 1.0.
+func floatParam(v, name string, allowZero bool) (float64, error) {
+	if v == "" {
+		return 1.0, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) || f < 0 || (f == 0 && !allowZero) || f > 100 {
+		return 0, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return f, nil
+}
+
+// handleProcess processes a posted WAV or raw 16-bit little-endian PCM body and
+// streams the result back using chunked encoding.
+func (s *server) handleProcess(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		s.fail(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	select {
+	case s.sem <- struct{}{}:
+		defer func() { <-s.sem }()
+	default:
+		w.Header().Set("Retry-After", "1")
+		s.fail(w, http.StatusServiceUnavailable, "too many concurrent requests")
+		return
+	}
+
+	s.metrics.inFlight.Add(1)
+	defer s.metrics.inFlight.Add(-1)
+	start := time.Now()
+	defer func() { s.metrics.observeDuration(time.Since(start)) }()
+
+	params, err := parseProcessParams(r)
+	if err != nil {
+		s.fail(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx := r.Context()
+	if s.cfg.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.cfg.timeout)
+		defer cancel()
+	}
+
+	// Output is streamed while the body is still being read, which HTTP/1.x
+	// servers only allow once full duplex has been enabled.
+	_ = http.NewResponseController(w).EnableFullDuplex()
+	body := bufio.NewReader(http.MaxBytesReader(w, r.Body, s.cfg.maxBodyBytes))
+
+	isWAV := false
+	if head, err := body.Peek(4); err == nil && string(head) == "RIFF" {
+		isWAV = true
+	} else if ct := r.Header.Get("Content-Type"); strings.HasPrefix(ct, "audio/wav") || strings.HasPrefix(ct, "audio/x-wav") {
+		isWAV = true
+	}
+
+	// Chunks after the PCM data, such as LIST or cue, are not audio.
+	var src io.Reader = body
+	if isWAV {
+		format, size, err := readWAVHeader(body)
+		if err == nil && !validFormat(format) {
+			err = errUnsupportedWAV
+		}
+		if err != nil {
+			s.fail(w, statusFor(err), err.Error())
+			return
+		}
+		params.sampleRate, params.channels = format.sampleRate, format.channels
+		if size != unknownDataSize {
+			src = io.LimitReader(body, size)
+		}
+		w.Header().Set("Content-Type", "audio/wav")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	w.Header().Set("X-Sample-Rate", strconv.Itoa(params.sampleRate))
+	w.Header().Set("X-Channels", strconv.Itoa(params.channels))
+
+	out := &responseWriter{w: w, wav: isWAV, format: pcmFormat{sampleRate: params.sampleRate, channels: params.channels}}
+	if err := s.process(ctx, src, out, params); err != nil {
+		if !out.started {
+			s.fail(w, statusFor(err), err.Error())
+			return
+		}
+		// The status line has already been sent, so abort the connection to let
+		// the client know that the response is incomplete.
+		s.metrics.countRequest(http.StatusInternalServerError)
+		log.Println("process:", err)
+		panic(http.ErrAbortHandler)
+	}
+	if !out.started {
+		// Nothing was produced, still reply with a valid (empty) stream.
+		if err := out.start(); err != nil {
+			return
+		}
+	}
+	s.metrics.countRequest(http.StatusOK)
+}
+
+// process runs the body through a sonic Stream, writing the output as it becomes available.
+func (s *server) process(ctx context.Context, body io.Reader, out *responseWriter, p processParams) error {
+	stream := sonic.NewSonicStream(p.sampleRate, p.channels)
+	stream.SetSpeed(p.speed)
+	stream.SetPitch(p.pitch)
+	stream.SetRate(p.rate)
+	stream.SetVolume(p.volume)
+	stream.SetQuality(p.quality)
+
+	maxFrames := int64(math.MaxInt64)
+	if s.cfg.maxDuration > 0 {
+		maxFrames = int64(s.cfg.maxDuration.Seconds() * float64(p.sampleRate))
+	}
+
+	frameBytes := 2 * p.channels
+	raw := make([]byte, serveFrames*frameBytes)
+	samples := make([]int16, serveFrames*p.channels)
+	pending := 0
+	var frames int64
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		n, rerr := body.Read(raw[pending:])
+		pending += n
+		whole := pending - pending%frameBytes
+		if whole > 0 {
+			frames += int64(whole / frameBytes)
+			if frames > maxFrames {
+				return errTooLong
+			}
+
+			s16 := samples[:whole/2]
+			for i := range s16 {
+				s16[i] = int16(uint16(raw[2*i]) | uint16(raw[2*i+1])<<8)
+			}
+			copy(raw, raw[whole:pending])
+			pending -= whole
+
+			if err := stream.Write(s16); err != nil {
+				return err
+			}
+			s.metrics.inputSamples.Add(int64(len(s16) / p.channels))
+			if err := s.drain(stream, out); err != nil {
+				return err
+			}
+		}
+
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+
+	if err := stream.Flush(); err != nil {
+		return err
+	}
+	return s.drain(stream, out)
+}
+
+// drain writes everything the stream has produced so far to the response.
+func (s *server) drain(stream *sonic.Stream, out *responseWriter) error {
+	for stream.NumOutputSamples() > 0 {
+		samples, err := stream.Read(serveFrames)
+		if err != nil {
+			return err
+		}
+		if err := out.write(samples); err != nil {
+			return err
+		}
+		s.metrics.outputSamples.Add(int64(len(samples) / stream.GetNumChannels()))
+	}
+	return out.flush()
+}
+
+// fail replies with an error message and counts the request.
+func (s *server) fail(w http.ResponseWriter, code int, msg string) {
+	s.metrics.countRequest(code)
+	http.Error(w, msg, code)
+}
+
+// statusFor maps processing errors to HTTP status codes.
+func statusFor(err error) int {
+	var maxBytes *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytes), errors.Is(err, errTooLong):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, errNotWAV), errors.Is(err, errUnsupportedWAV), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, sonic.ErrChannels):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// responseWriter encodes int16 samples into an HTTP response, writing the WAV
+// header in front of the first samples when the request carried a WAV body.
+type responseWriter struct {
+	w       http.ResponseWriter
+	wav     bool
+	format  pcmFormat
+	started bool
+	buf     []byte
+}
+
+// start sends the status line and, for WAV responses, the header.
+func (rw *responseWriter) start() error {
+	rw.started = true
+	rw.w.WriteHeader(http.StatusOK)
+	if rw.wav {
+		return writeWAVHeader(rw.w, rw.format)
+	}
+	return nil
+}
+
+// write encodes samples as 16-bit little-endian PCM.
+func (rw *responseWriter) write(samples []int16) error {
+	if !rw.started {
+		if err := rw.start(); err != nil {
+			return err
+		}
+	}
+	rw.buf = rw.buf[:0]
+	for _, v := range samples {
+		rw.buf = append(rw.buf, byte(v), byte(uint16(v)>>8))
+	}
+	_, err := rw.w.Write(rw.buf)
+	return err
+}
+
+// flush pushes buffered response data to the client as a chunk.
+func (rw *responseWriter) flush() error {
+	if !rw.started {
+		return nil
+	}
+	if f, ok := rw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testServer(t *testing.T, cfg serverConfig) (*server, *httptest.Server) {
+	t.Helper()
+	if cfg.maxBodyBytes == 0 {
+		cfg.maxBodyBytes = 64 << 20
+	}
+	if cfg.maxConcurrent == 0 {
+		cfg.maxConcurrent = 4
+	}
+	srv := newServer(cfg)
+	ts := httptest.NewServer(srv.routes())
+	t.Cleanup(ts.Close)
+	return srv, ts
+}
+
+func sinePCM(sampleRate, frames int) []byte {
+	out := make([]byte, 0, 2*frames)
+	for i := 0; i < frames; i++ {
+		v := int16(8000 * math.Sin(2*math.Pi*200*float64(i)/float64(sampleRate)))
+		out = append(out, byte(v), byte(uint16(v)>>8))
+	}
+	return out
+}
+
+func TestServeWAV(t *testing.T) {
+	in, err := os.ReadFile("../../testdata/OSR_us_000_0010_8k.wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	format, _, err := readWAVHeader(bytes.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, ts := testServer(t, serverConfig{})
+	resp, err := http.Post(ts.URL+"/process?speed=2", "audio/wav", bytes.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	if len(resp.TransferEncoding) == 0 || resp.TransferEncoding[0] != "chunked" {
+		t.Errorf("expected chunked response, got %v", resp.TransferEncoding)
+	}
+
+	out, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outFormat, _, err := readWAVHeader(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outFormat != format {
+		t.Errorf("format %+v, want %+v", outFormat, format)
+	}
+
+	// Both files have a 44 byte header; the output should be about half as long.
+	ratio := float64(len(out)-44) / float64(len(in)-44)
+	if ratio < 0.45 || ratio > 0.55 {
+		t.Errorf("output/input ratio %.3f, want about 0.5", ratio)
+	}
+}
+
+func TestServeRawPCM(t *testing.T) {
+	_, ts := testServer(t, serverConfig{})
+	in := sinePCM(16000, 16000)
+
+	resp, err := http.Post(ts.URL+"/process?speed=0.5&sample_rate=16000&channels=1", "application/octet-stream", bytes.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("X-Sample-Rate"); got != "16000" {
+		t.Errorf("X-Sample-Rate %q", got)
+	}
+
+	out, _ := io.ReadAll(resp.Body)
+	ratio := float64(len(out)) / float64(len(in))
+	if ratio < 1.9 || ratio > 2.1 {
+		t.Errorf("output/input ratio %.3f, want about 2", ratio)
+	}
+}
+
+func TestServeWAVTrailingChunks(t *testing.T) {
+	pcm := sinePCM(16000, 16000)
+	var in bytes.Buffer
+	_ = writeWAVHeader(&in, pcmFormat{sampleRate: 16000, channels: 1})
+	wav := in.Bytes()
+	binary.LittleEndian.PutUint32(wav[40:44], uint32(len(pcm)))
+	in.Write(pcm)
+	info := append(binary.LittleEndian.AppendUint32([]byte("INFOICMT"), 4000), bytes.Repeat([]byte{0x55}, 4000)...)
+	in.Write(binary.LittleEndian.AppendUint32([]byte("LIST"), uint32(len(info))))
+	in.Write(info)
+
+	_, ts := testServer(t, serverConfig{})
+	resp, err := http.Post(ts.URL+"/process", "audio/wav", &in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	out, _ := io.ReadAll(resp.Body)
+	if frames := (len(out) - 44) / 2; frames < 16000 || frames > 16001 {
+		t.Errorf("%d frames, want the 16000 of the data chunk", frames)
+	}
+}
+
+func TestServeLimits(t *testing.T) {
+	srv, ts := testServer(t, serverConfig{maxBodyBytes: 1000, maxConcurrent: 1, maxDuration: 10 * time.Millisecond})
+
+	t.Run("body", func(t *testing.T) {
+		resp, err := http.Post(ts.URL+"/process?sample_rate=8000", "application/octet-stream", bytes.NewReader(make([]byte, 4000)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("status %d, want 413", resp.StatusCode)
+		}
+	})
+
+	t.Run("duration", func(t *testing.T) {
+		// 10ms at 16kHz is 160 frames; send 400.
+		resp, err := http.Post(ts.URL+"/process", "application/octet-stream", bytes.NewReader(sinePCM(16000, 400)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("status %d, want 413", resp.StatusCode)
+		}
+	})
+
+	t.Run("concurrency", func(t *testing.T) {
+		srv.sem <- struct{}{}
+		defer func() { <-srv.sem }()
+
+		resp, err := http.Post(ts.URL+"/process", "application/octet-stream", bytes.NewReader(sinePCM(16000, 10)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("status %d, want 503", resp.StatusCode)
+		}
+	})
+
+	t.Run("params", func(t *testing.T) {
+		resp, err := http.Post(ts.URL+"/process?speed=-1", "application/octet-stream", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("status %d, want 400", resp.StatusCode)
+		}
+	})
+
+	t.Run("wav format", func(t *testing.T) {
+		for _, format := range []pcmFormat{{sampleRate: 1 << 30, channels: 1}, {sampleRate: 16000, channels: 65535}} {
+			var in bytes.Buffer
+			_ = writeWAVHeader(&in, format)
+			resp, err := http.Post(ts.URL+"/process", "audio/wav", &in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("%+v: status %d, want 400", format, resp.StatusCode)
+			}
+		}
+	})
+
+	t.Run("method", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + "/process")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("status %d, want 405", resp.StatusCode)
+		}
+	})
+}
+
+func TestServeTimeouts(t *testing.T) {
+	hs := newServer(serverConfig{addr: ":0", timeout: time.Minute}).httpServer()
+	if hs.ReadHeaderTimeout <= 0 || hs.ReadTimeout != time.Minute || hs.IdleTimeout <= 0 {
+		t.Errorf("timeouts %v %v %v", hs.ReadHeaderTimeout, hs.ReadTimeout, hs.IdleTimeout)
+	}
+}
+
+func TestServeHealthAndMetrics(t *testing.T) {
+	_, ts := testServer(t, serverConfig{})
+
+	resp, err := http.Get(ts.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("healthz status %d", resp.StatusCode)
+	}
+
+	resp, err = http.Post(ts.URL+"/process?speed=1.5", "application/octet-stream", bytes.NewReader(sinePCM(16000, 8000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	resp, err = http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	for _, want := range []string{
+		`sonic_http_requests_total{code="200"} 1`,
+		"sonic_input_samples_total 8000",
+		"sonic_requests_in_flight 0",
+		"sonic_request_duration_seconds_count 1",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics missing %q:\n%s", want, body)
+		}
+	}
+}
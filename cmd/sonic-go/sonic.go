@@ -20,21 +20,29 @@ import (
 	"github.com/go-audio/audio"
 	"github.com/go-audio/wav"
 	"log"
+	"math"
 	"os"
 	"time"
 )
 
 const BufLen = 4096
 
-var IntBuf = make([]int, BufLen)
-
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		if err := serve(os.Args[2:]); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
 	pitch := flag.Float64("p", 1.0, "Set pitch scaling factor.  1.3 means 30%% higher.")
 	rate := flag.Float64("r", 1.0, "Set playback rate.  2.0 means 2X faster, and 2X pitch.")
 	speed := flag.Float64("s", 1.0, "Set speed up factor.  2.0 means 2X faster.")
 	volume := flag.Float64("v", 1.0, "Set volume scale factor.  2.0 means 2X louder.")
 	in := flag.String("i", "", "Input WAV filename")
 	out := flag.String("o", "out.wav", "Output WAV filename")
+	duration := flag.Duration("duration", 0, "Fit the output to this duration, e.g. 30s.  Overrides -s.")
+	normalize := flag.String("normalize", "", "Normalize loudness to a target, e.g. -16LUFS, with a -1 dBTP limiter.")
 
 	flag.Parse()
 
@@ -44,6 +52,11 @@ func main() {
 	}
 	defer f.Close()
 
+	meta, err := readWAVMarkers(f)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
 	decoder := wav.NewDecoder(f)
 	decoder.ReadInfo()
 	format := decoder.Format()
@@ -53,6 +66,7 @@ func main() {
 	stream.SetSpeed(*speed)
 	stream.SetRate(*rate)
 	stream.SetVolume(*volume)
+	setNormalization(stream, *normalize)
 
 	of, err := os.Create(*out)
 	if err != nil {
@@ -60,37 +74,56 @@ func main() {
 	}
 	defer of.Close()
 
-	enc := wav.NewEncoder(of, format.SampleRate, 16, format.NumChannels, 1)
-	defer enc.Close()
+	bitDepth := int(decoder.BitDepth)
+	enc := wav.NewEncoder(of, format.SampleRate, bitDepth, format.NumChannels, 1)
 
-	intBufSamplesNum := len(IntBuf) / format.NumChannels
+	samplesNum := BufLen / format.NumChannels
+	outBuf := &audio.IntBuffer{SourceBitDepth: bitDepth}
 
-	s := make([]int16, 0, BufLen)
+	var markers []sonic.Marker
+	if *duration > 0 {
+		markers = fitToDuration(decoder, enc, outBuf, *pitch, *rate, *volume, *duration, *normalize, meta.markers())
+	} else {
+		for _, m := range meta.markers() {
+			stream.AddMarker(m)
+		}
+		markers = processStream(decoder, stream, enc, outBuf, samplesNum)
+	}
+
+	// The cue and LIST chunks go after the samples, so the encoder is closed first.
+	if err := enc.Close(); err != nil {
+		log.Fatalln(err)
+	}
+	meta.move(markers)
+	if err := meta.write(of); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// processStream runs the input through the stream and returns the markers of the stream at their
+// output positions.
+func processStream(decoder *wav.Decoder, stream *sonic.Stream, enc *wav.Encoder, outBuf *audio.IntBuffer, samplesNum int) []sonic.Marker {
+	format := decoder.Format()
+	var markers []sonic.Marker
 	var elapsedTime time.Duration
 
-	buf := &audio.IntBuffer{Data: IntBuf}
+	inBuf := &audio.IntBuffer{Data: make([]int, samplesNum*format.NumChannels)}
 	for {
-		samples, _ := decoder.PCMBuffer(buf)
+		inBuf.Data = inBuf.Data[:cap(inBuf.Data)]
+		samples, _ := decoder.PCMBuffer(inBuf)
 		if samples == 0 {
 			break
 		}
-
-		if buf.SourceBitDepth > 16 {
-			log.Fatalln("Not supported bit depth", buf.SourceBitDepth)
-		}
-
-		s = s[:0]
-		for i := 0; i < samples; i++ {
-			s = append(s, int16(buf.Data[i]))
-		}
+		inBuf.Data = inBuf.Data[:samples]
 
 		startTime := time.Now()
-		if err := stream.Write(s); err != nil {
+		if err := stream.WriteAudioBuffer(inBuf); err != nil {
 			log.Fatalln(err)
 		}
 		elapsedTime += time.Since(startTime)
 
-		writeSamples(stream, enc, format, intBufSamplesNum)
+		writeSamples(stream, enc, outBuf, samplesNum)
+		markers = append(markers, stream.ReadMarkers()...)
 	}
 
 	startTime := time.Now()
@@ -99,28 +132,92 @@ func main() {
 	}
 	elapsedTime += time.Since(startTime)
 
-	writeSamples(stream, enc, format, intBufSamplesNum)
+	writeSamples(stream, enc, outBuf, samplesNum)
+	markers = append(markers, stream.ReadMarkers()...)
 
 	log.Println("Processed in", elapsedTime)
+	return markers
 }
 
-func writeSamples(stream *sonic.Stream, enc *wav.Encoder, format *audio.Format, n int) {
+// fitToDuration reads the whole input, since the speed depends on its length, and writes
+// output lasting exactly target. It returns the markers moved in proportion.
+func fitToDuration(decoder *wav.Decoder, enc *wav.Encoder, buf *audio.IntBuffer, pitch, rate, volume float64, target time.Duration, normalize string, markers []sonic.Marker) []sonic.Marker {
+	format := decoder.Format()
+	in, err := decoder.FullPCMBuffer()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	samples, err := sonic.AppendAudioBuffer(nil, in)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	inLen := len(samples)
+	startTime := time.Now()
+	samples, err = sonic.ChangeSpeedToDuration(format.SampleRate, format.NumChannels, pitch, rate, volume, samples, target)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("Processed in", time.Since(startTime))
+
+	if normalize != "" {
+		samples = normalizeSamples(format.SampleRate, format.NumChannels, samples, normalize)
+	}
+
+	buf.Format = format
+	if buf.Data, err = sonic.AppendIntSamples(buf.Data[:0], samples, buf.SourceBitDepth); err != nil {
+		log.Fatalln(err)
+	}
+	if err := enc.Write(buf); err != nil {
+		log.Fatalln(err)
+	}
+
+	for i := range markers {
+		markers[i].Pos = int(math.Round(float64(markers[i].Pos) * float64(len(samples)) / float64(max(inLen, 1))))
+	}
+	return markers
+}
+
+// normalizeSamples normalizes the loudness of samples keeping their length.
+func normalizeSamples(sampleRate, numChannels int, samples []int16, target string) []int16 {
+	stream := sonic.NewSonicStream(sampleRate, numChannels)
+	setNormalization(stream, target)
+	if err := stream.Write(samples); err != nil {
+		log.Fatalln(err)
+	}
+	if err := stream.Flush(); err != nil {
+		log.Fatalln(err)
+	}
+	out, err := stream.ReadAll()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	// Flush may return a frame fewer than it was given; pad with silence to keep the length.
+	if len(out) < len(samples) {
+		out = append(out, make([]int16, len(samples)-len(out))...)
+	}
+	return out[:len(samples)]
+}
+
+// setNormalization enables loudness normalization if a target was given.
+func setNormalization(stream *sonic.Stream, target string) {
+	if target == "" {
+		return
+	}
+	lufs, err := sonic.ParseLoudness(target)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	stream.SetNormalization(lufs, sonic.DefaultTruePeak)
+}
+
+func writeSamples(stream *sonic.Stream, enc *wav.Encoder, buf *audio.IntBuffer, n int) {
 	for {
-		outs, err := stream.Read(n)
-		if err != nil {
+		if _, err := stream.ReadIntBuffer(buf, n); err != nil {
 			break
 		}
 
-		IntBuf = IntBuf[:0]
-		for i := range outs {
-			IntBuf = append(IntBuf, int(outs[i]))
-		}
-
-		if err := enc.Write(&audio.IntBuffer{
-			Format:         format,
-			SourceBitDepth: 16,
-			Data:           IntBuf,
-		}); err != nil {
+		if err := enc.Write(buf); err != nil {
 			log.Fatalln(err)
 		}
 	}
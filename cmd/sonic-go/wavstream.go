@@ -0,0 +1,117 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// The wav package decoder needs an io.ReadSeeker, which a request body is not,
+// so the service parses and writes the few WAV headers it needs by itself.
+
+var (
+	errNotWAV         = errors.New("body is not a RIFF/WAVE file")
+	errUnsupportedWAV = errors.New("only 16-bit PCM WAV is supported")
+)
+
+// pcmFormat describes an interleaved 16-bit PCM stream.
+type pcmFormat struct {
+	sampleRate int
+	channels   int
+}
+
+// unknownDataSize is the data chunk size of a WAV stream of unknown length.
+const unknownDataSize = 0xFFFFFFFF
+
+// readWAVHeader consumes the RIFF header and all chunks up to the start of the
+// PCM data, leaving r positioned at the first sample. It returns the size of the
+// data chunk in bytes, which is unknownDataSize for a stream of unknown length.
+func readWAVHeader(r io.Reader) (pcmFormat, int64, error) {
+	var format pcmFormat
+
+	var riff [12]byte
+	if _, err := io.ReadFull(r, riff[:]); err != nil {
+		return format, 0, errNotWAV
+	}
+	if string(riff[0:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		return format, 0, errNotWAV
+	}
+
+	haveFormat := false
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return format, 0, io.ErrUnexpectedEOF
+		}
+		id := string(hdr[0:4])
+		size := int64(binary.LittleEndian.Uint32(hdr[4:8]))
+
+		switch id {
+		case "fmt ":
+			if size < 16 || size > 1024 {
+				return format, 0, errUnsupportedWAV
+			}
+			chunk := make([]byte, size+size&1)
+			if _, err := io.ReadFull(r, chunk); err != nil {
+				return format, 0, io.ErrUnexpectedEOF
+			}
+			audioFormat := binary.LittleEndian.Uint16(chunk[0:2])
+			format.channels = int(binary.LittleEndian.Uint16(chunk[2:4]))
+			format.sampleRate = int(binary.LittleEndian.Uint32(chunk[4:8]))
+			bits := binary.LittleEndian.Uint16(chunk[14:16])
+			// 0xFFFE is WAVE_FORMAT_EXTENSIBLE, which carries plain PCM for our purposes.
+			if (audioFormat != 1 && audioFormat != 0xFFFE) || bits != 16 || format.channels < 1 || format.sampleRate < 1 {
+				return format, 0, errUnsupportedWAV
+			}
+			haveFormat = true
+		case "data":
+			if !haveFormat {
+				return format, 0, errNotWAV
+			}
+			return format, size, nil
+		default:
+			if _, err := io.CopyN(io.Discard, r, size+size&1); err != nil {
+				return format, 0, io.ErrUnexpectedEOF
+			}
+		}
+	}
+}
+
+// writeWAVHeader writes a 16-bit PCM WAV header for a stream of unknown length.
+// The RIFF and data sizes are set to 0xFFFFFFFF, which streaming readers treat
+// as "read until the end of the stream".
+func writeWAVHeader(w io.Writer, format pcmFormat) error {
+	var hdr [44]byte
+	blockAlign := 2 * format.channels
+
+	copy(hdr[0:4], "RIFF")
+	binary.LittleEndian.PutUint32(hdr[4:8], 0xFFFFFFFF)
+	copy(hdr[8:12], "WAVE")
+	copy(hdr[12:16], "fmt ")
+	binary.LittleEndian.PutUint32(hdr[16:20], 16)
+	binary.LittleEndian.PutUint16(hdr[20:22], 1)
+	binary.LittleEndian.PutUint16(hdr[22:24], uint16(format.channels))
+	binary.LittleEndian.PutUint32(hdr[24:28], uint32(format.sampleRate))
+	binary.LittleEndian.PutUint32(hdr[28:32], uint32(format.sampleRate*blockAlign))
+	binary.LittleEndian.PutUint16(hdr[32:34], uint16(blockAlign))
+	binary.LittleEndian.PutUint16(hdr[34:36], 16)
+	copy(hdr[36:40], "data")
+	binary.LittleEndian.PutUint32(hdr[40:44], unknownDataSize)
+
+	_, err := w.Write(hdr[:])
+	return err
+}
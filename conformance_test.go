@@ -0,0 +1,233 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonic
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var (
+	refgen = flag.String("refgen", "", "generate missing conformance references with this refgen binary")
+	refrev = flag.String("refrev", "", "revision of the C library the refgen binary is built from")
+)
+
+const (
+	conformanceDir = "./testdata/conformance"
+
+	// conformanceRevision names the file recording the revision of the C library the references
+	// were generated from.
+	conformanceRevision = "REVISION"
+
+	// conformanceSeconds is how much of each recording the conformance cases process.
+	conformanceSeconds = 4
+)
+
+// conformanceCase is a recording processed with a set of parameters.
+type conformanceCase struct {
+	file                       string
+	speed, pitch, rate, volume float64
+	quality                    bool
+}
+
+func (c conformanceCase) name() string {
+	q := 0
+	if c.quality {
+		q = 1
+	}
+	return fmt.Sprintf("%s_s%g_p%g_r%g_v%g_q%d", strings.TrimSuffix(c.file, ".wav"), c.speed, c.pitch, c.rate, c.volume, q)
+}
+
+// conformanceCases returns the matrix of recordings and parameters.
+func conformanceCases() []conformanceCase {
+	var cases []conformanceCase
+	for _, file := range []string{"OSR_us_000_0010_8k.wav", "OSR_us_000_0030_8k.wav", "stereo.wav"} {
+		for _, c := range []conformanceCase{
+			{speed: 1, pitch: 1, rate: 1, volume: 1},
+			{speed: 0.5, pitch: 1, rate: 1, volume: 1},
+			{speed: 0.8, pitch: 1, rate: 1, volume: 1},
+			{speed: 1.5, pitch: 1, rate: 1, volume: 1},
+			{speed: 2, pitch: 1, rate: 1, volume: 1},
+			{speed: 3, pitch: 1, rate: 1, volume: 1},
+			{speed: 0.8, pitch: 1, rate: 1, volume: 1, quality: true},
+			{speed: 1.5, pitch: 1, rate: 1, volume: 1, quality: true},
+			{speed: 1, pitch: 0.8, rate: 1, volume: 1},
+			{speed: 1, pitch: 1.3, rate: 1, volume: 1},
+			{speed: 1, pitch: 1, rate: 0.7, volume: 1},
+			{speed: 1, pitch: 1, rate: 1.4, volume: 1},
+			{speed: 1, pitch: 1, rate: 1, volume: 0.5},
+			{speed: 1, pitch: 1, rate: 1, volume: 0.8},
+			{speed: 1, pitch: 1, rate: 1, volume: 3},
+			{speed: 1.3, pitch: 1.2, rate: 0.9, volume: 1.5},
+		} {
+			c.file = file
+			cases = append(cases, c)
+		}
+	}
+	return cases
+}
+
+// divergence describes where got first differs from want, or returns "" if they are equal.
+func divergence(got, want []int16, channels, sampleRate int) string {
+	i := 0
+	for i < len(got) && i < len(want) && got[i] == want[i] {
+		i++
+	}
+	if i == len(got) && i == len(want) {
+		return ""
+	}
+
+	differ := 0
+	for j := i; j < min(len(got), len(want)); j++ {
+		if got[j] != want[j] {
+			differ++
+		}
+	}
+	at := fmt.Sprintf("first divergence at sample %d (frame %d, channel %d, %.4fs)", i, i/channels, i%channels, float64(i/channels)/float64(sampleRate))
+	if i < len(got) && i < len(want) {
+		lo, hi := max(i-2*channels, 0), i+2*channels
+		at += fmt.Sprintf(": got %d, want %d, around it %v, want %v", got[i], want[i], got[lo:min(hi, len(got))], want[lo:min(hi, len(want))])
+	}
+	return fmt.Sprintf("%s; %d of the %d common samples differ; %d frames, want %d",
+		at, differ, min(len(got), len(want)), len(got)/channels, len(want)/channels)
+}
+
+// readRaw reads interleaved 16-bit little-endian samples.
+func readRaw(path string) ([]int16, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]int16, len(data)/2)
+	for i := range out {
+		out[i] = int16(binary.LittleEndian.Uint16(data[2*i:]))
+	}
+	return out, nil
+}
+
+// generateReference runs refgen for a case.
+func generateReference(c conformanceCase, path string, frames int) error {
+	f := func(v float64) string { return strconv.FormatFloat(v, 'g', -1, 64) }
+	q := "0"
+	if c.quality {
+		q = "1"
+	}
+	cmd := exec.Command(*refgen, filepath.Join("./testdata", c.file), path, strconv.Itoa(frames), f(c.speed), f(c.pitch), f(c.rate), f(c.volume), q)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, out)
+	}
+	return nil
+}
+
+// conformanceRev returns the revision of the C library the references come from. With -refgen
+// it records the one given with -refrev.
+func conformanceRev() (string, error) {
+	path := filepath.Join(conformanceDir, conformanceRevision)
+	if *refgen != "" {
+		if *refrev == "" {
+			return "", errors.New("-refgen needs the revision of the C library in -refrev")
+		}
+		if err := os.WriteFile(path, []byte(*refrev+"\n"), 0o644); err != nil {
+			return "", err
+		}
+	}
+	rev, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("%v, see testdata/conformance/README.md", err)
+	}
+	return strings.TrimSpace(string(rev)), nil
+}
+
+// TestConformance compares the output of the port sample by sample with the output of the C
+// library in testdata/conformance. A missing reference fails; run with -refgen and -refrev to
+// generate them.
+func TestConformance(t *testing.T) {
+	rev, err := conformanceRev()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("references from the C library at %s", rev)
+
+	for _, c := range conformanceCases() {
+		c := c
+		t.Run(c.name(), func(t *testing.T) {
+			w, sampleRate, channels, err := readWAV(filepath.Join("./testdata", c.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			frames := min(conformanceSeconds*sampleRate, len(w)/channels)
+			w = w[:frames*channels]
+
+			path := filepath.Join(conformanceDir, c.name()+".raw")
+			if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) && *refgen != "" {
+				if err := generateReference(c, path, frames); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := readRaw(path)
+			if err != nil {
+				t.Fatalf("reference: %v, see testdata/conformance/README.md", err)
+			}
+
+			stream := NewSonicStream(sampleRate, channels)
+			stream.SetSpeed(c.speed)
+			stream.SetPitch(c.pitch)
+			stream.SetRate(c.rate)
+			stream.SetVolume(c.volume)
+			stream.SetQuality(c.quality)
+			if err := stream.AddSamples(w); err != nil {
+				t.Fatal(err)
+			}
+			if err := stream.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			got, err := stream.ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if d := divergence(got, want, channels, sampleRate); d != "" {
+				t.Error(d)
+			}
+		})
+	}
+}
+
+func TestDivergence(t *testing.T) {
+	want := []int16{1, 2, 3, 4, 5, 6}
+	for _, tc := range []struct {
+		got    []int16
+		prefix string
+	}{
+		{[]int16{1, 2, 3, 4, 5, 6}, ""},
+		{[]int16{1, 2, 3, 9, 5, 7}, "first divergence at sample 3 (frame 1, channel 1, 0.0010s): got 9, want 4"},
+		{[]int16{1, 2, 3, 4}, "first divergence at sample 4 (frame 2, channel 0, 0.0020s); 0 of the 4 common samples differ; 2 frames, want 3"},
+	} {
+		if d := divergence(tc.got, want, 2, 1000); !strings.HasPrefix(d, tc.prefix) || (tc.prefix == "") != (d == "") {
+			t.Errorf("%v: %q, want %q...", tc.got, d, tc.prefix)
+		}
+	}
+	if d := divergence([]int16{1, 2, 3, 9, 5, 7}, want, 2, 1000); !strings.Contains(d, "2 of the 6 common samples differ; 3 frames, want 3") {
+		t.Errorf("counts in %q", d)
+	}
+}
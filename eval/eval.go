@@ -0,0 +1,250 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package eval measures the quality of processed audio objectively by comparing it with the
+// original.
+//
+// The output is aligned with the original frame by frame: each output frame is matched to the
+// closest original frame near the position the speed and rate predict, and the original spectrum
+// is shifted by the pitch and rate so that the two line up in frequency. Compare then reports the
+// spectral distortion, the log-spectral distance and the pitch contour error over the aligned
+// frames, and the deviation of the output length from the expected length. All metrics are
+// lower for better output.
+package eval
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// ErrInput is returned for audio or options Compare cannot evaluate.
+var ErrInput = errors.New("invalid evaluation input")
+
+const (
+	// searchRadius is how many frames around the predicted position the alignment searches,
+	// enough for the drift of the time stretch by a few pitch periods.
+	searchRadius = 2
+
+	// floorRatio is the power, relative to the strongest bin of the original, below which the
+	// spectra are floored, so that quiet bins do not dominate the log-spectral distance.
+	floorRatio = 1e-6
+
+	// grossPitchError is the pitch error in cents, a fifth of the pitch, beyond which a frame
+	// counts as a gross error, typically an octave error of the pitch estimate.
+	grossPitchError = 315.64
+
+	// silenceRatio is the energy, relative to the loudest frame of the original, below which an
+	// original frame is silent and not compared.
+	silenceRatio = 1e-4
+)
+
+// Options describe how the output was produced from the original. Zero values mean 1.
+type Options struct {
+	Speed float64
+	Pitch float64
+	Rate  float64
+}
+
+// Report holds the metrics of an output.
+type Report struct {
+	// SpectralDistortion is the energy of the difference between the magnitude spectra of the
+	// output and of the original, relative to the energy of the original, in dB.
+	SpectralDistortion float64 `json:"spectral_distortion"`
+	// LogSpectralDistance is the RMS difference of the log power spectra in dB, averaged over
+	// frames.
+	LogSpectralDistance float64 `json:"log_spectral_distance"`
+	// PitchError is the RMS difference between the pitch of the output and the pitch of the
+	// original times pitch and rate, in cents, over the frames voiced in both, and
+	// GrossPitchErrors the fraction of those frames where they differ by more than a fifth of
+	// the pitch, which PitchError leaves out.
+	PitchError       float64 `json:"pitch_error"`
+	GrossPitchErrors float64 `json:"gross_pitch_errors"`
+	// DurationError is the relative deviation of the output length from the original length
+	// divided by speed and rate. Positive values mean the output is too long.
+	DurationError float64 `json:"duration_error"`
+	// Frames is the number of output frames compared and VoicedFrames the number of those the
+	// pitch error covers.
+	Frames       int `json:"frames"`
+	VoicedFrames int `json:"voiced_frames"`
+}
+
+// Tolerance is how much a metric may grow before Regressions reports it.
+type Tolerance struct {
+	// SpectralDistortion and LogSpectralDistance are in dB, PitchError in cents, and
+	// GrossPitchErrors and DurationError are fractions.
+	SpectralDistortion  float64
+	LogSpectralDistance float64
+	PitchError          float64
+	GrossPitchErrors    float64
+	DurationError       float64
+}
+
+// DefaultTolerance allows for small changes of the pitch period choices.
+var DefaultTolerance = Tolerance{
+	SpectralDistortion:  0.25,
+	LogSpectralDistance: 0.25,
+	PitchError:          5,
+	GrossPitchErrors:    0.01,
+	DurationError:       0.002,
+}
+
+// Regressions returns a description of each metric of r that is worse than in golden by more
+// than the tolerance, or nil. The duration error counts by its magnitude.
+func (r Report) Regressions(golden Report, tol Tolerance) []string {
+	var out []string
+	check := func(name string, got, want, tol float64, unit string) {
+		if got > want+tol {
+			out = append(out, fmt.Sprintf("%s %.4g%s, was %.4g%s", name, got, unit, want, unit))
+		}
+	}
+	check("spectral distortion", r.SpectralDistortion, golden.SpectralDistortion, tol.SpectralDistortion, " dB")
+	check("log-spectral distance", r.LogSpectralDistance, golden.LogSpectralDistance, tol.LogSpectralDistance, " dB")
+	check("pitch error", r.PitchError, golden.PitchError, tol.PitchError, " cents")
+	check("gross pitch errors", r.GrossPitchErrors, golden.GrossPitchErrors, tol.GrossPitchErrors, "")
+	check("duration error", math.Abs(r.DurationError), math.Abs(golden.DurationError), tol.DurationError, "")
+	return out
+}
+
+// Compare evaluates out, produced from original with the options, both interleaved 16-bit
+// samples with the given sample rate and channels. The channels are mixed down first. If no
+// frames could be compared, as for silence, only DurationError is set.
+func Compare(original, out []int16, sampleRate, channels int, o Options) (Report, error) {
+	if sampleRate <= 0 || channels < 1 || len(original)%channels != 0 || len(out)%channels != 0 || len(original) == 0 {
+		return Report{}, ErrInput
+	}
+	speed, pitch, rate := orOne(o.Speed), orOne(o.Pitch), orOne(o.Rate)
+	if speed <= 0 || pitch <= 0 || rate <= 0 {
+		return Report{}, fmt.Errorf("%w: speed %v, pitch %v, rate %v", ErrInput, speed, pitch, rate)
+	}
+	timeScale, shift := speed*rate, pitch*rate
+
+	x, y := mono(original, channels), mono(out, channels)
+	expected := float64(len(x)) / timeScale
+	report := Report{DurationError: (float64(len(y)) - expected) / expected}
+
+	size := frameSize(sampleRate)
+	hop := size / 2
+	ref, got := newSpectrogram(x, size, hop), newSpectrogram(y, size, hop)
+	floor := ref.peak * floorRatio
+	silence := 0.0
+	for _, e := range ref.energy {
+		silence = max(silence, e*silenceRatio)
+	}
+	// Above the top of the shifted original spectrum there is nothing to compare.
+	bins := min(size/2, int(float64(size/2)*shift))
+
+	var lsdSum, diffSum, refSum, pitchSum float64
+	fine := 0
+	for j, frame := range got.frames {
+		center := int(math.Round(float64(j) * timeScale))
+		best, bestLSD := -1, math.Inf(1)
+		for i := max(center-searchRadius, 0); i <= min(center+searchRadius, len(ref.frames)-1); i++ {
+			if ref.energy[i] < silence {
+				continue
+			}
+			if d := logSpectralDistance(frame, ref.frames[i], shift, bins, floor); d < bestLSD {
+				best, bestLSD = i, d
+			}
+		}
+		if best < 0 {
+			continue
+		}
+
+		report.Frames++
+		lsdSum += bestLSD
+		for k := 1; k <= bins; k++ {
+			p := warp(ref.frames[best], k, shift)
+			if p < 0 {
+				break
+			}
+			d := math.Sqrt(frame[k]) - math.Sqrt(p)
+			diffSum += d * d
+			refSum += p
+		}
+
+		pr := estimatePitch(segment(x, best*hop, size), sampleRate, minPitch, maxPitch)
+		po := estimatePitch(segment(y, j*hop, size), sampleRate, minPitch*shift, maxPitch*shift)
+		if pr > 0 && po > 0 {
+			report.VoicedFrames++
+			if cents := 1200 * math.Log2(po/(pr*shift)); math.Abs(cents) <= grossPitchError {
+				pitchSum += cents * cents
+				fine++
+			}
+		}
+	}
+
+	if report.Frames > 0 {
+		report.LogSpectralDistance = lsdSum / float64(report.Frames)
+		report.SpectralDistortion = 10 * math.Log10(max(diffSum, refSum*1e-12)/refSum)
+	}
+	if report.VoicedFrames > 0 {
+		report.GrossPitchErrors = float64(report.VoicedFrames-fine) / float64(report.VoicedFrames)
+	}
+	if fine > 0 {
+		report.PitchError = math.Sqrt(pitchSum / float64(fine))
+	}
+	return report, nil
+}
+
+// logSpectralDistance returns the RMS difference in dB between the power spectrum of an output
+// frame and the original spectrum shifted by shift, over the bins from 1 to bins.
+func logSpectralDistance(frame, original []float64, shift float64, bins int, floor float64) float64 {
+	sum, n := 0.0, 0
+	for k := 1; k <= bins; k++ {
+		p := warp(original, k, shift)
+		if p < 0 {
+			break
+		}
+		d := 10 * math.Log10(max(frame[k], floor)/max(p, floor))
+		sum += d * d
+		n++
+	}
+	if n == 0 {
+		return 0
+	}
+	return math.Sqrt(sum / float64(n))
+}
+
+// mono mixes interleaved samples down to one channel scaled to [-1, 1).
+func mono(samples []int16, channels int) []float64 {
+	out := make([]float64, len(samples)/channels)
+	for i := range out {
+		sum := 0
+		for c := 0; c < channels; c++ {
+			sum += int(samples[i*channels+c])
+		}
+		out[i] = float64(sum) / float64(channels) / 32768
+	}
+	return out
+}
+
+// segment returns n samples of x from start, padded with silence past its end.
+func segment(x []float64, start, n int) []float64 {
+	if start+n <= len(x) {
+		return x[start : start+n]
+	}
+	s := make([]float64, n)
+	if start < len(x) {
+		copy(s, x[start:])
+	}
+	return s
+}
+
+func orOne(v float64) float64 {
+	if v == 0 {
+		return 1
+	}
+	return v
+}
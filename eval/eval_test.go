@@ -0,0 +1,168 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eval
+
+import (
+	"errors"
+	"math"
+	"math/cmplx"
+	"math/rand"
+	"testing"
+)
+
+// tone returns n samples of a tone at f0 Hz with harmonics up to 3 kHz, whose pitch glides by
+// glide Hz per second, with noise at the given level relative to full scale.
+func tone(sampleRate int, f0, glide, noise float64, n int) []int16 {
+	rng := rand.New(rand.NewSource(1))
+	out := make([]int16, n)
+	phase := 0.0
+	for i := range out {
+		v := 0.0
+		for k := 1; float64(k)*f0 < 3000; k++ {
+			v += math.Sin(float64(k)*phase) / float64(k)
+		}
+		phase += 2 * math.Pi * (f0 + glide*float64(i)/float64(sampleRate)) / float64(sampleRate)
+		out[i] = int16(8000*v + noise*32767*rng.NormFloat64())
+	}
+	return out
+}
+
+func TestFFT(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	x := make([]complex128, 64)
+	for i := range x {
+		x[i] = complex(rng.Float64(), rng.Float64())
+	}
+	got := append([]complex128(nil), x...)
+	fft(got)
+	for k := range x {
+		var want complex128
+		for n := range x {
+			want += x[n] * cmplx.Exp(complex(0, -2*math.Pi*float64(k*n)/float64(len(x))))
+		}
+		if cmplx.Abs(got[k]-want) > 1e-9 {
+			t.Fatalf("bin %d: %v, want %v", k, got[k], want)
+		}
+	}
+}
+
+func TestEstimatePitch(t *testing.T) {
+	const sampleRate = 16000
+	size := frameSize(sampleRate)
+	for _, f0 := range []float64{70, 110, 220, 390} {
+		x := mono(tone(sampleRate, f0, 0, 0, size), 1)
+		if got := estimatePitch(x, sampleRate, minPitch, maxPitch); math.Abs(got-f0) > f0/200 {
+			t.Errorf("%v Hz tone: pitch %.2f Hz", f0, got)
+		}
+	}
+	rng := rand.New(rand.NewSource(1))
+	noise := make([]float64, size)
+	for i := range noise {
+		noise[i] = rng.NormFloat64()
+	}
+	if got := estimatePitch(noise, sampleRate, minPitch, maxPitch); got != 0 {
+		t.Errorf("noise: pitch %.2f Hz", got)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	const sampleRate = 16000
+	n := 2 * sampleRate
+	original := tone(sampleRate, 150, 50, 0, n)
+
+	same, err := Compare(original, original, sampleRate, 1, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if same.LogSpectralDistance > 1e-9 || same.SpectralDistortion > -100 || same.PitchError > 1e-6 || same.DurationError != 0 {
+		t.Errorf("identical audio: %+v", same)
+	}
+	if same.Frames < n/frameSize(sampleRate) || same.VoicedFrames < same.Frames*9/10 {
+		t.Errorf("identical audio: %d frames, %d voiced", same.Frames, same.VoicedFrames)
+	}
+
+	// Noise raises the spectral metrics but leaves the pitch.
+	noisy, _ := Compare(original, tone(sampleRate, 150, 50, 0.01, n), sampleRate, 1, Options{})
+	if noisy.LogSpectralDistance < 1 || noisy.SpectralDistortion < -40 || noisy.SpectralDistortion > -10 || noisy.PitchError > 5 {
+		t.Errorf("noisy audio: %+v", noisy)
+	}
+
+	// A tone at double speed is aligned with the original: the glide is twice as fast.
+	fast, _ := Compare(original, tone(sampleRate, 150, 100, 0, n/2), sampleRate, 1, Options{Speed: 2})
+	if fast.PitchError > 5 || fast.DurationError != 0 || fast.LogSpectralDistance > noisy.LogSpectralDistance {
+		t.Errorf("double speed: %+v", fast)
+	}
+
+	// A shifted pitch counts as an error unless the options expect it, and an octave as a gross
+	// error.
+	higher := tone(sampleRate, 165, 55, 0, n)
+	shifted, _ := Compare(original, higher, sampleRate, 1, Options{Pitch: 1.1})
+	wrong, _ := Compare(original, higher, sampleRate, 1, Options{})
+	if shifted.PitchError > 5 || math.Abs(wrong.PitchError-1200*math.Log2(1.1)) > 10 || wrong.GrossPitchErrors > 0.1 || shifted.LogSpectralDistance > wrong.LogSpectralDistance {
+		t.Errorf("pitch 1.1: %+v, unexpected: %+v", shifted, wrong)
+	}
+	octave, _ := Compare(tone(sampleRate, 150, 0, 0, n), tone(sampleRate, 300, 0, 0, n), sampleRate, 1, Options{})
+	if octave.GrossPitchErrors < 0.9 {
+		t.Errorf("octave up: %+v", octave)
+	}
+
+	long, _ := Compare(original, original, sampleRate, 1, Options{Speed: 1.25})
+	if math.Abs(long.DurationError-0.25) > 1e-9 {
+		t.Errorf("duration error %v, want 0.25", long.DurationError)
+	}
+
+	// Stereo is mixed down.
+	stereo := make([]int16, 2*n)
+	for i, v := range original {
+		stereo[2*i], stereo[2*i+1] = v, v
+	}
+	if r, _ := Compare(stereo, stereo, sampleRate, 2, Options{}); r != same {
+		t.Errorf("stereo: %+v, mono: %+v", r, same)
+	}
+
+	silent, err := Compare(make([]int16, n), make([]int16, n), sampleRate, 1, Options{})
+	if err != nil || silent != (Report{}) {
+		t.Errorf("silence: %+v, %v", silent, err)
+	}
+	for _, bad := range []struct {
+		original, out        []int16
+		sampleRate, channels int
+		o                    Options
+	}{
+		{nil, original, sampleRate, 1, Options{}},
+		{original, original, 0, 1, Options{}},
+		{original, original[:n-1], sampleRate, 2, Options{}},
+		{original, original, sampleRate, 1, Options{Speed: -1}},
+	} {
+		if _, err := Compare(bad.original, bad.out, bad.sampleRate, bad.channels, bad.o); !errors.Is(err, ErrInput) {
+			t.Errorf("%d samples to %d at %d Hz, %d channels, %+v: %v", len(bad.original), len(bad.out), bad.sampleRate, bad.channels, bad.o, err)
+		}
+	}
+}
+
+func TestRegressions(t *testing.T) {
+	golden := Report{SpectralDistortion: -10, LogSpectralDistance: 5, PitchError: 20, GrossPitchErrors: 0.05, DurationError: -0.001}
+	if got := golden.Regressions(golden, Tolerance{}); got != nil {
+		t.Errorf("golden against itself: %v", got)
+	}
+	better := Report{SpectralDistortion: -12, LogSpectralDistance: 4, PitchError: 10, GrossPitchErrors: 0.05, DurationError: 0.0005}
+	if got := better.Regressions(golden, Tolerance{}); got != nil {
+		t.Errorf("better report: %v", got)
+	}
+	worse := Report{SpectralDistortion: -9.9, LogSpectralDistance: 5.5, PitchError: 30, GrossPitchErrors: 0.07, DurationError: 0.004}
+	if got := worse.Regressions(golden, DefaultTolerance); len(got) != 4 {
+		t.Errorf("worse report: %v", got)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eval_test
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alttagil/sonic-go"
+	"github.com/alttagil/sonic-go/eval"
+	"github.com/go-audio/wav"
+)
+
+var update = flag.Bool("update", false, "rewrite testdata/golden.json with the current metrics")
+
+const goldenFile = "testdata/golden.json"
+
+// corpus are the recordings of the repository testdata.
+var corpus = []string{"OSR_us_000_0010_8k.wav", "OSR_us_000_0030_8k.wav", "stereo.wav"}
+
+// settings are the parameters each recording is processed with.
+var settings = []eval.Options{
+	{Speed: 0.5}, {Speed: 0.7}, {Speed: 1.5}, {Speed: 2}, {Speed: 3},
+	{Pitch: 0.8}, {Pitch: 1.25}, {Rate: 1.3}, {Speed: 1.5, Pitch: 1.2},
+}
+
+func readWAV(t *testing.T, name string) ([]int16, int, int) {
+	t.Helper()
+	f, err := os.Open(filepath.Join("..", "testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf, err := wav.NewDecoder(f).FullPCMBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.SourceBitDepth != 16 {
+		t.Fatalf("%s: %d bits per sample", name, buf.SourceBitDepth)
+	}
+	out := make([]int16, len(buf.Data))
+	for i, v := range buf.Data {
+		out[i] = int16(v)
+	}
+	return out, buf.Format.SampleRate, buf.Format.NumChannels
+}
+
+func orOne(v float64) float64 {
+	if v == 0 {
+		return 1
+	}
+	return v
+}
+
+// TestGolden processes the corpus and fails when a metric is worse than in the golden file by
+// more than the default tolerance. Run with -update to accept the current metrics.
+func TestGolden(t *testing.T) {
+	golden := map[string]eval.Report{}
+	if data, err := os.ReadFile(goldenFile); err == nil {
+		if err := json.Unmarshal(data, &golden); err != nil {
+			t.Fatal(err)
+		}
+	} else if !*update {
+		t.Fatal(err)
+	}
+
+	got := map[string]eval.Report{}
+	for _, name := range corpus {
+		samples, sampleRate, channels := readWAV(t, name)
+		for _, o := range settings {
+			key := fmt.Sprintf("%s speed=%v pitch=%v rate=%v", name, orOne(o.Speed), orOne(o.Pitch), orOne(o.Rate))
+			// ChangeSpeed reuses its input for the output.
+			in := append([]int16(nil), samples...)
+			out, err := sonic.ChangeSpeed(sampleRate, channels, orOne(o.Speed), orOne(o.Pitch), orOne(o.Rate), 1, in)
+			if err != nil {
+				t.Fatalf("%s: %v", key, err)
+			}
+			r, err := eval.Compare(samples, out, sampleRate, channels, o)
+			if err != nil {
+				t.Fatalf("%s: %v", key, err)
+			}
+			got[key] = r
+			t.Logf("%s: %+v", key, r)
+
+			if *update {
+				continue
+			}
+			want, ok := golden[key]
+			if !ok {
+				t.Errorf("%s: no golden metrics, run with -update", key)
+				continue
+			}
+			for _, msg := range r.Regressions(want, eval.DefaultTolerance) {
+				t.Errorf("%s: %s", key, msg)
+			}
+		}
+	}
+
+	if *update {
+		data, err := json.MarshalIndent(got, "", "\t")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(goldenFile, append(data, '\n'), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
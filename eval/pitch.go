@@ -0,0 +1,74 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eval
+
+import "math"
+
+const (
+	// minPitch and maxPitch bound the pitch of the original in Hz, as in the sonic package.
+	minPitch = 65
+	maxPitch = 400
+
+	// voicedCorrelation is the normalized autocorrelation a frame needs at its period to count
+	// as voiced.
+	voicedCorrelation = 0.7
+
+	// octaveTolerance is how close to the best correlation a shorter period may come and still
+	// be chosen, which avoids picking multiples of the period.
+	octaveTolerance = 0.9
+)
+
+// estimatePitch returns the pitch of x in Hz, searched between lo and hi, or 0 if x is not
+// voiced. It picks the shortest lag whose normalized autocorrelation is close to the best and
+// refines it by parabolic interpolation.
+func estimatePitch(x []float64, sampleRate int, lo, hi float64) float64 {
+	minLag := max(int(float64(sampleRate)/hi), 2)
+	maxLag := min(int(math.Ceil(float64(sampleRate)/lo)), len(x)/2)
+	if minLag+2 > maxLag {
+		return 0
+	}
+
+	r := make([]float64, maxLag+2)
+	best := 0.0
+	for lag := minLag - 1; lag <= maxLag+1; lag++ {
+		var xy, xx, yy float64
+		for i := 0; i+lag < len(x); i++ {
+			xy += x[i] * x[i+lag]
+			xx += x[i] * x[i]
+			yy += x[i+lag] * x[i+lag]
+		}
+		if xx > 0 && yy > 0 {
+			r[lag] = xy / math.Sqrt(xx*yy)
+		}
+		if lag >= minLag && lag <= maxLag {
+			best = max(best, r[lag])
+		}
+	}
+	if best < voicedCorrelation {
+		return 0
+	}
+
+	for lag := minLag; lag <= maxLag; lag++ {
+		if r[lag] < octaveTolerance*best || r[lag] < r[lag-1] || r[lag] < r[lag+1] {
+			continue
+		}
+		period := float64(lag)
+		if d := r[lag-1] - 2*r[lag] + r[lag+1]; d < 0 {
+			period += 0.5 * (r[lag-1] - r[lag+1]) / d
+		}
+		return float64(sampleRate) / period
+	}
+	return 0
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eval
+
+import (
+	"math"
+	"math/cmplx"
+)
+
+// frameSize returns the analysis frame length for a sample rate: the power of two closest to
+// 32 ms from above, long enough for two periods of the lowest pitch.
+func frameSize(sampleRate int) int {
+	n := 64
+	for n < sampleRate*32/1000 {
+		n <<= 1
+	}
+	return n
+}
+
+// hann returns a Hann window of n samples.
+func hann(n int) []float64 {
+	w := make([]float64, n)
+	for i := range w {
+		w[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(n))
+	}
+	return w
+}
+
+// fft transforms x in place. len(x) is a power of two.
+func fft(x []complex128) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j |= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				a, b := x[start+k], w*x[start+k+size/2]
+				x[start+k], x[start+k+size/2] = a+b, a-b
+				w *= step
+			}
+		}
+	}
+}
+
+// spectrogram holds the power spectra of the frames of a signal, hop samples apart.
+type spectrogram struct {
+	frames [][]float64
+	energy []float64
+	peak   float64
+}
+
+// newSpectrogram returns the power spectra of the windowed frames of x. The last frame is padded
+// with silence.
+func newSpectrogram(x []float64, size, hop int) *spectrogram {
+	s := &spectrogram{}
+	w := hann(size)
+	buf := make([]complex128, size)
+	for start := 0; start < len(x); start += hop {
+		for i := range buf {
+			v := 0.0
+			if start+i < len(x) {
+				v = x[start+i]
+			}
+			buf[i] = complex(v*w[i], 0)
+		}
+		fft(buf)
+		power := make([]float64, size/2+1)
+		energy := 0.0
+		for k := range power {
+			power[k] = real(buf[k])*real(buf[k]) + imag(buf[k])*imag(buf[k])
+			energy += power[k]
+			s.peak = max(s.peak, power[k])
+		}
+		s.frames = append(s.frames, power)
+		s.energy = append(s.energy, energy)
+	}
+	return s
+}
+
+// warp returns the power of frame at bin k/factor, interpolated, so that a spectrum shifted in
+// frequency by factor lines up with the original. It returns -1 above the top bin.
+func warp(frame []float64, k int, factor float64) float64 {
+	pos := float64(k) / factor
+	i := int(pos)
+	if i >= len(frame)-1 {
+		if i == len(frame)-1 && pos == float64(i) {
+			return frame[i]
+		}
+		return -1
+	}
+	f := pos - float64(i)
+	return frame[i]*(1-f) + frame[i+1]*f
+}
@@ -5,6 +5,8 @@ go 1.21
 require (
 	github.com/go-audio/audio v1.0.0
 	github.com/go-audio/wav v1.1.0
+	github.com/gorilla/websocket v1.5.3
+	golang.org/x/sys v0.30.0
 )
 
 require github.com/go-audio/riff v1.0.0 // indirect
@@ -0,0 +1,428 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonic
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+)
+
+// MaxVoiceSemitones bounds the pitch shift of a harmony voice, including its detune.
+const MaxVoiceSemitones = 12
+
+// ErrVoice is returned by SetHarmony for a voice shifted further than MaxVoiceSemitones.
+var ErrVoice = errors.New("invalid harmony voice")
+
+// Voice is a pitch-shifted copy of the stream output mixed in by the harmony stage.
+type Voice struct {
+	// Semitones is the pitch shift of the voice, e.g. 4 for a major third up.
+	Semitones float64
+	// Detune shifts the voice further by the given number of cents, which thickens a voice
+	// doubling another one.
+	Detune float64
+	// Gain is the linear gain of the voice in the mix.
+	Gain float64
+}
+
+// ratio returns the pitch ratio of the voice.
+func (v Voice) ratio() float64 {
+	return math.Exp2((v.Semitones + v.Detune/100) / 12)
+}
+
+// pitchMark is an analysis mark of the harmony stage: a position in the input, the pitch period
+// found there and the pitch ratio of the auto-tune correction, 1 without one. Consecutive marks
+// are one period apart.
+type pitchMark struct {
+	pos, period int
+	ratio       float64
+}
+
+// harmonyVoice holds the synthesis state of a voice: its pitch ratio, the position of its next
+// grain and the windowed grains and window weights added up so far, from position start of the
+// stage on.
+type harmonyVoice struct {
+	Voice
+	ratio  float64
+	next   float64
+	acc    []float64
+	weight []float64
+}
+
+// harmonyStage is an optional output stage that mixes the output of the time-stretch and rate
+// stages with pitch-shifted copies of it. Each voice is resynthesized with TD-PSOLA: grains of
+// two periods around analysis marks placed one period apart are overlap-added at synthesis marks
+// one period divided by the pitch ratio apart, which shifts the pitch and keeps the duration.
+// All voices share the analysis marks, so they stay aligned with each other and the dry signal.
+//
+// Positions count frames of input from the start of the stage, offset by pad frames of silence
+// so that the first grains can reach back. The stage delays the output by about five pitch
+// periods of the lowest pitch.
+type harmonyStage struct {
+	ch                   int
+	minPeriod, maxPeriod int
+	skip                 int
+	// reach is the largest half length of a grain, pad the silence before the first input frame.
+	reach, pad int
+
+	dry    float64
+	voices []harmonyVoice
+	// tuner is set in the auto-tune stage and shifts the grains of each mark by its own ratio.
+	tuner *pitchCorrector
+
+	// in holds the input frames from position start on, marks the analysis marks that are still
+	// needed and done the position up to which output was produced.
+	in    []int16
+	start int
+	marks []pitchMark
+	done  int
+
+	mono, down, out []int16
+	// silence is fed to the stage by drain, which collects the output in drained.
+	silence, drained []int16
+}
+
+// newHarmonyStage creates a harmony stage for the stream format.
+func newHarmonyStage(sampleRate, ch int) *harmonyStage {
+	maxPeriod := sampleRate / MinPitch
+	skip := 1
+	if sampleRate > AmdfFreq {
+		skip = sampleRate / AmdfFreq
+	}
+	h := &harmonyStage{
+		ch:        ch,
+		minPeriod: sampleRate / MaxPitch,
+		maxPeriod: maxPeriod,
+		skip:      skip,
+		reach:     maxPeriod,
+		pad:       2 * maxPeriod,
+		mono:      make([]int16, 2*maxPeriod),
+		down:      make([]int16, 2*maxPeriod/skip),
+		silence:   make([]int16, maxPeriod*ch),
+	}
+	h.reset()
+	return h
+}
+
+// setVoices replaces the mix. Voices that exist before and after keep their state, so a running
+// stage can change its voices without a gap; added voices start at the first position they can
+// still contribute to.
+func (h *harmonyStage) setVoices(dry float64, voices []Voice) {
+	h.dry = dry
+	frames := len(h.in) / h.ch
+	next := float64(h.done + h.reach)
+	if h.end() == h.pad {
+		next = float64(h.pad)
+	}
+	for i, v := range voices {
+		if i < len(h.voices) {
+			h.voices[i].Voice, h.voices[i].ratio = v, v.ratio()
+			continue
+		}
+		h.voices = append(h.voices, harmonyVoice{
+			Voice:  v,
+			ratio:  v.ratio(),
+			next:   next,
+			acc:    make([]float64, frames*h.ch),
+			weight: make([]float64, frames),
+		})
+	}
+	h.voices = h.voices[:len(voices)]
+}
+
+// reset drops all buffered samples and starts over with silence.
+func (h *harmonyStage) reset() {
+	h.in = extend(h.in[:0], h.pad*h.ch)
+	h.start, h.done = 0, h.pad
+	h.marks = h.marks[:0]
+	if h.tuner != nil {
+		h.tuner.reset()
+	}
+	for i := range h.voices {
+		v := &h.voices[i]
+		v.next = float64(h.pad)
+		v.acc = extend(v.acc[:0], h.pad*h.ch)
+		v.weight = extend(v.weight[:0], h.pad)
+	}
+}
+
+// clone returns a copy of the stage, either with all its state or freshly reset.
+func (h *harmonyStage) clone(withState bool) *harmonyStage {
+	c := *h
+	c.in = slices.Clone(h.in)
+	c.marks = slices.Clone(h.marks)
+	c.voices = slices.Clone(h.voices)
+	for i := range c.voices {
+		c.voices[i].acc = slices.Clone(h.voices[i].acc)
+		c.voices[i].weight = slices.Clone(h.voices[i].weight)
+	}
+	if h.tuner != nil {
+		tuner := *h.tuner
+		tuner.found = slices.Clone(h.tuner.found)
+		tuner.periods = slices.Clone(h.tuner.periods)
+		c.tuner = &tuner
+	}
+	c.mono = make([]int16, len(h.mono))
+	c.down = make([]int16, len(h.down))
+	c.out, c.drained = nil, nil
+	if !withState {
+		c.reset()
+	}
+	return &c
+}
+
+// end returns the position after the last input frame.
+func (h *harmonyStage) end() int {
+	return h.start + len(h.in)/h.ch
+}
+
+// pending returns the number of frames held by the stage.
+func (h *harmonyStage) pending() int {
+	return h.end() - h.done
+}
+
+// process adds interleaved samples to the stage and returns the mixed output that is complete.
+// The returned slice is reused by the next call.
+func (h *harmonyStage) process(s []int16) []int16 {
+	h.in = append(h.in, s...)
+	frames := len(s) / h.ch
+	for i := range h.voices {
+		v := &h.voices[i]
+		v.acc = extend(v.acc, frames*h.ch)
+		v.weight = extend(v.weight, frames)
+	}
+
+	h.analyze()
+	limit := h.end()
+	for i := range h.voices {
+		limit = min(limit, h.synthesize(&h.voices[i]))
+	}
+	h.mix(limit)
+	h.discard()
+	return h.out
+}
+
+// drain pushes silence through the stage until everything it held is mixed, returns those
+// samples and starts over. The returned slice is reused by the next call.
+func (h *harmonyStage) drain() []int16 {
+	n := h.pending() * h.ch
+	h.drained = h.drained[:0]
+	for len(h.drained) < n {
+		h.drained = append(h.drained, h.process(h.silence)...)
+	}
+	h.reset()
+	return h.drained[:n]
+}
+
+// analyze places analysis marks as far as the input allows a pitch search. The auto-tune stage
+// takes the periods from the time stretch instead of searching them.
+func (h *harmonyStage) analyze() {
+	for {
+		pos := h.pad
+		if n := len(h.marks); n > 0 {
+			pos = h.marks[n-1].pos + h.marks[n-1].period
+		}
+		if pos+2*h.maxPeriod > h.end() {
+			return
+		}
+		var period int
+		ratio := 1.0
+		if h.tuner != nil {
+			fine, voiced := h.tuner.periodAt(pos, h.maxPeriod)
+			period = min(max(int(math.Round(fine)), h.minPeriod), h.maxPeriod)
+			ratio = h.tuner.correct(fine, voiced)
+		} else {
+			period = h.findPeriod(pos)
+		}
+		h.marks = append(h.marks, pitchMark{pos, period, ratio})
+	}
+}
+
+// findPeriod finds the pitch period at pos like the stream does, on down-sampled, mixed input and
+// then with AMDF at the full rate. The first pass always uses YIN: where the time stretch gets
+// away with a multiple of the period, a voice would be shifted by an octave less.
+func (h *harmonyStage) findPeriod(pos int) int {
+	frames := h.in[(pos-h.start)*h.ch:]
+	for i := range h.mono {
+		v := 0
+		for c := 0; c < h.ch; c++ {
+			v += int(frames[i*h.ch+c])
+		}
+		h.mono[i] = int16(v / h.ch)
+	}
+	if h.skip == 1 {
+		period, _, _ := YINEstimator{}.EstimatePeriod(h.mono, h.minPeriod, h.maxPeriod)
+		return period
+	}
+
+	for i := range h.down {
+		v := 0
+		for _, s := range h.mono[i*h.skip : (i+1)*h.skip] {
+			v += int(s)
+		}
+		h.down[i] = int16(v / h.skip)
+	}
+	period, _, _ := YINEstimator{}.EstimatePeriod(h.down, h.minPeriod/h.skip, h.maxPeriod/h.skip)
+	period *= h.skip
+	minP := max(period-(h.skip<<2), h.minPeriod)
+	maxP := min(period+(h.skip<<2), h.maxPeriod)
+	period, _, _ = AMDFEstimator{}.EstimatePeriod(h.mono, minP, maxP)
+	return period
+}
+
+// synthesize adds the grains of a voice whose analysis marks are known and returns the position
+// below which the voice will not change anymore.
+func (h *harmonyStage) synthesize(v *harmonyVoice) int {
+	for k := 0; ; {
+		// Find the analysis mark nearest to the next synthesis mark; the one after it has to be
+		// known to tell.
+		for k+1 < len(h.marks) && float64(h.marks[k+1].pos) <= v.next {
+			k++
+		}
+		if k+1 >= len(h.marks) {
+			break
+		}
+		mark := h.marks[k]
+		if float64(h.marks[k+1].pos)-v.next < v.next-float64(mark.pos) {
+			mark = h.marks[k+1]
+		}
+
+		step := float64(mark.period) / (v.ratio * mark.ratio)
+		half := mark.period
+		at := int(math.Round(v.next)) - h.start
+		from := mark.pos - h.start
+		for i := -half; i < half; i++ {
+			w := 0.5 + 0.5*math.Cos(math.Pi*float64(i)/float64(half))
+			v.weight[at+i] += w
+			src, dst := (from+i)*h.ch, (at+i)*h.ch
+			for c := 0; c < h.ch; c++ {
+				v.acc[dst+c] += w * float64(h.in[src+c])
+			}
+		}
+		v.next += step
+	}
+	return int(v.next) - h.reach
+}
+
+// mix writes the output up to limit to h.out.
+func (h *harmonyStage) mix(limit int) {
+	h.out = h.out[:0]
+	for pos := h.done; pos < limit; pos++ {
+		i := pos - h.start
+		for c := 0; c < h.ch; c++ {
+			sum := h.dry * float64(h.in[i*h.ch+c])
+			for j := range h.voices {
+				v := &h.voices[j]
+				// Normalize by the sum of the windows. The gaps the grains of a lowered voice leave
+				// carry its pitch, so the further it goes down, the less they are filled up; the
+				// small gaps jitter leaves at the other ratios are filled up to a quarter.
+				if w := v.weight[i]; w > 0 {
+					sum += v.Gain * v.acc[i*h.ch+c] / max(w, min(max(2*(1-v.ratio), 0.25), 1))
+				}
+			}
+			h.out = append(h.out, clampInt16(math.Round(sum)))
+		}
+	}
+	h.done = max(h.done, limit)
+}
+
+// discard drops the frames and marks that no grain will use anymore.
+func (h *harmonyStage) discard() {
+	next := float64(h.end())
+	for _, v := range h.voices {
+		next = min(next, v.next)
+	}
+	drop := 0
+	for drop+1 < len(h.marks) && float64(h.marks[drop+1].pos) <= next {
+		drop++
+	}
+	h.marks = h.marks[:copy(h.marks, h.marks[drop:])]
+	if h.tuner != nil {
+		pos := h.pad
+		if n := len(h.marks); n > 0 {
+			pos = h.marks[n-1].pos + h.marks[n-1].period
+		}
+		h.tuner.prune(pos)
+	}
+	keep := min(h.done, int(next)-h.maxPeriod-h.reach)
+	if len(h.marks) > 0 {
+		keep = min(keep, h.marks[0].pos-h.reach)
+	}
+	n := keep - h.start
+	if n <= 0 {
+		return
+	}
+	h.in = h.in[:copy(h.in, h.in[n*h.ch:])]
+	for i := range h.voices {
+		v := &h.voices[i]
+		v.acc = v.acc[:copy(v.acc, v.acc[n*h.ch:])]
+		v.weight = v.weight[:copy(v.weight, v.weight[n:])]
+	}
+	h.start = keep
+}
+
+// SetHarmony mixes pitch-shifted copies of the output with the output itself, scaled by
+// dryGain. All voices are shifted from the same time-stretched signal, so they stay aligned.
+// Calling it again changes the mix without interrupting the running voices. The harmony stage
+// delays the output by about five periods of the lowest pitch; Flush drains it.
+func (stream *Stream) SetHarmony(dryGain float64, voices ...Voice) error {
+	for _, v := range voices {
+		if shift := v.Semitones + v.Detune/100; math.IsNaN(shift) || math.Abs(shift) > MaxVoiceSemitones {
+			return fmt.Errorf("%w: shifted by %v semitones", ErrVoice, shift)
+		}
+	}
+	if stream.harmony == nil {
+		stream.harmony = newHarmonyStage(stream.sampleRate, stream.numChannels)
+	}
+	stream.harmony.setVoices(dryGain, voices)
+	return nil
+}
+
+// GetHarmony returns the dry gain and the voices of the harmony stage, or 1 and no voices if it
+// is disabled.
+func (stream *Stream) GetHarmony() (float64, []Voice) {
+	if stream.harmony == nil {
+		return 1, nil
+	}
+	voices := make([]Voice, len(stream.harmony.voices))
+	for i, v := range stream.harmony.voices {
+		voices[i] = v.Voice
+	}
+	return stream.harmony.dry, voices
+}
+
+// DisableHarmony removes the harmony stage. Samples held by it are lost, so call Flush first to
+// keep them.
+func (stream *Stream) DisableHarmony() {
+	stream.harmony = nil
+}
+
+// extend appends n zero values to s, reusing its capacity.
+func extend[T any](s []T, n int) []T {
+	m := len(s)
+	s = slices.Grow(s, n)[:m+n]
+	clear(s[m:])
+	return s
+}
+
+// harmonize runs the output produced since position at through a harmony or auto-tune stage.
+func (stream *Stream) harmonize(h *harmonyStage, at int) error {
+	slice, err := stream.outputBuffer.ReadSliceAt(at)
+	if err != nil {
+		return err
+	}
+	return stream.outputBuffer.WriteSlice(h.process(slice))
+}
@@ -0,0 +1,230 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonic
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"testing"
+)
+
+// processChunks writes samples to a stream in chunks, flushes it and returns the output.
+func processChunks(t *testing.T, stream *Stream, samples []int16, chunk int) []int16 {
+	t.Helper()
+	var out []int16
+	for off := 0; off < len(samples); off += chunk {
+		if err := stream.Write(samples[off:min(off+chunk, len(samples))]); err != nil {
+			t.Fatal(err)
+		}
+		got, _ := stream.ReadAll()
+		out = append(out, got...)
+	}
+	if err := stream.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := stream.ReadAll()
+	return append(out, got...)
+}
+
+// medianF0 returns the median fundamental frequency YIN finds along mono samples.
+func medianF0(samples []int16, sampleRate int) float64 {
+	minP, maxP := sampleRate/MaxPitch, sampleRate/MinPitch
+	var f0 []float64
+	for pos := 0; pos+2*maxP <= len(samples); pos += maxP {
+		period, _, _ := YINEstimator{}.EstimatePeriod(samples[pos:], minP, maxP)
+		f0 = append(f0, float64(sampleRate)/float64(period))
+	}
+	slices.Sort(f0)
+	return f0[len(f0)/2]
+}
+
+// energy returns the sum of the squared samples.
+func energy(samples []int16) float64 {
+	var e float64
+	for _, v := range samples {
+		e += float64(v) * float64(v)
+	}
+	return e
+}
+
+func TestHarmonyVoicePitch(t *testing.T) {
+	const sampleRate, f0 = 16000, 150.0
+	in := harmonic(sampleRate, f0, 1, 0, 0, sampleRate)
+	want := processChunks(t, NewSonicStream(sampleRate, 1), in, 1000)
+	for _, v := range []Voice{
+		{Semitones: 7, Gain: 1},
+		{Semitones: -5, Gain: 1},
+		{Semitones: 4, Detune: 30, Gain: 1},
+		{Semitones: -12, Gain: 1},
+	} {
+		stream := NewSonicStream(sampleRate, 1)
+		if err := stream.SetHarmony(0, v); err != nil {
+			t.Fatal(err)
+		}
+		out := processChunks(t, stream, in, 1000)
+		if len(out) != len(want) {
+			t.Errorf("%+v: %d samples, want %d", v, len(out), len(want))
+		}
+		f := f0 * v.ratio()
+		if got := medianF0(out[2000:len(out)-2000], sampleRate); math.Abs(got-f) > f*0.02 {
+			t.Errorf("%+v: voice at %.1f Hz, want %.1f Hz", v, got, f)
+		}
+	}
+}
+
+func TestHarmonyLoweredVoiceLevel(t *testing.T) {
+	// The grains of a lowered voice leave gaps that are only partly filled up, so that they keep
+	// the pitch of the voice. That costs level, more so the further the voice goes down, but no
+	// more than this.
+	const sampleRate, f0 = 16000, 150.0
+	in := harmonic(sampleRate, f0, 1, 0, 0, sampleRate)
+	want := processChunks(t, NewSonicStream(sampleRate, 1), in, 1000)
+	for _, tc := range []struct{ semitones, maxLoss float64 }{
+		{-3, 1},
+		{-7, 2},
+		{-12, 5},
+	} {
+		stream := NewSonicStream(sampleRate, 1)
+		if err := stream.SetHarmony(0, Voice{Semitones: tc.semitones, Gain: 1}); err != nil {
+			t.Fatal(err)
+		}
+		out := processChunks(t, stream, in, 1000)
+		gain := 10 * math.Log10(energy(out[2000:len(out)-2000])/energy(want[2000:len(want)-2000]))
+		if gain < -tc.maxLoss || gain > 0.5 {
+			t.Errorf("%v semitones: voice at %+.1f dB, want between -%v and +0.5 dB", tc.semitones, gain, tc.maxLoss)
+		}
+	}
+}
+
+func TestHarmonyAlignment(t *testing.T) {
+	w, sampleRate, channels, err := readWAV("./testdata/OSR_us_000_0010_8k.wav")
+	if err != nil {
+		t.Fatalf("reading error: %v", err)
+	}
+	w = w[:len(w)/4]
+
+	plain := NewSonicStream(sampleRate, channels)
+	plain.SetSpeed(1.5)
+	want := processChunks(t, plain, w, 777)
+
+	// Without voices the stage only delays the output.
+	dry := NewSonicStream(sampleRate, channels)
+	dry.SetSpeed(1.5)
+	_ = dry.SetHarmony(1)
+	if got := processChunks(t, dry, w, 777); !slices.Equal(got, want) {
+		t.Errorf("dry harmony output differs: %d vs %d samples", len(got), len(want))
+	}
+
+	// A voice without a shift places its grains where they were taken from, so it rebuilds the
+	// time-stretched output in place, apart from where the period jumps.
+	unison := NewSonicStream(sampleRate, channels)
+	unison.SetSpeed(1.5)
+	_ = unison.SetHarmony(0, Voice{Gain: 1})
+	got := processChunks(t, unison, w, 777)
+	if len(got) != len(want) {
+		t.Fatalf("%d samples, want %d", len(got), len(want))
+	}
+	var signal, noise float64
+	for i := range got {
+		d := float64(got[i]) - float64(want[i])
+		signal += float64(want[i]) * float64(want[i])
+		noise += d * d
+	}
+	if snr := 10 * math.Log10(signal/noise); snr < 45 {
+		t.Errorf("unison voice SNR %.1f dB, want at least 45 dB", snr)
+	}
+}
+
+func TestHarmonyState(t *testing.T) {
+	w, sampleRate, _, err := readWAV("./testdata/OSR_us_000_0010_8k.wav")
+	if err != nil {
+		t.Fatalf("reading error: %v", err)
+	}
+	mono := upsample(w[:len(w)/4], 2)
+	sampleRate *= 2
+	w = make([]int16, 2*len(mono))
+	for i, v := range mono {
+		w[2*i], w[2*i+1] = v, v/2
+	}
+
+	stream := NewSonicStream(sampleRate, 2)
+	stream.SetSpeed(0.8)
+	if err := stream.SetHarmony(0.8, Voice{Semitones: 4, Gain: 0.4}, Voice{Semitones: 7, Detune: -8, Gain: 0.3}); err != nil {
+		t.Fatal(err)
+	}
+	half := len(w) / 4 * 2
+	if err := stream.Write(w[:half]); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = stream.ReadAll()
+
+	data, _ := stream.MarshalBinary()
+	restored := &Stream{}
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	clone := stream.Clone(true)
+
+	// Changing the mix keeps the running voices.
+	for _, s := range []*Stream{stream, restored, clone} {
+		_ = s.SetHarmony(0.8, Voice{Semitones: 3, Gain: 0.4}, Voice{Semitones: 7, Detune: -8, Gain: 0.3}, Voice{Semitones: -12, Gain: 0.2})
+	}
+	var outs [3][]int16
+	for i, s := range []*Stream{stream, restored, clone} {
+		outs[i] = processChunks(t, s, w[half:], 1000)
+	}
+	if !slices.Equal(outs[0], outs[1]) || !slices.Equal(outs[0], outs[2]) {
+		t.Error("restored or cloned stream output differs")
+	}
+
+	dryGain, voices := restored.GetHarmony()
+	if dryGain != 0.8 || len(voices) != 3 || voices[0].Semitones != 3 {
+		t.Errorf("harmony %v %+v", dryGain, voices)
+	}
+	if err := stream.SetHarmony(1, Voice{Semitones: 13}); !errors.Is(err, ErrVoice) {
+		t.Errorf("13 semitones: %v", err)
+	}
+	stream.DisableHarmony()
+	if _, voices := stream.GetHarmony(); voices != nil {
+		t.Error("harmony still enabled")
+	}
+}
+
+func BenchmarkHarmony(b *testing.B) {
+	for _, voices := range []int{0, 1, 3} {
+		b.Run(string(rune('0'+voices))+"voices", func(b *testing.B) {
+			stream := NewSonicStream(48000, 1)
+			stream.SetSpeed(1.5)
+			_ = stream.SetHarmony(1, []Voice{{Semitones: 4, Gain: 0.5}, {Semitones: 7, Gain: 0.5}, {Semitones: -12, Gain: 0.3}}[:voices]...)
+			frame := make([]int16, 960)
+			for i := range frame {
+				frame[i] = int16(8000 * math.Sin(float64(i)*0.05))
+			}
+			out := make([]int16, len(frame))
+			for i := 0; i < 100; i++ {
+				_ = steadyStateFrame(stream, frame, out)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := steadyStateFrame(stream, frame, out); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package simd holds the inner loops of the pitch period search and of overlap-add, with AVX2
+// and NEON assembly kernels chosen at run time and scalar code for other CPUs. It is a separate
+// package because Go assembly cannot live in a package that uses cgo.
+package simd
+
+// amdfBlock is the number of samples the AMDF kernels process per iteration.
+const amdfBlock = 16
+
+// amdfKernelMax is the length from which AMDF uses the scalar code: the kernels add up their sum
+// in 32 bits, which holds 1<<16 differences of at most 65535 but not more.
+const amdfKernelMax = 1 << 16
+
+// hasKernels is set at init when the CPU supports the assembly kernels of its architecture:
+//
+//	amdfKernel(a, b []int16) int returns the sum of |a[i]-b[i]|. len(a) is a multiple of
+//	amdfBlock, below 1<<16.
+//
+//	overlapAddKernel(out, down, up []int16, n float64, w *[4]float64, step float64) computes
+//	overlapAddGeneric for a multiple of 4 samples. w holds the frame index of the first four
+//	samples and step is how many frames four samples span.
+//
+// Each kernel handles the largest prefix of its input that is a multiple of its block size, the
+// callers finish the rest with the scalar code.
+var hasKernels bool
+
+// Accelerated reports whether AMDF runs on an assembly kernel.
+func Accelerated() bool {
+	return hasKernels
+}
+
+// AMDF returns the average magnitude difference sum of a and b: the sum of |a[i]-b[i]|.
+// b must be at least as long as a. Slices of 1<<16 samples or more always take the scalar code.
+func AMDF(a, b []int16) int {
+	b = b[:len(a)]
+	sum, i := 0, 0
+	if hasKernels && len(a) < amdfKernelMax {
+		i = len(a) &^ (amdfBlock - 1)
+		sum = amdfKernel(a[:i], b[:i])
+	}
+	return sum + amdfGeneric(a[i:], b[i:])
+}
+
+// amdfGeneric is the scalar version of AMDF.
+func amdfGeneric(a, b []int16) int {
+	b = b[:len(a)]
+	sum := 0
+	for i, v := range a {
+		d := int(v) - int(b[i])
+		if d < 0 {
+			d = -d
+		}
+		sum += d
+	}
+	return sum
+}
+
+// OverlapAdd ramps down from full volume to zero over n frames of interleaved samples with ch
+// channels while ramping up from zero to full volume, and stores the sum in out:
+//
+//	out[j] = (down[j]*(n-i) + up[j]*i) / n, where i = j/ch
+//
+// down and up must be at least as long as out.
+func OverlapAdd(out, down, up []int16, ch, n int) {
+	down, up = down[:len(out)], up[:len(out)]
+	j := 0
+	if hasKernels && 4%ch == 0 {
+		// The kernels work in float64, which is exact here: the products fit into 53 bits and
+		// truncating the rounded quotient gives the integer quotient for n below 1<<30.
+		j = len(out) &^ 3
+		w := [4]float64{float64(0 / ch), float64(1 / ch), float64(2 / ch), float64(3 / ch)}
+		overlapAddKernel(out[:j], down[:j], up[:j], float64(n), &w, float64(4/ch))
+	}
+	overlapAddGeneric(out[j:], down[j:], up[j:], ch, n, j/ch)
+}
+
+// overlapAddGeneric is the scalar version of OverlapAdd, starting at frame i0.
+func overlapAddGeneric(out, down, up []int16, ch, n, i0 int) {
+	for j := range out {
+		i := i0 + j/ch
+		out[j] = int16((int(down[j])*(n-i) + int(up[j])*i) / n)
+	}
+}
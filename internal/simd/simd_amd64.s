@@ -0,0 +1,95 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "textflag.h"
+
+// func amdfKernel(a, b []int16) int
+//
+// |a-b| of 16 samples is max(a,b)-min(a,b), which fits into an unsigned 16 bit lane. The even
+// and odd lanes are added into eight 32 bit sums.
+TEXT ·amdfKernel(SB), NOSPLIT, $0-56
+	MOVQ a_base+0(FP), SI
+	MOVQ a_len+8(FP), CX
+	MOVQ b_base+24(FP), DX
+	VPXOR Y0, Y0, Y0
+	VPCMPEQD Y7, Y7, Y7
+	VPSRLD $16, Y7, Y7
+	SHRQ $4, CX
+	JZ reduce
+
+loop:
+	VMOVDQU (SI), Y1
+	VMOVDQU (DX), Y2
+	VPMAXSW Y2, Y1, Y3
+	VPMINSW Y2, Y1, Y4
+	VPSUBW Y4, Y3, Y3
+	VPAND Y7, Y3, Y4
+	VPSRLD $16, Y3, Y3
+	VPADDD Y4, Y0, Y0
+	VPADDD Y3, Y0, Y0
+	ADDQ $32, SI
+	ADDQ $32, DX
+	DECQ CX
+	JNZ loop
+
+reduce:
+	VEXTRACTI128 $1, Y0, X1
+	VPADDD X1, X0, X0
+	VPSHUFD $0x4e, X0, X1
+	VPADDD X1, X0, X0
+	VPSHUFD $0xb1, X0, X1
+	VPADDD X1, X0, X0
+	VMOVD X0, AX
+	VZEROUPPER
+	MOVQ AX, ret+48(FP)
+	RET
+
+// func overlapAddKernel(out, down, up []int16, n float64, w *[4]float64, step float64)
+//
+// Four samples at a time: out = (down*(n-w) + up*w) / n in float64, truncated towards zero.
+TEXT ·overlapAddKernel(SB), NOSPLIT, $0-96
+	MOVQ out_base+0(FP), DI
+	MOVQ out_len+8(FP), CX
+	MOVQ down_base+24(FP), SI
+	MOVQ up_base+48(FP), DX
+	VBROADCASTSD n+72(FP), Y0
+	MOVQ w+80(FP), AX
+	VMOVUPD (AX), Y1
+	VBROADCASTSD step+88(FP), Y2
+	SHRQ $2, CX
+	JZ done
+
+loop:
+	VPMOVSXWD (SI), X3
+	VCVTDQ2PD X3, Y3
+	VPMOVSXWD (DX), X4
+	VCVTDQ2PD X4, Y4
+	VSUBPD Y1, Y0, Y5
+	VMULPD Y5, Y3, Y3
+	VMULPD Y1, Y4, Y4
+	VADDPD Y4, Y3, Y3
+	VDIVPD Y0, Y3, Y3
+	VCVTTPD2DQY Y3, X3
+	VPACKSSDW X3, X3, X3
+	MOVQ X3, (DI)
+	VADDPD Y2, Y1, Y1
+	ADDQ $8, SI
+	ADDQ $8, DX
+	ADDQ $8, DI
+	DECQ CX
+	JNZ loop
+
+done:
+	VZEROUPPER
+	RET
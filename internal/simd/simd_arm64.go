@@ -0,0 +1,30 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simd
+
+func init() {
+	// Advanced SIMD is part of the ARMv8-A baseline that Go requires, no detection is needed.
+	hasKernels = true
+}
+
+// amdfKernel is implemented with NEON in simd_arm64.s.
+//
+//go:noescape
+func amdfKernel(a, b []int16) int
+
+// overlapAddKernel is implemented with NEON in simd_arm64.s.
+//
+//go:noescape
+func overlapAddKernel(out, down, up []int16, n float64, w *[4]float64, step float64)
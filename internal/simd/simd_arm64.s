@@ -0,0 +1,118 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "textflag.h"
+
+// func amdfKernel(a, b []int16) int
+//
+// Flipping the sign bit maps int16 to uint16 in the same order, so |a-b| is umax-umin of the
+// flipped values. The differences are widened and added into eight 32 bit sums.
+TEXT ·amdfKernel(SB), NOSPLIT, $0-56
+	MOVD a_base+0(FP), R0
+	MOVD a_len+8(FP), R2
+	MOVD b_base+24(FP), R1
+	VEOR V0.B16, V0.B16, V0.B16
+	VEOR V1.B16, V1.B16, V1.B16
+	MOVD $0x8000, R3
+	VDUP R3, V7.H8
+	LSR $4, R2
+	CBZ R2, reduce
+
+loop:
+	VLD1.P 32(R0), [V2.H8, V3.H8]
+	VLD1.P 32(R1), [V4.H8, V5.H8]
+	VEOR V7.B16, V2.B16, V2.B16
+	VEOR V7.B16, V3.B16, V3.B16
+	VEOR V7.B16, V4.B16, V4.B16
+	VEOR V7.B16, V5.B16, V5.B16
+	VUMAX V4.H8, V2.H8, V16.H8
+	VUMIN V4.H8, V2.H8, V17.H8
+	VUMAX V5.H8, V3.H8, V18.H8
+	VUMIN V5.H8, V3.H8, V19.H8
+	VSUB V17.H8, V16.H8, V16.H8
+	VSUB V19.H8, V18.H8, V18.H8
+	VUADDW V16.H4, V0.S4, V0.S4
+	VUADDW2 V16.H8, V1.S4, V1.S4
+	VUADDW V18.H4, V0.S4, V0.S4
+	VUADDW2 V18.H8, V1.S4, V1.S4
+	SUB $1, R2
+	CBNZ R2, loop
+
+reduce:
+	VADD V1.S4, V0.S4, V0.S4
+	VMOV V0.S[0], R4
+	VMOV V0.S[1], R5
+	VMOV V0.S[2], R6
+	VMOV V0.S[3], R7
+	ADD R5, R4
+	ADD R7, R6
+	ADD R6, R4
+	MOVD R4, ret+48(FP)
+	RET
+
+// func overlapAddKernel(out, down, up []int16, n float64, w *[4]float64, step float64)
+//
+// Four samples at a time: out = (down*(n-w) + up*w) / n in float64, truncated towards zero.
+// The floating point vector instructions are not known to the Go 1.21 assembler and are
+// spelled out as WORDs.
+TEXT ·overlapAddKernel(SB), NOSPLIT, $0-96
+	MOVD out_base+0(FP), R0
+	MOVD out_len+8(FP), R3
+	MOVD down_base+24(FP), R1
+	MOVD up_base+48(FP), R2
+	FMOVD n+72(FP), F0
+	VDUP V0.D[0], V0.D2
+	MOVD w+80(FP), R4
+	VLD1 (R4), [V1.D2, V2.D2]
+	FMOVD step+88(FP), F6
+	VDUP V6.D[0], V6.D2
+	LSR $2, R3
+	CBZ R3, done
+
+loop:
+	VLD1.P 8(R1), [V16.H4]
+	VLD1.P 8(R2), [V17.H4]
+	WORD $0x0f10a610 // SXTL V16.S4, V16.H4
+	WORD $0x0f10a631 // SXTL V17.S4, V17.H4
+	WORD $0x0f20a612 // SXTL V18.D2, V16.S2
+	WORD $0x4f20a613 // SXTL2 V19.D2, V16.S4
+	WORD $0x0f20a634 // SXTL V20.D2, V17.S2
+	WORD $0x4f20a635 // SXTL2 V21.D2, V17.S4
+	WORD $0x4e61da52 // SCVTF V18.D2, V18.D2
+	WORD $0x4e61da73 // SCVTF V19.D2, V19.D2
+	WORD $0x4e61da94 // SCVTF V20.D2, V20.D2
+	WORD $0x4e61dab5 // SCVTF V21.D2, V21.D2
+	WORD $0x4ee1d416 // FSUB V22.D2, V0.D2, V1.D2
+	WORD $0x4ee2d417 // FSUB V23.D2, V0.D2, V2.D2
+	WORD $0x6e76de52 // FMUL V18.D2, V18.D2, V22.D2
+	WORD $0x6e77de73 // FMUL V19.D2, V19.D2, V23.D2
+	WORD $0x6e61de94 // FMUL V20.D2, V20.D2, V1.D2
+	WORD $0x6e62deb5 // FMUL V21.D2, V21.D2, V2.D2
+	WORD $0x4e74d652 // FADD V18.D2, V18.D2, V20.D2
+	WORD $0x4e75d673 // FADD V19.D2, V19.D2, V21.D2
+	WORD $0x6e60fe52 // FDIV V18.D2, V18.D2, V0.D2
+	WORD $0x6e60fe73 // FDIV V19.D2, V19.D2, V0.D2
+	WORD $0x4ee1ba52 // FCVTZS V18.D2, V18.D2
+	WORD $0x4ee1ba73 // FCVTZS V19.D2, V19.D2
+	WORD $0x0ea12a52 // XTN V18.S2, V18.D2
+	WORD $0x4ea12a72 // XTN2 V18.S4, V19.D2
+	WORD $0x0e612a52 // XTN V18.H4, V18.S4
+	VST1.P [V18.H4], 8(R0)
+	WORD $0x4e66d421 // FADD V1.D2, V1.D2, V6.D2
+	WORD $0x4e66d442 // FADD V2.D2, V2.D2, V6.D2
+	SUB $1, R3
+	CBNZ R3, loop
+
+done:
+	RET
@@ -0,0 +1,148 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simd
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// samples decodes little-endian int16 samples from fuzz data.
+func samples(data []byte) []int16 {
+	s := make([]int16, len(data)/2)
+	for i := range s {
+		s[i] = int16(binary.LittleEndian.Uint16(data[2*i:]))
+	}
+	return s
+}
+
+// seed returns random samples including the extreme values.
+func seed(n int) []byte {
+	r := rand.New(rand.NewSource(int64(n)))
+	data := make([]byte, 2*n)
+	for i := 0; i < n; i++ {
+		v := uint16(r.Intn(65536))
+		switch i % 7 {
+		case 0:
+			v = 0x8000
+		case 3:
+			v = 0x7fff
+		}
+		binary.LittleEndian.PutUint16(data[2*i:], v)
+	}
+	return data
+}
+
+func FuzzAMDF(f *testing.F) {
+	for _, n := range []int{0, 15, 16, 33, 130, 1480} {
+		f.Add(seed(2*n), n)
+	}
+	f.Fuzz(func(t *testing.T, data []byte, period int) {
+		s := samples(data)
+		if period < 0 || 2*period > len(s) {
+			period = len(s) / 2
+		}
+		a, b := s[:period], s[period:2*period]
+		if got, want := AMDF(a, b), amdfGeneric(a, b); got != want {
+			t.Errorf("AMDF of %d samples = %d, want %d", period, got, want)
+		}
+	})
+}
+
+func FuzzOverlapAdd(f *testing.F) {
+	for _, n := range []int{1, 3, 4, 17, 160, 5000} {
+		for _, ch := range []int{1, 2, 3, 4} {
+			f.Add(seed(2*n*ch), ch, n)
+		}
+	}
+	f.Fuzz(func(t *testing.T, data []byte, ch, n int) {
+		s := samples(data)
+		if ch < 1 || ch > 8 {
+			ch = 1
+		}
+		if n < 1 || 2*n*ch > len(s) {
+			n = len(s) / (2 * ch)
+			if n == 0 {
+				return
+			}
+		}
+		down, up := s[:n*ch], s[n*ch:2*n*ch]
+		got, want := make([]int16, n*ch), make([]int16, n*ch)
+		OverlapAdd(got, down, up, ch, n)
+		overlapAddGeneric(want, down, up, ch, n, 0)
+		if !slices.Equal(got, want) {
+			t.Errorf("OverlapAdd of %d frames with %d channels differs from the scalar code", n, ch)
+		}
+	})
+}
+
+func TestOverlapAddLongRamp(t *testing.T) {
+	// Long ramps make the products exceed 32 bits.
+	n := 100000
+	down, up := make([]int16, n), make([]int16, n)
+	for i := range down {
+		down[i], up[i] = 32767, -32768
+	}
+	got, want := make([]int16, n), make([]int16, n)
+	OverlapAdd(got, down, up, 1, n)
+	overlapAddGeneric(want, down, up, 1, n, 0)
+	if !slices.Equal(got, want) {
+		t.Error("OverlapAdd differs from the scalar code")
+	}
+}
+
+func TestAMDFLongPeriod(t *testing.T) {
+	// The kernels add up in 32 bits, which overflows past 1<<16 differences of 65535.
+	for _, n := range []int{amdfKernelMax - amdfBlock, amdfKernelMax, amdfKernelMax + amdfBlock} {
+		a, b := make([]int16, n), make([]int16, n)
+		for i := range a {
+			a[i], b[i] = 32767, -32768
+		}
+		if got, want := AMDF(a, b), amdfGeneric(a, b); got != want {
+			t.Errorf("AMDF of %d samples = %d, want %d", n, got, want)
+		}
+	}
+}
+
+func BenchmarkAMDF(b *testing.B) {
+	s := samples(seed(2 * 400))
+	b.Run("kernel", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			AMDF(s[:400], s[400:])
+		}
+	})
+	b.Run("scalar", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			amdfGeneric(s[:400], s[400:])
+		}
+	})
+}
+
+func BenchmarkOverlapAdd(b *testing.B) {
+	s := samples(seed(2 * 400))
+	out := make([]int16, 400)
+	b.Run("kernel", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			OverlapAdd(out, s[:400], s[400:], 1, 400)
+		}
+	})
+	b.Run("scalar", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			overlapAddGeneric(out, s[:400], s[400:], 1, 400, 0)
+		}
+	})
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonic
+
+import (
+	"errors"
+	"math"
+)
+
+// ErrBufferFull is returned when a write does not fit into the capacity limits of a stream.
+// Nothing is written; the caller should read some output and try again.
+var ErrBufferFull = errors.New("stream buffer is full")
+
+// GetMaxInput returns the input capacity limit in samples per channel, 0 if unlimited.
+func (stream *Stream) GetMaxInput() int {
+	return stream.maxInput
+}
+
+// SetMaxInput limits how many samples per channel may wait in the input buffer. 0 removes the limit.
+// Up to two maximal pitch periods of input stay buffered between writes, so the limit is raised
+// to at least twice that.
+func (stream *Stream) SetMaxInput(samples int) {
+	if samples > 0 && samples < 2*stream.maxRequired {
+		samples = 2 * stream.maxRequired
+	}
+	stream.maxInput = max(samples, 0)
+}
+
+// GetMaxOutput returns the output capacity limit in samples per channel, 0 if unlimited.
+func (stream *Stream) GetMaxOutput() int {
+	return stream.maxOutput
+}
+
+// SetMaxOutput limits how many samples per channel may pile up in the output buffer. Writes that
+// would take the output over the limit fail with ErrBufferFull, so a consumer that stops reading
+// stops the producer instead of making the stream grow without bound. 0 removes the limit.
+// Flush is not limited, it may add the output for up to a few pitch periods of buffered input.
+func (stream *Stream) SetMaxOutput(samples int) {
+	stream.maxOutput = max(samples, 0)
+}
+
+// Writable returns how many samples per channel the stream can currently accept. With no limits
+// set it returns math.MaxInt.
+func (stream *Stream) Writable() int {
+	n := math.MaxInt
+	if stream.maxInput > 0 {
+		n = stream.maxInput - stream.inputBuffer.Len()
+	}
+	if stream.maxOutput > 0 {
+		// Processing turns all buffered input into output at the effective speed, give or take
+		// a pitch period. Keep that much room in reserve.
+		free := stream.maxOutput - stream.outputBuffer.Len() - stream.maxRequired
+		pending := stream.inputBuffer.Len() + stream.pitchBuffer.Len()
+		n = min(n, int(float64(free)*stream.speed*stream.rate)-pending)
+	}
+	return max(n, 0)
+}
+
+// reserve checks that n interleaved samples fit into the capacity limits.
+func (stream *Stream) reserve(n int) error {
+	if stream.maxInput == 0 && stream.maxOutput == 0 {
+		return nil
+	}
+	if n/stream.numChannels > stream.Writable() {
+		return ErrBufferFull
+	}
+	return nil
+}
+
+// fits reports whether n interleaved samples could be written to the stream once all its output
+// has been read. Input that processing keeps buffered counts against the limits, so a write
+// that does not fit then can never succeed.
+func (stream *Stream) fits(n int) bool {
+	frames := n / stream.numChannels
+	if stream.maxInput > 0 && frames > stream.maxInput-stream.maxRequired {
+		return false
+	}
+	if stream.maxOutput > 0 && frames > int(float64(stream.maxOutput-stream.maxRequired)*stream.speed*stream.rate)-2*stream.maxRequired {
+		return false
+	}
+	return true
+}
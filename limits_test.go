@@ -0,0 +1,159 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonic
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestMaxOutput(t *testing.T) {
+	stream := NewSonicStream(16000, 1)
+	stream.SetSpeed(0.5)
+	stream.SetMaxOutput(8000)
+	frame := sine(16000, 320, 200, 0.5)
+
+	writes := 0
+	for ; writes < 1000; writes++ {
+		err := stream.Write(frame)
+		if errors.Is(err, ErrBufferFull) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if n := stream.NumOutputSamples(); n > 8000 {
+			t.Fatalf("output grew to %d samples", n)
+		}
+	}
+	if writes == 1000 {
+		t.Fatal("writes never failed")
+	}
+	if w := stream.Writable(); w >= 320 {
+		t.Errorf("Writable %d after ErrBufferFull", w)
+	}
+
+	if _, err := stream.ReadAll(); err != nil {
+		t.Fatal(err)
+	}
+	if w := stream.Writable(); w < 320 {
+		t.Errorf("Writable %d after reading all output", w)
+	}
+	if err := stream.Write(frame); err != nil {
+		t.Errorf("write after reading failed: %v", err)
+	}
+
+	stream.SetMaxOutput(0)
+	if w := stream.Writable(); w != math.MaxInt {
+		t.Errorf("Writable %d without limits", w)
+	}
+}
+
+func TestMaxInput(t *testing.T) {
+	stream := NewSonicStream(16000, 2)
+	stream.SetMaxInput(1)
+	if got := stream.GetMaxInput(); got != 2*stream.maxRequired {
+		t.Errorf("max input %d, want it raised to %d", got, 2*stream.maxRequired)
+	}
+	stream.SetSpeed(2)
+	if err := stream.Write(make([]int16, 2*(stream.GetMaxInput()+1))); !errors.Is(err, ErrBufferFull) {
+		t.Errorf("expected ErrBufferFull, got %v", err)
+	}
+	if stream.NumInputSamples() != 0 {
+		t.Error("a failed write left samples behind")
+	}
+}
+
+func TestSyncStreamBlocks(t *testing.T) {
+	stream := NewSonicStream(16000, 1)
+	stream.SetSpeed(0.5)
+	stream.SetMaxOutput(4000)
+	ss := NewSyncStream(stream)
+	frame := sine(16000, 320, 200, 0.5)
+
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 100; i++ {
+			if err := ss.Write(frame); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- ss.Flush()
+	}()
+
+	out := make([]int16, 160)
+	total := 0
+	for finished := false; !finished; {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			finished = true
+		case <-time.After(time.Millisecond):
+		}
+		ss.Do(func(s *Stream) {
+			if n := s.NumOutputSamples(); n > 4000 {
+				t.Errorf("output grew to %d samples", n)
+			}
+		})
+		for {
+			got, err := ss.ReadTo(out)
+			if err != nil {
+				break
+			}
+			total += len(got)
+		}
+	}
+	if total < 63000 || total > 65000 {
+		t.Errorf("read %d samples, want about 64000", total)
+	}
+}
+
+func TestSyncStreamUnblock(t *testing.T) {
+	stream := NewSonicStream(16000, 1)
+	stream.SetMaxOutput(4000)
+	ss := NewSyncStream(stream)
+	frame := make([]int16, 320)
+	for ss.Writable() >= len(frame) {
+		if err := ss.Write(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := ss.WriteContext(ctx, frame); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline to expire, got %v", err)
+	}
+
+	done := make(chan error)
+	go func() { done <- ss.Write(frame) }()
+	time.Sleep(10 * time.Millisecond)
+	_ = ss.Close()
+	if err := <-done; !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+
+	if err := ss.Write(make([]int16, 100000)); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed after Close, got %v", err)
+	}
+	if err := NewSyncStream(stream).Write(make([]int16, 100000)); !errors.Is(err, ErrBufferFull) {
+		t.Errorf("expected ErrBufferFull for a write that never fits, got %v", err)
+	}
+}
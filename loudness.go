@@ -0,0 +1,481 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonic
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultTruePeak is the default limiter ceiling in dBTP.
+	DefaultTruePeak = -1.0
+
+	// loudnessBlockHops is the number of 100ms hops in a 400ms gating block.
+	loudnessBlockHops = 4
+
+	// loudnessAbsoluteGate and loudnessRelativeGate are the BS.1770 gating thresholds.
+	loudnessAbsoluteGate = -70.0
+	loudnessRelativeGate = -10.0
+
+	// loudnessBinsPerLU is the resolution of the gating histogram.
+	loudnessBinsPerLU = 10
+	// loudnessMaxLUFS is the loudest block the histogram can hold.
+	loudnessMaxLUFS = 10.0
+
+	// normalizeMaxGain and normalizeMinGain bound the normalization gain in dB.
+	normalizeMaxGain = 20.0
+	normalizeMinGain = -40.0
+
+	// normalizeTimeConstant is how fast, in seconds, the gain follows the measured loudness.
+	normalizeTimeConstant = 1.0
+
+	// limiterLookahead and limiterRelease are the limiter time constants in seconds.
+	limiterLookahead = 0.005
+	limiterRelease   = 0.05
+)
+
+// ErrLoudness is returned for an unparsable loudness target.
+var ErrLoudness = errors.New("invalid loudness target")
+
+// biquad is a second-order IIR filter section.
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+}
+
+// biquadState holds the transposed direct form II delay elements of a biquad.
+type biquadState struct {
+	z1, z2 float64
+}
+
+// run filters a single value.
+func (f *biquad) run(s *biquadState, x float64) float64 {
+	y := f.b0*x + s.z1
+	s.z1 = f.b1*x - f.a1*y + s.z2
+	s.z2 = f.b2*x - f.a2*y
+	return y
+}
+
+// kWeighting returns the two BS.1770 K-weighting filter stages for the sample rate.
+func kWeighting(sampleRate int) (biquad, biquad) {
+	fs := float64(sampleRate)
+
+	// Stage 1: high shelf modelling the acoustic effect of the head.
+	f0, gain, q := 1681.974450955533, 3.999843853973347, 0.7071752369554196
+	k := math.Tan(math.Pi * f0 / fs)
+	vh := math.Pow(10, gain/20)
+	vb := math.Pow(vh, 0.4996667741545416)
+	a0 := 1 + k/q + k*k
+	shelf := biquad{
+		b0: (vh + vb*k/q + k*k) / a0,
+		b1: 2 * (k*k - vh) / a0,
+		b2: (vh - vb*k/q + k*k) / a0,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+
+	// Stage 2: the RLB high-pass.
+	f0, q = 38.13547087602444, 0.5003270373238773
+	k = math.Tan(math.Pi * f0 / fs)
+	a0 = 1 + k/q + k*k
+	highPass := biquad{
+		b0: 1,
+		b1: -2,
+		b2: 1,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+	return shelf, highPass
+}
+
+// loudnessStage is an optional output stage. It measures the gated integrated loudness of the
+// output, applies a smooth gain towards a target and runs a look-ahead true-peak limiter.
+// The limiter delays the output by lookahead+1 samples.
+type loudnessStage struct {
+	ch      int
+	target  float64
+	ceiling float64
+
+	// K-weighting filters and their per channel state.
+	shelf, highPass   biquad
+	shelfS, highPassS []biquadState
+
+	// Gating: energy of the current 100ms hop, the last four hops and a histogram of the
+	// loudness of all blocks above the absolute gate.
+	hopLen    int
+	hopPos    int
+	hopEnergy float64
+	hops      [loudnessBlockHops]float64
+	hopCount  int
+	binCount  []int64
+	binEnergy []float64
+
+	// Normalization gain and the value it is moving towards.
+	gain       float64
+	targetGain float64
+	gainAlpha  float64
+
+	// Limiter state: the last four gained frames for inter-sample peak estimation, a sliding
+	// minimum of the required gain, its release smoothing, a moving average of the result and
+	// a delay line matching the look-ahead.
+	look     int
+	hist     []float64
+	minIdx   []int
+	minVal   []float64
+	minHead  int
+	minLen   int
+	frameIdx int
+	held     float64
+	relAlpha float64
+	avg      []float64
+	avgPos   int
+	avgSum   float64
+	delay    []float64
+	valid    []bool
+	delayPos int
+
+	frame   []float64
+	scratch []int16
+}
+
+// newLoudnessStage creates a loudness stage aiming at target LUFS with a ceiling in dBTP.
+func newLoudnessStage(sampleRate, ch int, target, ceilingDB float64) *loudnessStage {
+	look := int(math.Round(limiterLookahead * float64(sampleRate)))
+	if look < 1 {
+		look = 1
+	}
+	bins := int((loudnessMaxLUFS-loudnessAbsoluteGate)*loudnessBinsPerLU) + 1
+	shelf, highPass := kWeighting(sampleRate)
+
+	l := &loudnessStage{
+		ch:        ch,
+		target:    target,
+		ceiling:   math.Pow(10, ceilingDB/20) * 32768,
+		shelf:     shelf,
+		highPass:  highPass,
+		shelfS:    make([]biquadState, ch),
+		highPassS: make([]biquadState, ch),
+		hopLen:    sampleRate / 10,
+		binCount:  make([]int64, bins),
+		binEnergy: make([]float64, bins),
+		gainAlpha: 1 - math.Exp(-1/(normalizeTimeConstant*float64(sampleRate))),
+		look:      look,
+		hist:      make([]float64, 4*ch),
+		minIdx:    make([]int, look+2),
+		minVal:    make([]float64, look+2),
+		relAlpha:  1 - math.Exp(-1/(limiterRelease*float64(sampleRate))),
+		avg:       make([]float64, look),
+		delay:     make([]float64, (look+1)*ch),
+		valid:     make([]bool, look+1),
+		frame:     make([]float64, ch),
+		scratch:   make([]int16, 0, (look+1)*ch),
+	}
+	l.reset()
+	return l
+}
+
+// clone returns a copy of the stage, either with all its state or freshly reset.
+func (l *loudnessStage) clone(withState bool) *loudnessStage {
+	c := *l
+	c.shelfS = append([]biquadState(nil), l.shelfS...)
+	c.highPassS = append([]biquadState(nil), l.highPassS...)
+	c.binCount = append([]int64(nil), l.binCount...)
+	c.binEnergy = append([]float64(nil), l.binEnergy...)
+	c.hist = append([]float64(nil), l.hist...)
+	c.minIdx = append([]int(nil), l.minIdx...)
+	c.minVal = append([]float64(nil), l.minVal...)
+	c.avg = append([]float64(nil), l.avg...)
+	c.delay = append([]float64(nil), l.delay...)
+	c.valid = append([]bool(nil), l.valid...)
+	c.frame = make([]float64, len(l.frame))
+	c.scratch = make([]int16, 0, cap(l.scratch))
+	if !withState {
+		c.reset()
+	}
+	return &c
+}
+
+// reset clears all measurements and the delay line.
+func (l *loudnessStage) reset() {
+	clear(l.shelfS)
+	clear(l.highPassS)
+	l.hopPos, l.hopEnergy, l.hopCount = 0, 0, 0
+	l.hops = [loudnessBlockHops]float64{}
+	clear(l.binCount)
+	clear(l.binEnergy)
+	l.gain, l.targetGain = 1, 1
+	l.resetLimiter()
+}
+
+// resetLimiter drops the samples in the delay line and the limiter gain, keeping the loudness
+// measurement and the normalization gain.
+func (l *loudnessStage) resetLimiter() {
+	clear(l.hist)
+	l.minHead, l.minLen, l.frameIdx = 0, 0, 0
+	l.held = 1
+	for i := range l.avg {
+		l.avg[i] = 1
+	}
+	l.avgPos, l.avgSum = 0, float64(len(l.avg))
+	clear(l.delay)
+	clear(l.valid)
+	l.delayPos = 0
+}
+
+// pending returns the number of samples held in the limiter delay line.
+func (l *loudnessStage) pending() int {
+	n := 0
+	for _, v := range l.valid {
+		if v {
+			n++
+		}
+	}
+	return n
+}
+
+// loudness returns the gated integrated loudness measured so far, or -Inf if nothing was measured.
+func (l *loudnessStage) loudness() float64 {
+	var count int64
+	var energy float64
+	for i := range l.binCount {
+		count += l.binCount[i]
+		energy += l.binEnergy[i]
+	}
+	if count == 0 {
+		return math.Inf(-1)
+	}
+
+	relative := energyToLUFS(energy/float64(count)) + loudnessRelativeGate
+	first := int(math.Ceil((relative - loudnessAbsoluteGate) * loudnessBinsPerLU))
+	if first < 0 {
+		first = 0
+	}
+	count, energy = 0, 0
+	for i := first; i < len(l.binCount); i++ {
+		count += l.binCount[i]
+		energy += l.binEnergy[i]
+	}
+	if count == 0 {
+		return math.Inf(-1)
+	}
+	return energyToLUFS(energy / float64(count))
+}
+
+// energyToLUFS converts a mean square K-weighted energy to loudness.
+func energyToLUFS(e float64) float64 {
+	return -0.691 + 10*math.Log10(e)
+}
+
+// measure feeds a frame of full-scale normalized samples to the loudness meter and updates
+// the normalization target once per 100ms.
+func (l *loudnessStage) measure(frame []float64) {
+	for c, x := range frame {
+		z := l.highPass.run(&l.highPassS[c], l.shelf.run(&l.shelfS[c], x))
+		l.hopEnergy += z * z
+	}
+	l.hopPos++
+	if l.hopPos < l.hopLen {
+		return
+	}
+
+	copy(l.hops[:], l.hops[1:])
+	l.hops[loudnessBlockHops-1] = l.hopEnergy / float64(l.hopLen)
+	l.hopPos, l.hopEnergy = 0, 0
+	if l.hopCount < loudnessBlockHops {
+		l.hopCount++
+		if l.hopCount < loudnessBlockHops {
+			return
+		}
+	}
+
+	var block float64
+	for _, e := range l.hops {
+		block += e
+	}
+	block /= loudnessBlockHops
+	lufs := energyToLUFS(block)
+	if lufs <= loudnessAbsoluteGate {
+		return
+	}
+	bin := int((lufs - loudnessAbsoluteGate) * loudnessBinsPerLU)
+	if bin >= len(l.binCount) {
+		bin = len(l.binCount) - 1
+	}
+	l.binCount[bin]++
+	l.binEnergy[bin] += block
+
+	gain := math.Max(normalizeMinGain, math.Min(normalizeMaxGain, l.target-l.loudness()))
+	l.targetGain = math.Pow(10, gain/20)
+}
+
+// process runs interleaved samples through the stage in place. It returns the number of samples
+// at the head of s that are ready; the others are kept in the delay line.
+func (l *loudnessStage) process(s []int16) int {
+	out := 0
+	for i := 0; i+l.ch <= len(s); i += l.ch {
+		for c := 0; c < l.ch; c++ {
+			l.frame[c] = float64(s[i+c]) / 32768
+		}
+		l.measure(l.frame)
+		l.gain += (l.targetGain - l.gain) * l.gainAlpha
+
+		for c := 0; c < l.ch; c++ {
+			l.frame[c] = float64(s[i+c]) * l.gain
+		}
+		if l.limit(l.frame, true, s[out:out+l.ch]) {
+			out += l.ch
+		}
+	}
+	return out
+}
+
+// drain pushes silence through the limiter until the delay line is empty and returns the
+// samples that were held in it. The returned slice is reused by the next call.
+func (l *loudnessStage) drain() []int16 {
+	l.scratch = l.scratch[:0]
+	clear(l.frame)
+	for range l.valid {
+		n := len(l.scratch)
+		l.scratch = l.scratch[:n+l.ch]
+		if !l.limit(l.frame, false, l.scratch[n:]) {
+			l.scratch = l.scratch[:n]
+		}
+	}
+	return l.scratch
+}
+
+// limit pushes a gained frame into the limiter. If a delayed frame comes out, it is written to
+// out and limit returns true.
+func (l *loudnessStage) limit(frame []float64, valid bool, out []int16) bool {
+	ch := l.ch
+
+	// Estimate the true peak of the segment between the two middle frames of the history
+	// using Catmull-Rom interpolation at a 4x oversampling rate.
+	copy(l.hist, l.hist[ch:])
+	copy(l.hist[3*ch:], frame)
+	peak := 0.0
+	for c := 0; c < ch; c++ {
+		p0, p1, p2, p3 := l.hist[c], l.hist[ch+c], l.hist[2*ch+c], l.hist[3*ch+c]
+		peak = math.Max(peak, math.Max(math.Abs(p1), math.Abs(p2)))
+		for _, t := range [...]float64{0.25, 0.5, 0.75} {
+			v := p1 + 0.5*t*(p2-p0+t*(2*p0-5*p1+4*p2-p3+t*(3*(p1-p2)+p3-p0)))
+			peak = math.Max(peak, math.Abs(v))
+		}
+	}
+	required := 1.0
+	if peak > l.ceiling {
+		required = l.ceiling / peak
+	}
+
+	// Sliding minimum over look+1 frames, so that the gain is low enough for both frames around
+	// the segment by the time they leave the delay line.
+	size := len(l.minIdx)
+	for l.minLen > 0 && l.minVal[(l.minHead+l.minLen-1)%size] >= required {
+		l.minLen--
+	}
+	tail := (l.minHead + l.minLen) % size
+	l.minIdx[tail], l.minVal[tail] = l.frameIdx, required
+	l.minLen++
+	for l.minIdx[l.minHead] <= l.frameIdx-(l.look+1) {
+		l.minHead = (l.minHead + 1) % size
+		l.minLen--
+	}
+	l.frameIdx++
+	hold := l.minVal[l.minHead]
+
+	// Attack instantly, release slowly, then smooth the attack with a moving average that spans
+	// the look-ahead.
+	if hold < l.held {
+		l.held = hold
+	} else {
+		l.held += (hold - l.held) * l.relAlpha
+	}
+	l.avgSum += l.held - l.avg[l.avgPos]
+	l.avg[l.avgPos] = l.held
+	l.avgPos = (l.avgPos + 1) % len(l.avg)
+	gain := l.avgSum / float64(len(l.avg))
+
+	pos := l.delayPos * ch
+	ready := l.valid[l.delayPos]
+	if ready {
+		for c := 0; c < ch; c++ {
+			out[c] = clampInt16(math.Round(l.delay[pos+c] * gain))
+		}
+	}
+	copy(l.delay[pos:pos+ch], frame)
+	l.valid[l.delayPos] = valid
+	l.delayPos = (l.delayPos + 1) % len(l.valid)
+	return ready
+}
+
+// clampInt16 converts a value to int16, clipping it to the valid range.
+func clampInt16(v float64) int16 {
+	if v > ShrtMax {
+		return ShrtMax
+	} else if v < ShrtMin {
+		return ShrtMin
+	}
+	return int16(v)
+}
+
+// ParseLoudness parses a loudness target such as "-16LUFS", "-23 LUFS" or "-14".
+func ParseLoudness(s string) (float64, error) {
+	v := strings.TrimSpace(s)
+	if len(v) >= 4 && strings.EqualFold(v[len(v)-4:], "LUFS") {
+		v = strings.TrimSpace(v[:len(v)-4])
+	}
+	lufs, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsNaN(lufs) || lufs >= 0 || lufs < loudnessAbsoluteGate {
+		return 0, fmt.Errorf("%w %q", ErrLoudness, s)
+	}
+	return lufs, nil
+}
+
+// SetNormalization enables the loudness output stage. The stage measures the gated integrated
+// loudness of the output (EBU R128 style) and smoothly applies a gain moving it towards
+// targetLUFS. A look-ahead limiter keeps true peaks below ceilingDBTP, e.g. DefaultTruePeak.
+// The limiter delays the output by about 5ms; Flush drains it.
+func (stream *Stream) SetNormalization(targetLUFS, ceilingDBTP float64) {
+	stream.loudness = newLoudnessStage(stream.sampleRate, stream.numChannels, targetLUFS, ceilingDBTP)
+}
+
+// DisableNormalization removes the loudness output stage. Samples held by its limiter are lost,
+// so call Flush first to keep them.
+func (stream *Stream) DisableNormalization() {
+	stream.loudness = nil
+}
+
+// GetLoudness returns the gated integrated loudness in LUFS of the output measured so far,
+// before the normalization gain. It returns -Inf if normalization is disabled or nothing
+// was measured yet.
+func (stream *Stream) GetLoudness() float64 {
+	if stream.loudness == nil {
+		return math.Inf(-1)
+	}
+	return stream.loudness.loudness()
+}
+
+// normalize runs the output produced since position at through the loudness stage.
+func (stream *Stream) normalize(at int) error {
+	slice, err := stream.outputBuffer.ReadSliceAt(at)
+	if err != nil {
+		return err
+	}
+	n := stream.loudness.process(slice)
+	return stream.outputBuffer.WriteSlice(slice[:n])
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonic
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func sine(sampleRate, frames int, freq, amplitude float64) []int16 {
+	out := make([]int16, frames)
+	for i := range out {
+		out[i] = int16(amplitude * 32767 * math.Sin(2*math.Pi*freq*float64(i)/float64(sampleRate)))
+	}
+	return out
+}
+
+func peakAmplitude(s []int16) float64 {
+	peak := 0
+	for _, v := range s {
+		if a := int(v); a > peak {
+			peak = a
+		} else if -a > peak {
+			peak = -a
+		}
+	}
+	return float64(peak) / 32768
+}
+
+func processAll(t *testing.T, stream *Stream, in []int16) []int16 {
+	t.Helper()
+	var out []int16
+	for off := 0; off < len(in); off += 1600 {
+		if err := stream.Write(in[off:min(off+1600, len(in))]); err != nil {
+			t.Fatal(err)
+		}
+		got, _ := stream.ReadAll()
+		out = append(out, got...)
+	}
+	if err := stream.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := stream.ReadAll()
+	return append(out, got...)
+}
+
+func TestNormalization(t *testing.T) {
+	const sampleRate = 16000
+	// A 1kHz sine with a peak of 0.1 measures about -23 LUFS.
+	in := sine(sampleRate, 10*sampleRate, 1000, 0.1)
+
+	stream := NewSonicStream(sampleRate, 1)
+	stream.SetNormalization(-16, DefaultTruePeak)
+	out := processAll(t, stream, in)
+
+	if want := processAll(t, NewSonicStream(sampleRate, 1), in); len(out) != len(want) {
+		t.Errorf("got %d samples, want %d as without normalization", len(out), len(want))
+	}
+	if got := stream.GetLoudness(); math.Abs(got+23.0) > 0.2 {
+		t.Errorf("measured %.2f LUFS, want about -23", got)
+	}
+	// -16 LUFS is a sine peak of about 0.224.
+	if got := 20 * math.Log10(peakAmplitude(out[len(out)-sampleRate:])/0.224); math.Abs(got) > 0.5 {
+		t.Errorf("output level is %.2f dB off the target", got)
+	}
+}
+
+func TestNormalizationLimiter(t *testing.T) {
+	const sampleRate = 16000
+	in := sine(sampleRate, 4*sampleRate, 3700, 0.5)
+
+	stream := NewSonicStream(sampleRate, 2)
+	stream.SetSpeed(1.5)
+	stream.SetNormalization(0, DefaultTruePeak)
+	stereo := make([]int16, 2*len(in))
+	for i, v := range in {
+		stereo[2*i], stereo[2*i+1] = v, -v
+	}
+	out := processAll(t, stream, stereo)
+
+	if peak := 20 * math.Log10(peakAmplitude(out)); peak > DefaultTruePeak+0.01 {
+		t.Errorf("peak %.2f dBFS above the %.1f dBTP ceiling", peak, DefaultTruePeak)
+	}
+
+	plain := NewSonicStream(sampleRate, 2)
+	plain.SetSpeed(1.5)
+	if want := processAll(t, plain, stereo); len(out) != len(want) {
+		t.Errorf("got %d samples, want %d as without normalization", len(out), len(want))
+	}
+}
+
+func TestParseLoudness(t *testing.T) {
+	for in, want := range map[string]float64{"-16LUFS": -16, "-23 lufs": -23, " -14.5 ": -14.5} {
+		if got, err := ParseLoudness(in); err != nil || got != want {
+			t.Errorf("ParseLoudness(%q) = %v, %v, want %v", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "LUFS", "loud", "3LUFS", "-90"} {
+		if _, err := ParseLoudness(in); !errors.Is(err, ErrLoudness) {
+			t.Errorf("ParseLoudness(%q) expected ErrLoudness, got %v", in, err)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonic
+
+import (
+	"cmp"
+	"math"
+	"slices"
+)
+
+// Marker is a position in the audio, such as a WAV cue point, that the stream carries from the
+// input to the output.
+type Marker struct {
+	// Pos is the frame the marker is at, counted from the start of the stream or the last Reset:
+	// in the input for AddMarker and in the output for ReadMarkers.
+	Pos int
+	// ID identifies the marker to the caller.
+	ID int
+}
+
+// AddMarker adds a marker at an input frame. Markers at frames already written are placed at
+// the first frame written next. The frames of a Seek pre-roll do not count, the frames Discard
+// drops do.
+func (stream *Stream) AddMarker(m Marker) {
+	i, _ := slices.BinarySearchFunc(stream.markersIn, m, func(a, b Marker) int { return cmp.Compare(a.Pos, b.Pos+1) })
+	stream.markersIn = slices.Insert(stream.markersIn, i, m)
+}
+
+// ReadMarkers returns the markers whose output frame the stream produced since the last call, in
+// order of position, and forgets them. The output frame of a marker is estimated from the
+// playtime of the input held by the stream when its input frame is written and can be off by
+// about a pitch period. Markers in output dropped by Seek, Discard or Flush end up at the frame
+// where the output goes on.
+func (stream *Stream) ReadMarkers() []Marker {
+	var out []Marker
+	stream.markersOut = slices.DeleteFunc(stream.markersOut, func(m Marker) bool {
+		if m.Pos > stream.produced {
+			return false
+		}
+		out = append(out, m)
+		return true
+	})
+	slices.SortStableFunc(out, func(a, b Marker) int { return cmp.Compare(a.Pos, b.Pos) })
+	return out
+}
+
+// noteInput counts frames of input written after the stream held input for the output frames up
+// to at, and moves the markers among them to their output frames. Without frames, it moves the
+// markers at the end of the input written so far.
+func (stream *Stream) noteInput(at, frames int) {
+	skip := min(stream.discard, frames)
+	scale := stream.speed * stream.rate
+	n := 0
+	for ; n < len(stream.markersIn) && (stream.markersIn[n].Pos < stream.written+frames || stream.markersIn[n].Pos <= stream.written && frames == 0); n++ {
+		m := stream.markersIn[n]
+		offset := max(m.Pos-stream.written-skip, 0)
+		m.Pos = at + int(math.Round(float64(offset)/scale))
+		stream.markersOut = append(stream.markersOut, m)
+	}
+	stream.markersIn = slices.Delete(stream.markersIn, 0, n)
+	stream.written += frames
+}
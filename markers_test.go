@@ -0,0 +1,119 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonic
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+// processMarkers writes samples in chunks, flushes and returns the output and the markers read.
+func processMarkers(t *testing.T, stream *Stream, samples []int16, chunk int) ([]int16, []Marker) {
+	t.Helper()
+	var out []int16
+	var markers []Marker
+	for off := 0; off < len(samples); off += chunk {
+		if err := stream.Write(samples[off:min(off+chunk, len(samples))]); err != nil {
+			t.Fatal(err)
+		}
+		got, _ := stream.ReadAll()
+		out = append(out, got...)
+		markers = append(markers, stream.ReadMarkers()...)
+	}
+	_ = stream.Flush()
+	got, _ := stream.ReadAll()
+	return append(out, got...), append(markers, stream.ReadMarkers()...)
+}
+
+func TestMarkers(t *testing.T) {
+	w, sampleRate, _, err := readWAV("./testdata/OSR_us_000_0010_8k.wav")
+	if err != nil {
+		t.Fatalf("reading error: %v", err)
+	}
+	w = w[:len(w)/4]
+	maxPeriod := sampleRate / MinPitch
+
+	for _, tc := range []struct {
+		speed, pitch, rate float64
+		tolerance          int
+	}{
+		{1, 1, 1, 0},
+		{1.5, 1, 1, maxPeriod},
+		{0.7, 1.2, 1, maxPeriod},
+		{1, 1, 1.3, SincFilterPoints},
+	} {
+		stream := NewSonicStream(sampleRate, 1)
+		stream.SetSpeed(tc.speed)
+		stream.SetPitch(tc.pitch)
+		stream.SetRate(tc.rate)
+		var want []Marker
+		for i, pos := range []int{0, 1, sampleRate / 3, sampleRate, 2 * sampleRate, 2*sampleRate + 5, len(w)} {
+			stream.AddMarker(Marker{Pos: pos, ID: i})
+			want = append(want, Marker{Pos: pos, ID: i})
+		}
+		_, got := processMarkers(t, stream, w, 700)
+
+		if len(got) != len(want) {
+			t.Fatalf("speed %v pitch %v rate %v: %d markers, want %d", tc.speed, tc.pitch, tc.rate, len(got), len(want))
+		}
+		for i, m := range got {
+			pos := int(math.Round(float64(want[i].Pos) / (tc.speed * tc.rate)))
+			if m.ID != want[i].ID || abs(m.Pos-pos) > tc.tolerance {
+				t.Errorf("speed %v pitch %v rate %v: marker %d at %d, want about %d", tc.speed, tc.pitch, tc.rate, m.ID, m.Pos, pos)
+			}
+		}
+	}
+}
+
+func TestMarkersState(t *testing.T) {
+	const sampleRate = 16000
+	w := seekSource(sampleRate, 2*sampleRate)
+
+	stream := NewSonicStream(sampleRate, 1)
+	stream.SetSpeed(1.3)
+	for i := 0; i < 8; i++ {
+		stream.AddMarker(Marker{Pos: i * sampleRate / 4, ID: i})
+	}
+	_ = stream.Write(w[:sampleRate/2+100])
+	_, _ = stream.ReadAll()
+	stream.ReadMarkers()
+
+	data, _ := stream.MarshalBinary()
+	restored := &Stream{}
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	clone := stream.Clone(true)
+	var markers [3][]Marker
+	for i, s := range []*Stream{stream, restored, clone} {
+		_, markers[i] = processMarkers(t, s, w[sampleRate/2+100:], 500)
+	}
+	if len(markers[0]) != 5 || !slices.Equal(markers[0], markers[1]) || !slices.Equal(markers[0], markers[2]) {
+		t.Errorf("markers %v, restored %v, cloned %v", markers[0], markers[1], markers[2])
+	}
+
+	// A marker in output dropped by Seek moves to the seam.
+	stream.Reset()
+	_ = stream.Write(w[:sampleRate/2])
+	out, _ := stream.ReadAll()
+	stream.AddMarker(Marker{Pos: sampleRate/2 - 10, ID: 1})
+	stream.AddMarker(Marker{Pos: sampleRate / 2, ID: 2})
+	_ = stream.Seek(w[:sampleRate])
+	_ = stream.Write(w[sampleRate:])
+	if got := stream.ReadMarkers(); len(got) != 2 || got[0].Pos != len(out) || got[1].Pos != len(out) {
+		t.Errorf("markers %v after seeking, want both at %d", got, len(out))
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonic
+
+import (
+	"math"
+	"runtime"
+	"sync"
+)
+
+const (
+	// parallelSegment is the nominal length of a segment processed on its own, in seconds.
+	parallelSegment = 10.0
+
+	// parallelSearch is how far, in seconds, a cut may move from its nominal position to reach
+	// a quieter spot.
+	parallelSearch = 0.5
+
+	// parallelEnergyWindow is the window, in seconds, over which the energy at a cut is measured.
+	parallelEnergyWindow = 0.01
+
+	// parallelOverlap is the input, in seconds, that neighbouring segments share on each side
+	// of a cut. Their outputs are crossfaded over it.
+	parallelOverlap = 0.02
+)
+
+// ParallelChangeSpeed is like ChangeSpeed, but splits long input at low-energy points into segments
+// of about ten seconds and processes them concurrently on up to GOMAXPROCS goroutines. Segments
+// share a little input around each cut and their outputs are aligned by cross-correlation and
+// crossfaded there, so the seams are not audible. The split does not depend on the number of
+// CPUs, so the output is deterministic. The input slice is left untouched; a new slice is
+// returned.
+func ParallelChangeSpeed(sampleRate, numChannels int, speed, pitch, rate, volume float64, samples []int16) ([]int16, error) {
+	if numChannels < 1 || len(samples)%numChannels != 0 {
+		return nil, ErrChannels
+	}
+	template := NewSonicStream(sampleRate, numChannels)
+	template.SetSpeed(speed)
+	template.SetPitch(pitch)
+	template.SetRate(rate)
+	template.SetVolume(volume)
+
+	cuts := splitPoints(samples, sampleRate, numChannels)
+	overlap := int(parallelOverlap * float64(sampleRate))
+
+	outs := make([][]int16, len(cuts)-1)
+	errs := make([]error, len(cuts)-1)
+	sem := make(chan struct{}, runtime.GOMAXPROCS(0))
+	var wg sync.WaitGroup
+	for i := range outs {
+		start := max(cuts[i]-overlap, 0) * numChannels
+		end := min(cuts[i+1]+overlap, len(samples)/numChannels) * numChannels
+		wg.Add(1)
+		go func(i int, stream *Stream) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			outs[i], errs[i] = stream.processAll(samples[start:end])
+		}(i, template.Clone(false))
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The shared input around a cut lasts 2*overlap samples before speed and rate are applied.
+	fade := int(math.Round(2 * float64(overlap) / (speed * rate)))
+	maxPeriod := sampleRate / MinPitch
+	out := outs[0]
+	for _, next := range outs[1:] {
+		out, next = alignSeam(out, next, min(fade, len(out)/numChannels, len(next)/numChannels), maxPeriod, numChannels)
+		out = crossfade(out, next, min(fade, len(out)/numChannels, len(next)/numChannels), numChannels)
+	}
+	return out, nil
+}
+
+// alignSeam shifts the seam between a and b by up to maxLag frames either way, so that the last
+// n frames of a and the first n frames of b line up best by their normalized cross-correlation.
+// The segments drop or insert pitch periods at different places, so their outputs are off by a
+// fraction of a period at the seam, and crossfading them unaligned cancels the signal there.
+// It trims the end of a or the start of b and returns both.
+func alignSeam(a, b []int16, n, maxLag, numChannels int) ([]int16, []int16) {
+	maxLag = min(maxLag, len(a)/numChannels-n, len(b)/numChannels-n)
+	if n == 0 || maxLag <= 0 {
+		return a, b
+	}
+	// frame returns the sum of the channels of frame i of s.
+	frame := func(s []int16, i int) float64 {
+		sum := 0
+		for c := 0; c < numChannels; c++ {
+			sum += int(s[i*numChannels+c])
+		}
+		return float64(sum)
+	}
+	tailAt := func(lag int) int { return len(a)/numChannels - n - max(-lag, 0) }
+
+	best, bestCorr := 0, math.Inf(-1)
+	for _, lag := range seamLags(maxLag) {
+		ta, tb := tailAt(lag), max(lag, 0)
+		var xy, xx, yy float64
+		for i := 0; i < n; i++ {
+			x, y := frame(a, ta+i), frame(b, tb+i)
+			xy += x * y
+			xx += x * x
+			yy += y * y
+		}
+		if xx == 0 || yy == 0 {
+			continue
+		}
+		if corr := xy / math.Sqrt(xx*yy); corr > bestCorr {
+			best, bestCorr = lag, corr
+		}
+	}
+	if best < 0 {
+		return a[:len(a)+best*numChannels], b
+	}
+	return a, b[best*numChannels:]
+}
+
+// seamLags returns the lags from -maxLag to maxLag ordered by their magnitude, so that ties
+// keep the seam closest to its place.
+func seamLags(maxLag int) []int {
+	lags := []int{0}
+	for l := 1; l <= maxLag; l++ {
+		lags = append(lags, l, -l)
+	}
+	return lags
+}
+
+// splitPoints returns the frame positions at which samples are cut into segments, including
+// the start and the end. Each inner cut is placed at the quietest spot near its nominal position.
+func splitPoints(samples []int16, sampleRate, numChannels int) []int {
+	frames := len(samples) / numChannels
+	segment := int(parallelSegment * float64(sampleRate))
+	search := int(parallelSearch * float64(sampleRate))
+	window := max(int(parallelEnergyWindow*float64(sampleRate)), 1)
+
+	cuts := []int{0}
+	for nominal := segment; frames-nominal > segment/2; nominal += segment {
+		best, bestEnergy := nominal, math.MaxFloat64
+		for pos := nominal - search; pos+window <= nominal+search; pos += window {
+			energy := 0.0
+			for _, v := range samples[pos*numChannels : (pos+window)*numChannels] {
+				energy += float64(v) * float64(v)
+			}
+			if energy < bestEnergy {
+				best, bestEnergy = pos+window/2, energy
+			}
+		}
+		cuts = append(cuts, best)
+	}
+	return append(cuts, frames)
+}
+
+// crossfade fades the last n frames of a into the first n frames of b and appends the rest of b.
+func crossfade(a, b []int16, n, numChannels int) []int16 {
+	tail := a[len(a)-n*numChannels:]
+	for i := 0; i < n; i++ {
+		w := (float64(i) + 0.5) / float64(n)
+		for c := 0; c < numChannels; c++ {
+			k := i*numChannels + c
+			tail[k] = int16(math.Round(float64(tail[k])*(1-w) + float64(b[k])*w))
+		}
+	}
+	return append(a, b[n*numChannels:]...)
+}
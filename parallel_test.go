@@ -0,0 +1,142 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonic
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestClone(t *testing.T) {
+	stream := NewSonicStream(16000, 2)
+	stream.SetSpeed(1.4)
+	stream.SetPitch(0.9)
+	stream.SetVolumeDB(-3)
+	stream.SetClipMode(ClipTanh)
+	stream.SetNormalization(-20, DefaultTruePeak)
+
+	in := sine(16000, 2*16000, 300, 0.3)
+	if err := stream.Write(in[:len(in)/2]); err != nil {
+		t.Fatal(err)
+	}
+
+	fresh := stream.Clone(false)
+	if fresh.GetSpeed() != 1.4 || fresh.GetPitch() != 0.9 || fresh.GetClipMode() != ClipTanh || !fresh.volumeDB || fresh.loudness == nil {
+		t.Error("clone lost the configuration")
+	}
+	if fresh.NumInputSamples() != 0 || fresh.NumOutputSamples() != 0 {
+		t.Error("clone without state has buffered samples")
+	}
+
+	clone := stream.Clone(true)
+	got, err := clone.processAll(in[len(in)/2:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := stream.processAll(in[len(in)/2:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Error("clone with state produced different output")
+	}
+}
+
+func TestParallelChangeSpeed(t *testing.T) {
+	w, sampleRate, channels, err := readWAV("./testdata/OSR_us_000_0010_8k.wav")
+	if err != nil {
+		t.Fatalf("reading error: %v", err)
+	}
+	if cuts := splitPoints(w, sampleRate, channels); len(cuts) < 4 {
+		t.Fatalf("expected at least 3 segments, got cuts %v", cuts)
+	}
+
+	got, err := ParallelChangeSpeed(sampleRate, channels, 1.5, 1, 1.1, 1, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := changeSpeedOnce(sampleRate, channels, 1.5, 1, 1.1, 1, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := math.Abs(float64(len(got)-len(want))) / float64(len(want)); diff > 0.005 {
+		t.Errorf("got %d samples, want about %d", len(got), len(want))
+	}
+
+	again, _ := ParallelChangeSpeed(sampleRate, channels, 1.5, 1, 1.1, 1, w)
+	if !reflect.DeepEqual(got, again) {
+		t.Error("output is not deterministic")
+	}
+}
+
+func TestSplitPointsFindsSilence(t *testing.T) {
+	const sampleRate = 8000
+	in := sine(sampleRate, 26*sampleRate, 200, 0.5)
+	gap := 10*sampleRate + 2000
+	clear(in[gap : gap+400])
+
+	cuts := splitPoints(in, sampleRate, 1)
+	if len(cuts) != 4 || cuts[0] != 0 || cuts[3] != len(in) {
+		t.Fatalf("unexpected cuts %v", cuts)
+	}
+	if cuts[1] < gap || cuts[1] >= gap+400 {
+		t.Errorf("cut at %d, want within the silence at %d", cuts[1], gap)
+	}
+}
+
+// seamStats returns the largest step between neighbouring samples and the lowest RMS over
+// windows of the given length, leaving out the first and last window.
+func seamStats(s []int16, window int) (maxStep int, minRMS float64) {
+	for i := window + 1; i < len(s)-window; i++ {
+		maxStep = max(maxStep, abs(int(s[i])-int(s[i-1])))
+	}
+	minRMS = math.Inf(1)
+	for start := window; start+2*window <= len(s); start += window {
+		sum := 0.0
+		for _, v := range s[start : start+window] {
+			sum += float64(v) * float64(v)
+		}
+		minRMS = min(minRMS, math.Sqrt(sum/float64(window)))
+	}
+	return maxStep, minRMS
+}
+
+func TestParallelSeams(t *testing.T) {
+	// A steady tone whose period is not a whole number of samples: a seam that is not aligned
+	// to it shows up as a step or as a dip of the level where the crossfaded periods cancel.
+	const sampleRate = 8000
+	in := sine(sampleRate, 35*sampleRate, 173, 0.5)
+	if cuts := splitPoints(in, sampleRate, 1); len(cuts) < 4 {
+		t.Fatalf("expected at least 3 segments, got cuts %v", cuts)
+	}
+
+	for _, speed := range []float64{0.7, 1.5, 2.5} {
+		got, err := ParallelChangeSpeed(sampleRate, 1, speed, 1, 1, 1, in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := changeSpeedOnce(sampleRate, 1, speed, 1, 1, 1, in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		window := sampleRate / 100
+		gotStep, gotRMS := seamStats(got, window)
+		wantStep, wantRMS := seamStats(want, window)
+		if float64(gotStep) > 1.1*float64(wantStep) || gotRMS < 0.95*wantRMS {
+			t.Errorf("speed %v: largest step %d, lowest level %.0f; single stream %d, %.0f", speed, gotStep, gotRMS, wantStep, wantRMS)
+		}
+	}
+}
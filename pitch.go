@@ -0,0 +1,184 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonic
+
+import (
+	"math"
+
+	"github.com/alttagil/sonic-go/internal/simd"
+)
+
+// PitchEstimator finds the pitch period of mono audio.
+//
+// EstimatePeriod returns the period in [minPeriod, maxPeriod] at which samples repeat best.
+// samples holds at least 2*maxPeriod samples. minDiff is the mismatch at that period and maxDiff
+// the worst mismatch in the range, on a scale where 0 is a perfect match; the stream compares
+// them with each other and with earlier results of the same estimator to detect unvoiced input.
+//
+// At sample rates above 4 kHz the stream runs the estimator on down-sampled input and refines the
+// period with AMDF at the full rate.
+type PitchEstimator interface {
+	EstimatePeriod(samples []int16, minPeriod, maxPeriod int) (period, minDiff, maxDiff int)
+}
+
+// AMDFEstimator is the average magnitude difference function search of the original Sonic. It is
+// the default and the fastest estimator.
+type AMDFEstimator struct{}
+
+// EstimatePeriod implements PitchEstimator.
+func (AMDFEstimator) EstimatePeriod(samples []int16, minPeriod, maxPeriod int) (int, int, int) {
+	if simd.Accelerated() {
+		return findPitchPeriodAMDF(samples, minPeriod, maxPeriod)
+	}
+	return findPitchPeriodC(samples, minPeriod, maxPeriod)
+}
+
+// estimatorScale is the value of a mismatch of 1.0 reported by YINEstimator and NACFEstimator.
+const estimatorScale = 1000
+
+// DefaultYINThreshold is the YINEstimator threshold used when Threshold is zero. It is above the
+// 0.1 to 0.15 of the paper so that the dip of the period still counts in telephone audio with a
+// signal to noise ratio of 10 dB.
+const DefaultYINThreshold = 0.25
+
+// YINEstimator implements the YIN estimator of de Cheveigné and Kawahara. It takes the first dip
+// of the cumulative mean normalized difference function below Threshold instead of the global
+// minimum, which avoids picking multiples of the period. minDiff is the normalized difference
+// times 1000.
+type YINEstimator struct {
+	// Threshold is the normalized difference below which a dip is accepted as the period.
+	Threshold float64
+}
+
+// EstimatePeriod implements PitchEstimator.
+func (e YINEstimator) EstimatePeriod(samples []int16, minPeriod, maxPeriod int) (int, int, int) {
+	threshold := e.Threshold
+	if threshold == 0 {
+		threshold = DefaultYINThreshold
+	}
+	window := samples[:maxPeriod]
+	samples = samples[:2*maxPeriod]
+
+	bestPeriod, best := 0, math.Inf(1)
+	dipPeriod, dip := 0, 0.0
+	armed, done := true, false
+	maxNorm := 0.0
+	var sum int64
+	for tau := 1; tau <= maxPeriod; tau++ {
+		var d int64
+		for j, v := range window {
+			x := int64(v) - int64(samples[j+tau])
+			d += x * x
+		}
+		sum += d
+		if tau < minPeriod {
+			continue
+		}
+
+		norm := 0.0
+		if d != 0 {
+			norm = float64(d) * float64(tau) / float64(sum)
+		}
+		maxNorm = max(maxNorm, norm)
+		if norm < best {
+			bestPeriod, best = tau, norm
+		}
+		// Follow the first dip below the threshold down to its bottom. A dip that bottoms out on
+		// minPeriod belongs to a shorter period outside the range and is skipped.
+		switch {
+		case dipPeriod != 0 && !done:
+			if norm < dip {
+				dipPeriod, dip = tau, norm
+			} else if dipPeriod == minPeriod {
+				dipPeriod, armed = 0, false
+			} else {
+				done = true
+			}
+		case dipPeriod == 0:
+			if norm >= threshold {
+				armed = true
+			} else if armed {
+				dipPeriod, dip = tau, norm
+			}
+		}
+	}
+	if dipPeriod != 0 {
+		bestPeriod, best = dipPeriod, dip
+	}
+	return bestPeriod, int(best * estimatorScale), int(maxNorm * estimatorScale)
+}
+
+// nacfOctaveMargin is how much better the correlation at a longer period has to be than the best
+// correlation at shorter periods for NACFEstimator to prefer it.
+const nacfOctaveMargin = 0.1
+
+// NACFEstimator finds the period with the highest normalized autocorrelation. A peak at a longer
+// period only wins if its correlation is higher by a margin, so that noise does not tip the
+// choice towards a multiple of the period. minDiff is one minus the correlation, times 1000.
+type NACFEstimator struct{}
+
+// EstimatePeriod implements PitchEstimator.
+func (NACFEstimator) EstimatePeriod(samples []int16, minPeriod, maxPeriod int) (int, int, int) {
+	window := samples[:maxPeriod]
+	samples = samples[:2*maxPeriod]
+
+	var energy int64
+	for _, v := range window {
+		energy += int64(v) * int64(v)
+	}
+	var lagEnergy int64
+	for _, v := range samples[minPeriod : minPeriod+maxPeriod] {
+		lagEnergy += int64(v) * int64(v)
+	}
+
+	bestPeriod, best, worst := 0, -2.0, 2.0
+	for tau := minPeriod; tau <= maxPeriod; tau++ {
+		if tau > minPeriod {
+			in, out := int64(samples[tau+maxPeriod-1]), int64(samples[tau-1])
+			lagEnergy += in*in - out*out
+		}
+		var r int64
+		for j, v := range window {
+			r += int64(v) * int64(samples[j+tau])
+		}
+
+		c := 1.0
+		if energy != 0 && lagEnergy != 0 {
+			c = float64(r) / math.Sqrt(float64(energy)*float64(lagEnergy))
+		}
+		worst = min(worst, c)
+		// Climbing towards the current best peak continues it, a new peak has to beat it clearly.
+		// A best on minPeriod that is not a peak, but the tail of one below the range, is not.
+		climbing := bestPeriod == tau-1 || bestPeriod == minPeriod
+		if bestPeriod == 0 || (climbing && c > best) || c > best+nacfOctaveMargin {
+			bestPeriod, best = tau, c
+		}
+	}
+	return bestPeriod, int((1 - best) * estimatorScale), int((1 - worst) * estimatorScale)
+}
+
+// GetPitchEstimator returns the pitch period estimator of the stream.
+func (stream *Stream) GetPitchEstimator() PitchEstimator {
+	return stream.estimator
+}
+
+// SetPitchEstimator sets the pitch period estimator of the stream. nil restores the default
+// AMDFEstimator. Pitch tracking only applies to the AMDFEstimator.
+func (stream *Stream) SetPitchEstimator(e PitchEstimator) {
+	if e == nil {
+		e = AMDFEstimator{}
+	}
+	stream.estimator = e
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonic
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// harmonic returns n samples of a tone with fundamental f0 and harmonics of amplitude 1/k from
+// minHarmonic up to the Nyquist frequency, or up to maxFreq if it is not zero, with white noise
+// at the given signal to noise ratio in dB (none if snr is zero).
+func harmonic(sampleRate int, f0 float64, minHarmonic int, maxFreq, snr float64, n int) []int16 {
+	rng := rand.New(rand.NewSource(int64(f0)))
+	if maxFreq == 0 {
+		maxFreq = float64(sampleRate) / 2
+	}
+	x := make([]float64, n)
+	for k := minHarmonic; float64(k)*f0 < maxFreq; k++ {
+		phase := rng.Float64() * 2 * math.Pi
+		w := 2 * math.Pi * float64(k) * f0 / float64(sampleRate)
+		for i := range x {
+			x[i] += math.Sin(w*float64(i)+phase) / float64(k)
+		}
+	}
+	power := 0.0
+	for _, v := range x {
+		power += v * v
+	}
+	rms := math.Sqrt(power / float64(n))
+	noise := 0.0
+	if snr != 0 {
+		noise = rms * math.Pow(10, -snr/20)
+	}
+	samples := make([]int16, n)
+	for i, v := range x {
+		samples[i] = int16(6000 * (v + noise*rng.NormFloat64()) / rms)
+	}
+	return samples
+}
+
+var pitchSignals = []struct {
+	name        string
+	minHarmonic int
+	maxFreq     float64
+	snr         float64
+}{
+	{"clean", 1, 0, 0},
+	{"noisy", 1, 0, 10},
+	// Telephone band audio misses the fundamental of most voices.
+	{"telephone", 3, 3400, 0},
+	{"noisy telephone", 3, 3400, 10},
+}
+
+var pitchEstimators = []struct {
+	name      string
+	estimator PitchEstimator
+}{
+	{"amdf", AMDFEstimator{}},
+	{"yin", YINEstimator{}},
+	{"nacf", NACFEstimator{}},
+}
+
+// maxPitchMisses is how many of the synthetic signals YIN and NACF may get wrong. At 8 kHz the
+// periods of high voices are a fraction of a sample off an integer, and an integer multiple of the
+// period can match better than the period itself.
+const maxPitchMisses = 3
+
+func TestPitchEstimators(t *testing.T) {
+	for _, e := range pitchEstimators {
+		var misses []string
+		for _, sig := range pitchSignals {
+			for _, sampleRate := range []int{8000, 16000} {
+				minP, maxP := sampleRate/MaxPitch, sampleRate/MinPitch
+				for _, f0 := range []float64{80, 95, 110, 130, 150, 175, 200, 230, 260, 300, 340} {
+					samples := harmonic(sampleRate, f0, sig.minHarmonic, sig.maxFreq, sig.snr, 2*maxP)
+					want := float64(sampleRate) / f0
+					period, minDiff, maxDiff := e.estimator.EstimatePeriod(samples, minP, maxP)
+					if period < minP || period > maxP || minDiff < 0 || minDiff > maxDiff {
+						t.Errorf("%s: %s %v Hz at %d: period %d, diff %d..%d", e.name, sig.name, f0, sampleRate, period, minDiff, maxDiff)
+					}
+					if math.Abs(float64(period)-want) > max(1, want*0.02) {
+						misses = append(misses, fmt.Sprintf("%s %v Hz at %d: %d, want %.1f", sig.name, f0, sampleRate, period, want))
+					}
+				}
+			}
+		}
+		if _, ok := e.estimator.(AMDFEstimator); ok {
+			// AMDF is kept for speed and compatibility and makes octave errors on these signals.
+			t.Logf("%s: %d misses", e.name, len(misses))
+		} else if len(misses) > maxPitchMisses {
+			t.Errorf("%s: %d misses, want at most %d: %v", e.name, len(misses), maxPitchMisses, misses)
+		}
+	}
+}
+
+func TestPitchEstimatorStream(t *testing.T) {
+	w, sampleRate, channels, err := readWAV("./testdata/OSR_us_000_0010_8k.wav")
+	if err != nil {
+		t.Fatalf("reading error: %v", err)
+	}
+	for _, e := range pitchEstimators {
+		t.Run(e.name, func(t *testing.T) {
+			stream := NewSonicStream(sampleRate, channels)
+			stream.SetPitchEstimator(e.estimator)
+			stream.SetSpeed(2)
+			half := len(w) / 2
+			if err := stream.Write(w[:half]); err != nil {
+				t.Fatal(err)
+			}
+			out, _ := stream.ReadAll()
+
+			// The snapshot does not hold the estimator, the receiving stream has to bring it.
+			data, _ := stream.MarshalBinary()
+			restored := &Stream{}
+			restored.SetPitchEstimator(e.estimator)
+			if err := restored.UnmarshalBinary(data); err != nil {
+				t.Fatal(err)
+			}
+			clone := stream.Clone(true)
+
+			var rest [3][]int16
+			for i, s := range []*Stream{stream, restored, clone} {
+				if s.GetPitchEstimator() != e.estimator {
+					t.Fatalf("stream %d has estimator %T", i, s.GetPitchEstimator())
+				}
+				if err := s.Write(w[half:]); err != nil {
+					t.Fatal(err)
+				}
+				if err := s.Flush(); err != nil {
+					t.Fatal(err)
+				}
+				rest[i], _ = s.ReadAll()
+			}
+			if !slices.Equal(rest[0], rest[1]) || !slices.Equal(rest[0], rest[2]) {
+				t.Error("restored or cloned stream output differs")
+			}
+
+			n := len(out) + len(rest[0])
+			if want := len(w) / 2; n < want*95/100 || n > want*105/100 {
+				t.Errorf("%d output samples, want about %d", n, want)
+			}
+		})
+	}
+}
+
+func BenchmarkPitchEstimators(b *testing.B) {
+	minP, maxP := 8000/MaxPitch, 8000/MinPitch
+	samples := harmonic(8000, 130, 3, 3400, 10, 2*maxP)
+	for _, e := range pitchEstimators {
+		b.Run(e.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				e.estimator.EstimatePeriod(samples, minP, maxP)
+			}
+		})
+	}
+}
@@ -0,0 +1,251 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonic
+
+import (
+	"errors"
+	"io"
+	"math"
+)
+
+// ErrPosition is returned by Player for a position or loop region outside its source.
+var ErrPosition = errors.New("position out of range")
+
+// playerBlocks is the number of blocks per second the player feeds its stream with.
+const playerBlocks = 100
+
+// Player plays an in-memory source through a Stream with random access: it can seek, play
+// backwards at negative speeds and repeat a loop region. It suits scrubbing in an editor, where
+// the speed follows the mouse and the pitch stays the same.
+type Player struct {
+	stream *Stream
+	source []int16
+	ch     int
+	frames int
+
+	speed   float64
+	reverse bool
+	// scale is the number of source frames per output frame at the last write.
+	scale float64
+	// pos is the boundary of the next source frame to play: frame pos forwards, frame pos-1
+	// backwards.
+	pos int
+	// done is set when the source ran out and the stream was flushed.
+	done bool
+
+	loop                     bool
+	loopStart, loopEnd, fade int
+
+	block, preroll, silence []int16
+}
+
+// NewPlayer creates a player of the interleaved source through stream, which must have the
+// format of the source. The player sets the speed of the stream; its other parameters and stages
+// can be set up as usual. The stream must not be written to directly.
+func NewPlayer(stream *Stream, source []int16) (*Player, error) {
+	if len(source)%stream.numChannels != 0 {
+		return nil, ErrChannels
+	}
+	return &Player{
+		stream:  stream,
+		source:  source,
+		ch:      stream.numChannels,
+		frames:  len(source) / stream.numChannels,
+		speed:   stream.speed,
+		scale:   stream.speed * stream.rate,
+		block:   make([]int16, max(stream.sampleRate/playerBlocks, 1)*stream.numChannels),
+		preroll: make([]int16, stream.SeekPreroll()*stream.numChannels),
+	}, nil
+}
+
+// Stream returns the stream of the player.
+func (p *Player) Stream() *Stream {
+	return p.stream
+}
+
+// Len returns the length of the source in frames.
+func (p *Player) Len() int {
+	return p.frames
+}
+
+// GetSpeed returns the playback speed.
+func (p *Player) GetSpeed() float64 {
+	return p.speed
+}
+
+// SetSpeed sets the playback speed. Negative speeds play backwards and zero pauses. Changing
+// the direction restarts the stream at the current position.
+func (p *Player) SetSpeed(speed float64) {
+	p.speed = speed
+	if speed == 0 {
+		return
+	}
+	p.stream.SetSpeed(math.Abs(speed))
+	if reverse := speed < 0; reverse != p.reverse {
+		pos := p.Position()
+		p.reverse = reverse
+		_ = p.Seek(pos)
+	}
+}
+
+// GetLoop returns the loop region and its crossfade in frames, and whether looping is on.
+func (p *Player) GetLoop() (start, end, fade int, ok bool) {
+	return p.loopStart, p.loopEnd, p.fade, p.loop
+}
+
+// SetLoop repeats the frames from start up to end. Playing forwards, the last fade frames of the
+// region are crossfaded into the frames before start; playing backwards, the first fade frames
+// into the frames from end on. The crossfade is shortened where the source is too short for it.
+func (p *Player) SetLoop(start, end, fade int) error {
+	if start < 0 || end > p.frames || start >= end || fade < 0 {
+		return ErrPosition
+	}
+	p.loop, p.loopStart, p.loopEnd, p.fade = true, start, end, fade
+	return nil
+}
+
+// ClearLoop stops looping.
+func (p *Player) ClearLoop() {
+	p.loop = false
+}
+
+// Position returns the source frame the next output frame comes from, estimated from the
+// samples held by the stream. The estimate can be off by about a pitch period.
+func (p *Player) Position() int {
+	held := float64(p.stream.NumInputSamples()) + float64(p.stream.NumOutputSamples()-p.stream.seekSkip)*p.scale
+	pos := p.pos - int(math.Round(held))
+	if p.reverse {
+		pos = p.pos + int(math.Round(held))
+	}
+	if p.loop {
+		n := p.loopEnd - p.loopStart
+		if !p.reverse && pos < p.loopStart && p.pos >= p.loopStart && p.pos <= p.loopEnd {
+			pos += n
+		} else if p.reverse && pos > p.loopEnd && p.pos >= p.loopStart && p.pos <= p.loopEnd {
+			pos -= n
+		}
+	}
+	return min(max(pos, 0), p.frames)
+}
+
+// Seek restarts playback at frame pos with Stream.Seek, pre-rolled with the frames before pos in
+// the direction of play and crossfaded from the output before the seek.
+func (p *Player) Seek(pos int) error {
+	if pos < 0 || pos > p.frames {
+		return ErrPosition
+	}
+	p.done = false
+
+	n := p.stream.SeekPreroll()
+	if p.reverse {
+		p.pos = min(pos+n, p.frames)
+		n = p.pos - pos
+	} else {
+		p.pos = max(pos-n, 0)
+		n = pos - p.pos
+	}
+	p.scale = p.stream.speed * p.stream.rate
+	n = p.fill(p.preroll, n, false)
+	return p.stream.Seek(p.preroll[:n*p.ch])
+}
+
+// Read plays up to n frames and returns them. It returns fewer only at the end of the source,
+// and io.EOF once everything was played. While the player is paused it returns silence.
+// The slice shares memory with the player and is only valid until the next call.
+func (p *Player) Read(n int) ([]int16, error) {
+	if p.speed == 0 {
+		if len(p.silence) < n*p.ch {
+			p.silence = make([]int16, n*p.ch)
+		}
+		return p.silence[:n*p.ch], nil
+	}
+
+	for p.stream.NumOutputSamples() < n && !p.done {
+		p.scale = p.stream.speed * p.stream.rate
+		if k := p.fill(p.block, len(p.block)/p.ch, true); k > 0 {
+			if err := p.stream.Write(p.block[:k*p.ch]); err != nil {
+				return nil, err
+			}
+		} else {
+			if err := p.stream.Flush(); err != nil {
+				return nil, err
+			}
+			p.done = true
+		}
+	}
+	if p.stream.NumOutputSamples() == 0 {
+		return nil, io.EOF
+	}
+	return p.stream.Read(n)
+}
+
+// fill copies up to n frames from the source into buf in the direction of play and returns how
+// many it copied. With wrap set, playback jumps over the seam of the loop region.
+func (p *Player) fill(buf []int16, n int, wrap bool) int {
+	for k := 0; k < n; k++ {
+		dst := buf[k*p.ch : (k+1)*p.ch]
+		if p.reverse {
+			if wrap && p.loop && p.pos == p.loopStart {
+				p.pos = p.loopEnd
+			}
+			if p.pos == 0 {
+				return k
+			}
+			p.pos--
+		} else {
+			if wrap && p.loop && p.pos == p.loopEnd {
+				p.pos = p.loopStart
+			}
+			if p.pos == p.frames {
+				return k
+			}
+		}
+		p.frame(dst, p.pos)
+		if !p.reverse {
+			p.pos++
+		}
+	}
+	return n
+}
+
+// frame copies source frame i to dst, crossfaded with the frame it is played instead of where
+// it lies before the seam of the loop region.
+func (p *Player) frame(dst []int16, i int) {
+	copy(dst, p.source[i*p.ch:])
+	if !p.loop {
+		return
+	}
+
+	n := p.loopEnd - p.loopStart
+	var x float64
+	var other int
+	if p.reverse {
+		fade := min(p.fade, p.frames-p.loopEnd, n)
+		if i < p.loopStart || i >= p.loopStart+fade {
+			return
+		}
+		x, other = (float64(p.loopStart+fade-i)-0.5)/float64(fade), i+n
+	} else {
+		fade := min(p.fade, p.loopStart, n)
+		if i < p.loopEnd-fade || i >= p.loopEnd {
+			return
+		}
+		x, other = (float64(i-p.loopEnd+fade)+0.5)/float64(fade), i-n
+	}
+	for c := range dst {
+		v := (1-x)*float64(dst[c]) + x*float64(p.source[other*p.ch+c])
+		dst[c] = clampInt16(math.Round(v))
+	}
+}
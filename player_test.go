@@ -0,0 +1,207 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonic
+
+import (
+	"io"
+	"math"
+	"slices"
+	"testing"
+)
+
+// playAll reads from the player in blocks of n frames until the end.
+func playAll(t *testing.T, p *Player, n int) []int16 {
+	t.Helper()
+	var out []int16
+	for {
+		got, err := p.Read(n)
+		if err == io.EOF {
+			return out
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, got...)
+	}
+}
+
+// maxStep returns the largest difference between neighbouring samples.
+func maxStep(samples []int16) int {
+	step := 0
+	for i := 1; i < len(samples); i++ {
+		step = max(step, abs(int(samples[i])-int(samples[i-1])))
+	}
+	return step
+}
+
+func TestPlayerDirections(t *testing.T) {
+	w, sampleRate, _, err := readWAV("./testdata/OSR_us_000_0010_8k.wav")
+	if err != nil {
+		t.Fatalf("reading error: %v", err)
+	}
+	w = w[:len(w)/8]
+
+	// At speeds 1 and -1 the stream passes the source through, forwards or reversed.
+	p, err := NewPlayer(NewSonicStream(sampleRate, 1), w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := processChunks(t, NewSonicStream(sampleRate, 1), w, 300)
+	if got := playAll(t, p, 300); !slices.Equal(got, want) {
+		t.Errorf("forward playback differs: %d vs %d samples", len(got), len(want))
+	}
+
+	p.SetSpeed(-1)
+	if err := p.Seek(len(w)); err != nil {
+		t.Fatal(err)
+	}
+	reversed := slices.Clone(w)
+	slices.Reverse(reversed)
+	want = processChunks(t, NewSonicStream(sampleRate, 1), reversed, 300)
+	if got := playAll(t, p, 300); !slices.Equal(got, want) {
+		t.Errorf("reverse playback differs: %d vs %d samples", len(got), len(want))
+	}
+
+	// A seek pre-rolls the stream, so that the output continues exactly where a stream that
+	// played from the start would be.
+	p.SetSpeed(1)
+	mid := len(w) / 2
+	if err := p.Seek(mid); err != nil {
+		t.Fatal(err)
+	}
+	if pos := p.Position(); pos != mid {
+		t.Errorf("position %d after seeking to %d", pos, mid)
+	}
+	want = processChunks(t, NewSonicStream(sampleRate, 1), w[mid:], 300)
+	if got := playAll(t, p, 300); !slices.Equal(got, want) {
+		t.Errorf("playback after a seek differs: %d vs %d samples", len(got), len(want))
+	}
+	if err := p.Seek(len(w) + 1); err != ErrPosition {
+		t.Errorf("seek past the end: %v", err)
+	}
+}
+
+func TestPlayerScrub(t *testing.T) {
+	w, sampleRate, _, err := readWAV("./testdata/OSR_us_000_0010_8k.wav")
+	if err != nil {
+		t.Fatalf("reading error: %v", err)
+	}
+	w = w[:len(w)/4]
+	maxPeriod := sampleRate / MinPitch
+
+	p, _ := NewPlayer(NewSonicStream(sampleRate, 1), w)
+	p.SetSpeed(1.5)
+	mid := len(w) / 2
+	if err := p.Seek(mid); err != nil {
+		t.Fatal(err)
+	}
+	// The first output is the source at the seek position, give or take the period found there.
+	first, _ := p.Read(maxPeriod)
+	first = slices.Clone(first)
+	best, bestDiff := 0, math.Inf(1)
+	for lag := -maxPeriod; lag <= maxPeriod; lag++ {
+		diff := 0.0
+		for i, v := range first {
+			diff += math.Abs(float64(v) - float64(w[mid+lag+i]))
+		}
+		if diff < bestDiff {
+			best, bestDiff = lag, diff
+		}
+	}
+	if abs(best) > maxPeriod {
+		t.Errorf("output starts %d frames off the seek position", best)
+	}
+
+	// Dragging back plays backwards from about where playback was.
+	before := p.Position()
+	p.SetSpeed(-0.7)
+	if pos := p.Position(); abs(pos-before) > maxPeriod {
+		t.Errorf("position %d after reversing at %d", pos, before)
+	}
+	got, _ := p.Read(sampleRate / 10)
+	if len(got) != sampleRate/10 {
+		t.Errorf("%d frames after reversing", len(got))
+	}
+	if pos := p.Position(); pos >= before {
+		t.Errorf("position %d did not move back from %d", pos, before)
+	}
+
+	// Pausing outputs silence and keeps the position.
+	pos := p.Position()
+	p.SetSpeed(0)
+	if got, _ := p.Read(100); len(got) != 100 || slices.ContainsFunc(got, func(v int16) bool { return v != 0 }) {
+		t.Error("paused player is not silent")
+	}
+	p.SetSpeed(-2)
+	if p.Position() != pos {
+		t.Errorf("position %d after pausing at %d", p.Position(), pos)
+	}
+	rest := playAll(t, p, 500)
+	if want := float64(pos) / 2; math.Abs(float64(len(rest))-want) > float64(maxPeriod) {
+		t.Errorf("%d frames played back to the start, want about %.0f", len(rest), want)
+	}
+}
+
+func TestPlayerLoop(t *testing.T) {
+	const sampleRate, f0 = 16000, 187.0
+	w := harmonic(sampleRate, f0, 1, 1000, 0, sampleRate)
+	start, end, fade := 4000, 4000+1234, 200
+
+	for _, speed := range []float64{1, -1} {
+		p, _ := NewPlayer(NewSonicStream(sampleRate, 1), w)
+		p.SetSpeed(speed)
+		if err := p.SetLoop(start, end, fade); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Seek(start + 10); err != nil {
+			t.Fatal(err)
+		}
+		n := 4 * (end - start)
+		got, err := p.Read(n)
+		if err != nil || len(got) != n {
+			t.Fatalf("speed %v: %d frames, %v", speed, len(got), err)
+		}
+		// The loop repeats every loop length and its seam is as smooth as the source.
+		for i := end - start; i < n; i++ {
+			if got[i] != got[i-(end-start)] {
+				t.Fatalf("speed %v: frame %d does not repeat", speed, i)
+			}
+		}
+		if step, want := maxStep(got), maxStep(w); step > want*11/10 {
+			t.Errorf("speed %v: largest step %d, source %d", speed, step, want)
+		}
+
+		p.SetLoop(start, end, 0)
+		if err := p.Seek(start + 10); err != nil {
+			t.Fatal(err)
+		}
+		got, _ = p.Read(n)
+		if step, want := maxStep(got), maxStep(w); step < want*2 {
+			t.Errorf("speed %v: seam without a crossfade is smooth, %d vs %d", speed, step, want)
+		}
+	}
+
+	p, _ := NewPlayer(NewSonicStream(sampleRate, 1), w)
+	if err := p.SetLoop(100, 50, 0); err != ErrPosition {
+		t.Errorf("empty loop: %v", err)
+	}
+	p.ClearLoop()
+	if _, _, _, ok := p.GetLoop(); ok {
+		t.Error("loop still set")
+	}
+	if _, err := NewPlayer(NewSonicStream(sampleRate, 2), w[:3]); err != ErrChannels {
+		t.Errorf("odd stereo source: %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonic
+
+import (
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// DefaultPoolBudget is the default number of samples a pooled stream may hold in its buffers.
+// It is about ten seconds of 48kHz stereo audio.
+const DefaultPoolBudget = 1 << 20
+
+// poolKey identifies streams that can replace each other.
+type poolKey struct {
+	sampleRate  int
+	numChannels int
+	backend     Backend
+}
+
+// StreamPool hands out reset streams and takes them back when a session ends, so that servers
+// running many short sessions reuse the stream buffers instead of allocating them each time.
+// Streams are pooled per sample rate, number of channels and storage backend on top of
+// sync.Pool, so idle streams are released by the garbage collector. A StreamPool is safe for
+// concurrent use.
+type StreamPool struct {
+	budget int
+	pools  sync.Map // poolKey -> *sync.Pool
+
+	created  atomic.Int64
+	reused   atomic.Int64
+	released atomic.Int64
+}
+
+// PoolStats reports how streams were obtained from and returned to a StreamPool.
+type PoolStats struct {
+	// Created is the number of streams allocated because none could be reused.
+	Created int64
+	// Reused is the number of streams handed out again after Put.
+	Reused int64
+	// Released is the number of streams Put refused because their buffers grew over the budget.
+	Released int64
+}
+
+// NewStreamPool creates a pool. budget is the total capacity, in samples, that the buffers of a
+// returned stream may have; streams that grew beyond it are left to the garbage collector instead
+// of being kept around. A budget of 0 means DefaultPoolBudget.
+func NewStreamPool(budget int) *StreamPool {
+	if budget <= 0 {
+		budget = DefaultPoolBudget
+	}
+	return &StreamPool{budget: budget}
+}
+
+// Get returns a stream for the given format in the state of a new stream from NewSonicStream:
+// empty, with default parameters and no observer.
+func (p *StreamPool) Get(sampleRate, numChannels int) *Stream {
+	return p.GetWithBackend(sampleRate, numChannels, SliceBackend)
+}
+
+// GetWithBackend is like Get for a stream whose sample buffers use the given storage backend, as
+// from NewSonicStreamWithBackend.
+func (p *StreamPool) GetWithBackend(sampleRate, numChannels int, backend Backend) *Stream {
+	if stream, ok := p.pool(sampleRate, numChannels, backend).Get().(*Stream); ok {
+		p.reused.Add(1)
+		return stream
+	}
+	p.created.Add(1)
+	return NewSonicStreamWithBackend(sampleRate, numChannels, backend)
+}
+
+// Put resets a stream and returns it to the pool. The stream must not be used afterwards.
+func (p *StreamPool) Put(stream *Stream) {
+	if stream == nil {
+		return
+	}
+	stream.resetDefaults()
+	if stream.capacity() > p.budget {
+		p.released.Add(1)
+		return
+	}
+	p.pool(stream.sampleRate, stream.numChannels, stream.backend).Put(stream)
+}
+
+// Stats returns the pool counters.
+func (p *StreamPool) Stats() PoolStats {
+	return PoolStats{
+		Created:  p.created.Load(),
+		Reused:   p.reused.Load(),
+		Released: p.released.Load(),
+	}
+}
+
+// pool returns the sync.Pool for a format and backend, creating it on first use.
+func (p *StreamPool) pool(sampleRate, numChannels int, backend Backend) *sync.Pool {
+	key := poolKey{sampleRate, numChannels, backend}
+	if pool, ok := p.pools.Load(key); ok {
+		return pool.(*sync.Pool)
+	}
+	pool, _ := p.pools.LoadOrStore(key, &sync.Pool{})
+	return pool.(*sync.Pool)
+}
+
+// capacity returns the number of samples the buffers and scratch slices of the stream can hold
+// without growing, counting other slices by the number of samples their memory would hold.
+// After resetDefaults they are all the stream keeps.
+func (stream *Stream) capacity() int {
+	n := cap(stream.conv) + cap(stream.seekTail) + cap(stream.seekHistory)
+	n += cap(stream.ptsJumps) * int(unsafe.Sizeof(ptsJump{})) / 2
+	n += (cap(stream.markersIn) + cap(stream.markersOut)) * int(unsafe.Sizeof(Marker{})) / 2
+	for _, b := range stream.buffers() {
+		n += b.Cap()
+	}
+	return n
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonic
+
+import (
+	"testing"
+)
+
+func TestStreamPool(t *testing.T) {
+	pool := NewStreamPool(0)
+
+	stream := pool.Get(16000, 2)
+	stream.SetSpeed(2)
+	stream.SetVolume(0.5)
+	stream.SetClipMode(ClipCubic)
+	stream.SetNormalization(-16, DefaultTruePeak)
+	stream.SetObserver(ObserverFunc(func(PeriodEvent) {}))
+	if err := stream.Write(sine(16000, 3200, 200, 0.5)); err != nil {
+		t.Fatal(err)
+	}
+	pool.Put(stream)
+
+	// sync.Pool may or may not hand the same stream back; either way it must look new.
+	stream = pool.Get(16000, 2)
+	if stream.GetSampleRate() != 16000 || stream.GetNumChannels() != 2 {
+		t.Fatalf("got a %d Hz %d channel stream", stream.GetSampleRate(), stream.GetNumChannels())
+	}
+	if stream.GetSpeed() != 1 || stream.GetVolume() != 1 || stream.GetClipMode() != ClipHard ||
+		stream.loudness != nil || stream.observer != nil {
+		t.Error("pooled stream kept its parameters")
+	}
+	if stream.NumInputSamples() != 0 || stream.NumOutputSamples() != 0 {
+		t.Error("pooled stream kept its samples")
+	}
+
+	if other := pool.Get(8000, 1); other.GetSampleRate() != 8000 || other.GetNumChannels() != 1 {
+		t.Error("pool mixed up formats")
+	}
+	if s := pool.Stats(); s.Created+s.Reused != 3 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestStreamPoolBackend(t *testing.T) {
+	pool := NewStreamPool(0)
+	stream := pool.GetWithBackend(16000, 1, RingBackend)
+	stream.SetPitch(1.5)
+	if err := stream.Write(sine(16000, 1600, 200, 0.5)); err != nil {
+		t.Fatal(err)
+	}
+	pool.Put(stream)
+
+	if stream := pool.Get(16000, 1); stream.backend != SliceBackend {
+		t.Error("Get returned a ring stream")
+	}
+	stream = pool.GetWithBackend(16000, 1, RingBackend)
+	if stream.backend != RingBackend || stream.GetPitch() != 1 || stream.NumInputSamples() != 0 || stream.NumOutputSamples() != 0 {
+		t.Error("pooled ring stream was not reset to a new ring stream")
+	}
+	if err := stream.Write(sine(16000, 1600, 200, 0.5)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamPoolBudget(t *testing.T) {
+	pool := NewStreamPool(50000)
+	stream := pool.Get(16000, 1)
+	if err := stream.AddSamples(make([]int16, 100000)); err != nil {
+		t.Fatal(err)
+	}
+	pool.Put(stream)
+	if s := pool.Stats(); s.Released != 1 {
+		t.Errorf("stream over budget was pooled, stats %+v", s)
+	}
+}
+
+// session simulates a short call: a second of 20ms frames at 1.25x speed.
+func session(b *testing.B, stream *Stream, frame, out []int16) {
+	stream.SetSpeed(1.25)
+	for i := 0; i < 50; i++ {
+		if err := stream.Write(frame); err != nil {
+			b.Fatal(err)
+		}
+		for {
+			if _, err := stream.ReadTo(out); err != nil {
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkSessionNewStream(b *testing.B) {
+	frame := sine(48000, 960, 200, 0.5)
+	out := make([]int16, 960)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		session(b, NewSonicStream(48000, 1), frame, out)
+	}
+}
+
+func BenchmarkSessionStreamPool(b *testing.B) {
+	pool := NewStreamPool(0)
+	frame := sine(48000, 960, 200, 0.5)
+	out := make([]int16, 960)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		stream := pool.Get(48000, 1)
+		session(b, stream, frame, out)
+		pool.Put(stream)
+	}
+}
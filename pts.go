@@ -0,0 +1,114 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonic
+
+import (
+	"math"
+	"slices"
+	"time"
+)
+
+// ptsJump is a jump of the output timestamps by shift from output frame at on.
+type ptsJump struct {
+	at    int
+	shift time.Duration
+}
+
+// WritePTS writes samples like Write, with pts the presentation time of their first frame.
+// The first timestamp sets the time of the output frame it lands on. After that the output
+// timestamps advance by the duration of the output, so they stay continuous across Flush and
+// parameter changes, and a later timestamp only matters where it differs from the one the input
+// written so far leads to: the difference, divided by speed times rate, is added to the output
+// timestamps from the frame the input lands on. That frame is estimated from the playtime of the
+// input held by the stream and can be off by about a pitch period.
+func (stream *Stream) WritePTS(samples []int16, pts time.Duration) error {
+	ch := stream.numChannels
+	if len(samples)%ch != 0 {
+		return ErrChannels
+	}
+
+	// Input that a Discard drops moves the first frame that reaches the output.
+	skip := min(stream.discard, len(samples)/ch)
+	if skip < len(samples)/ch {
+		at := stream.produced + stream.pendingOutput()
+		if !stream.timed {
+			stream.ptsBase = pts + stream.frameTime(skip) - stream.frameTime(at)
+			stream.timed = true
+		} else if diff := pts - stream.ptsIn - stream.frameTime(stream.ptsInFrames); 2*diff.Abs() > stream.frameTime(1) {
+			shift := time.Duration(math.Round(float64(diff) / (stream.speed * stream.rate)))
+			stream.ptsJumps = append(stream.ptsJumps, ptsJump{at, shift})
+		}
+	}
+	stream.ptsIn, stream.ptsInFrames = pts, 0
+	return stream.Write(samples)
+}
+
+// ReadPTS reads like Read and returns the presentation time of the first frame read as well.
+func (stream *Stream) ReadPTS(n int) ([]int16, time.Duration, error) {
+	pts := stream.OutputPTS()
+	samples, err := stream.Read(n)
+	return samples, pts, err
+}
+
+// OutputPTS returns the presentation time of the next output frame. It is zero-based until the
+// first WritePTS.
+func (stream *Stream) OutputPTS() time.Duration {
+	next := stream.produced - stream.outputBuffer.Len()
+	pts := stream.ptsBase + stream.frameTime(next)
+	for _, j := range stream.ptsJumps {
+		if j.at <= next {
+			pts += j.shift
+		}
+	}
+	return pts
+}
+
+// prunePTS folds the timestamp jumps the output read so far has reached into ptsBase.
+func (stream *Stream) prunePTS() {
+	if len(stream.ptsJumps) == 0 {
+		return
+	}
+	next := stream.produced - stream.outputBuffer.Len()
+	stream.ptsJumps = slices.DeleteFunc(stream.ptsJumps, func(j ptsJump) bool {
+		if j.at > next {
+			return false
+		}
+		stream.ptsBase += j.shift
+		return true
+	})
+}
+
+// frameTime returns the duration of n frames.
+func (stream *Stream) frameTime(n int) time.Duration {
+	return time.Duration(math.Round(float64(n) * float64(time.Second) / float64(stream.sampleRate)))
+}
+
+// pendingOutput estimates the number of output frames the stream makes of the samples it holds
+// before the output buffer: the playtime of the input less the time error PICOLA has yet to
+// make up, the samples waiting for the rate converter and the samples held by the stages.
+func (stream *Stream) pendingOutput() int {
+	held := (stream.inputPlaytime-stream.timeError)*float64(stream.sampleRate) + float64(stream.pitchBuffer.Len())
+	n := int(math.Round(held/(stream.rate*stream.pitch))) - stream.seekSkip
+	if stream.tune != nil {
+		n += stream.tune.pending()
+	}
+	if stream.harmony != nil {
+		n += stream.harmony.pending()
+	}
+	if stream.loudness != nil {
+		n += stream.loudness.pending()
+	}
+	return max(n, 0)
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonic
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// readFramePTS reads the output frame by frame and returns the timestamp of each frame.
+func readFramePTS(t *testing.T, stream *Stream) []time.Duration {
+	t.Helper()
+	var pts []time.Duration
+	for stream.NumOutputSamples() > 0 {
+		_, p, err := stream.ReadPTS(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pts = append(pts, p)
+	}
+	return pts
+}
+
+func TestPTSContinuity(t *testing.T) {
+	const sampleRate, block = 16000, 320
+	w := seekSource(sampleRate, 3*sampleRate)
+	start := 10 * time.Second
+	frame := time.Second / sampleRate
+
+	stream := NewSonicStream(sampleRate, 1)
+	var pts []time.Duration
+	for i, off := 0, 0; off < len(w); i, off = i+1, off+block {
+		switch off {
+		case sampleRate:
+			stream.SetSpeed(1.5)
+		case 3 * sampleRate / 2:
+			_ = stream.Flush()
+		case 2 * sampleRate:
+			stream.SetSpeed(0.7)
+			stream.SetPitch(1.2)
+		}
+		if err := stream.WritePTS(w[off:off+block], start+time.Duration(off)*frame); err != nil {
+			t.Fatal(err)
+		}
+		// Reading in blocks of changing size gives the same timestamps.
+		for n := 100 + 37*(i%5); stream.NumOutputSamples() > n; {
+			_, p, _ := stream.ReadPTS(n)
+			pts = append(pts, p)
+			for k := 1; k < n; k++ {
+				pts = append(pts, p+time.Duration(k)*frame)
+			}
+		}
+	}
+	_ = stream.Flush()
+	pts = append(pts, readFramePTS(t, stream)...)
+
+	if pts[0] != start {
+		t.Errorf("first timestamp %v, want %v", pts[0], start)
+	}
+	for i := 1; i < len(pts); i++ {
+		if d := pts[i] - pts[i-1]; d < frame-1 || d > frame+1 {
+			t.Fatalf("timestamps %v and %v of frames %d and %d", pts[i-1], pts[i], i-1, i)
+		}
+	}
+}
+
+func TestPTSJump(t *testing.T) {
+	const sampleRate = 16000
+	w := seekSource(sampleRate, 2*sampleRate)
+	maxPeriod := sampleRate / MinPitch
+	frame := time.Second / sampleRate
+
+	// One second of input, then a second from two seconds on, played at double speed.
+	stream := NewSonicStream(sampleRate, 1)
+	stream.SetSpeed(2)
+	var pts []time.Duration
+	for off := 0; off < len(w); off += 500 {
+		in := time.Duration(off) * frame
+		if off >= sampleRate {
+			in += time.Second
+		}
+		if err := stream.WritePTS(w[off:off+500], in); err != nil {
+			t.Fatal(err)
+		}
+		if off == sampleRate+1000 {
+			// The pending jump survives a snapshot and a clone.
+			data, _ := stream.MarshalBinary()
+			restored := &Stream{}
+			if err := restored.UnmarshalBinary(data); err != nil {
+				t.Fatal(err)
+			}
+			// Asking for the timestamp leaves the stream as it is.
+			jumps := slices.Clone(stream.ptsJumps)
+			if stream.OutputPTS() != stream.OutputPTS() || !slices.Equal(stream.ptsJumps, jumps) || len(jumps) == 0 {
+				t.Errorf("OutputPTS changed the pending jumps %v to %v", jumps, stream.ptsJumps)
+			}
+			a, b, c := readFramePTS(t, stream.Clone(true)), readFramePTS(t, restored), readFramePTS(t, stream)
+			if !slices.Equal(a, c) || !slices.Equal(b, c) {
+				t.Error("restored or cloned stream timestamps differ")
+			}
+			pts = append(pts, c...)
+		}
+	}
+	_ = stream.Flush()
+	pts = append(pts, readFramePTS(t, stream)...)
+
+	jumps := 0
+	for i := 1; i < len(pts); i++ {
+		d := pts[i] - pts[i-1]
+		if d < frame-1 || d > frame+1 {
+			jumps++
+			if want := sampleRate / 2; abs(i-want) > maxPeriod {
+				t.Errorf("timestamps jump at output frame %d, want about %d", i, want)
+			}
+			if shift := d - frame; shift < time.Second/2-frame || shift > time.Second/2+frame {
+				t.Errorf("timestamps jump by %v, want 500ms", shift)
+			}
+		}
+	}
+	if jumps != 1 {
+		t.Errorf("%d jumps, want 1", jumps)
+	}
+	if len(stream.ptsJumps) != 0 {
+		t.Errorf("reading the output left the jumps %v", stream.ptsJumps)
+	}
+	if end := pts[len(pts)-1]; end < 1500*time.Millisecond-time.Duration(maxPeriod)*frame || end > 1500*time.Millisecond+time.Duration(maxPeriod)*frame {
+		t.Errorf("last timestamp %v, want about 1.5s", end)
+	}
+}
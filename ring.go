@@ -0,0 +1,372 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonic
+
+import (
+	"io"
+)
+
+// Storage is the method set a Buffer keeps its elements in. It is implemented by SliceBuffer,
+// which slides its data to the front when it runs out of room at the end, and by RingBuffer,
+// which wraps around instead.
+//
+// Slices returned by GetSlice, GetSliceAtN, ReadSlice, ReadSliceAt and Buffer share memory with
+// the storage. They are valid until the next call that modifies the storage or asks for another
+// slice.
+type Storage[T any] interface {
+	Len() int
+	Cap() int
+	Available() int
+	Truncate(n int)
+	Reset()
+	Grow(n int)
+
+	Write(v T) error
+	WriteAt(n int, v T)
+	WriteSlice(slice []T) error
+	WriteZero(n int)
+
+	Read() (T, error)
+	At(n int) (T, error)
+	DropSlice(n int) error
+	ReadSlice(n int) ([]T, error)
+	ReadSliceAt(at int) ([]T, error)
+	GetSlice(n int) ([]T, error)
+	GetSliceAtN(at, n int) ([]T, error)
+	Buffer() []T
+	AvailableBuffer() []T
+
+	MoveTo(dest *Buffer[T], n int) error
+	MoveAllTo(dest *Buffer[T]) error
+	CopyTo(dest *Buffer[T], n int) error
+}
+
+// Backend selects the Storage the sample buffers of a Stream keep their samples in.
+type Backend int
+
+const (
+	// SliceBackend uses SliceBuffer. It is the default.
+	SliceBackend Backend = iota
+	// RingBackend uses RingBuffer.
+	RingBackend
+)
+
+var (
+	_ Storage[int16] = (*SliceBuffer[int16])(nil)
+	_ Storage[int16] = (*RingBuffer[int16])(nil)
+)
+
+// RingBuffer is a Storage that never moves its data on writes: elements wrap around the end of
+// a fixed array, which only grows when it is full. A view that crosses the end of the array
+// continues past it: the wrapped part is copied behind the end and copied back by the next call,
+// so a view costs no more than its own length.
+type RingBuffer[T any] struct {
+	buf   []T // len(buf) is the capacity
+	head  int // index of the first element
+	n     int // number of elements
+	spill int // number of elements of the last view behind the end of buf, mirroring buf[:spill]
+}
+
+// NewRingBuffer creates a RingBuffer with the given capacity.
+func NewRingBuffer[T any](capacity int) *RingBuffer[T] {
+	return &RingBuffer[T]{buf: make([]T, capacity)}
+}
+
+// Len returns the number of elements in the buffer.
+func (b *RingBuffer[T]) Len() int {
+	return b.n
+}
+
+// Cap returns the capacity of the buffer.
+func (b *RingBuffer[T]) Cap() int {
+	return len(b.buf)
+}
+
+// Available returns how many elements can be written without growing the buffer.
+func (b *RingBuffer[T]) Available() int {
+	return len(b.buf) - b.n
+}
+
+// Truncate discards all but the first n elements.
+func (b *RingBuffer[T]) Truncate(n int) {
+	if n == 0 {
+		b.Reset()
+		return
+	}
+	if n < 0 || n > b.n {
+		panic("sonic.RingBuffer: truncation out of range")
+	}
+	b.n = n
+}
+
+// Reset resets the buffer to be empty.
+func (b *RingBuffer[T]) Reset() {
+	b.head = 0
+	b.n = 0
+	b.spill = 0
+}
+
+// Grow grows the buffer's capacity to guarantee space for another n elements.
+func (b *RingBuffer[T]) Grow(n int) {
+	if n < 0 {
+		panic("sonic.RingBuffer.Grow: negative count")
+	}
+	b.settle()
+	if b.n+n <= len(b.buf) {
+		return
+	}
+	c := max(2*len(b.buf), b.n+n, smallBufferSize)
+	buf := make([]T, c)
+	b.copyOut(buf, 0, b.n)
+	b.buf = buf
+	b.head = 0
+}
+
+// Write appends the element v to the buffer, growing the buffer as needed.
+func (b *RingBuffer[T]) Write(v T) error {
+	b.Grow(1)
+	b.buf[b.index(b.n)] = v
+	b.n++
+	return nil
+}
+
+// WriteAt rewrites the element v in the buffer at position n.
+func (b *RingBuffer[T]) WriteAt(n int, v T) {
+	b.settle()
+	if b.n < n {
+		panic("sonic.RingBuffer: wrong position to write at")
+	}
+	b.buf[b.index(n)] = v
+}
+
+// WriteSlice appends the elements of the slice to the buffer, growing the buffer as needed.
+func (b *RingBuffer[T]) WriteSlice(slice []T) error {
+	if len(slice) == 0 {
+		return nil
+	}
+	b.Grow(len(slice))
+	start := b.index(b.n)
+	m := copy(b.buf[start:], slice)
+	copy(b.buf, slice[m:])
+	b.n += len(slice)
+	return nil
+}
+
+// WriteZero appends n zero elements to the buffer.
+func (b *RingBuffer[T]) WriteZero(n int) {
+	b.Grow(n)
+	start := b.index(b.n)
+	end := start + n
+	if end <= len(b.buf) {
+		clear(b.buf[start:end])
+	} else {
+		clear(b.buf[start:])
+		clear(b.buf[:end-len(b.buf)])
+	}
+	b.n += n
+}
+
+// Read reads the next element from the buffer.
+func (b *RingBuffer[T]) Read() (T, error) {
+	b.settle()
+	if b.n == 0 {
+		var zeroValue T
+		b.Reset()
+		return zeroValue, io.EOF
+	}
+	v := b.buf[b.head]
+	b.drop(1)
+	return v, nil
+}
+
+// At peeks the element of the buffer at position n.
+func (b *RingBuffer[T]) At(n int) (T, error) {
+	b.settle()
+	if n < 0 || n >= b.n {
+		var zeroValue T
+		return zeroValue, io.EOF
+	}
+	return b.buf[b.index(n)], nil
+}
+
+// DropSlice drops the next n elements from the buffer.
+func (b *RingBuffer[T]) DropSlice(n int) error {
+	if b.n == 0 {
+		b.Reset()
+		return io.EOF
+	}
+	b.drop(min(n, b.n))
+	return nil
+}
+
+// ReadSlice reads the next n elements from the buffer.
+func (b *RingBuffer[T]) ReadSlice(n int) ([]T, error) {
+	if b.n == 0 {
+		b.Reset()
+		return nil, io.EOF
+	}
+	n = min(n, b.n)
+	slice := b.view(0, n)
+	b.drop(n)
+	return slice, nil
+}
+
+// ReadSliceAt reads the elements from position at to the end of the buffer.
+func (b *RingBuffer[T]) ReadSliceAt(at int) ([]T, error) {
+	if b.n == 0 {
+		b.Reset()
+		return nil, io.EOF
+	}
+	if at < 0 || at > b.n {
+		panic("sonic.RingBuffer: out of range")
+	}
+	slice := b.view(at, b.n-at)
+	b.n = at
+	return slice, nil
+}
+
+// GetSlice gets the next n elements from the buffer without removing them.
+func (b *RingBuffer[T]) GetSlice(n int) ([]T, error) {
+	if b.n == 0 {
+		b.Reset()
+		return nil, io.EOF
+	}
+	return b.view(0, min(n, b.n)), nil
+}
+
+// GetSliceAtN gets n elements starting at position at without removing them.
+func (b *RingBuffer[T]) GetSliceAtN(at, n int) ([]T, error) {
+	if b.n == 0 {
+		b.Reset()
+		return nil, io.EOF
+	}
+	if at < 0 || n < 0 || at+n > b.n {
+		panic("sonic.RingBuffer: out of range")
+	}
+	return b.view(at, n), nil
+}
+
+// Buffer returns a slice holding all the elements of the buffer.
+func (b *RingBuffer[T]) Buffer() []T {
+	return b.view(0, b.n)
+}
+
+// AvailableBuffer returns nil: the free space of a RingBuffer may wrap around the end of its
+// array, so there is no single slice to append to.
+func (b *RingBuffer[T]) AvailableBuffer() []T {
+	return nil
+}
+
+// MoveTo reads n elements and writes them to dest.
+func (b *RingBuffer[T]) MoveTo(dest *Buffer[T], n int) error {
+	if b.n == 0 {
+		return nil
+	}
+	n = min(n, b.n)
+	if err := b.writeTo(dest, n); err != nil {
+		return err
+	}
+	b.drop(n)
+	return nil
+}
+
+// MoveAllTo moves all elements to dest.
+func (b *RingBuffer[T]) MoveAllTo(dest *Buffer[T]) error {
+	return b.MoveTo(dest, b.n)
+}
+
+// CopyTo writes the next n elements to dest without removing them.
+func (b *RingBuffer[T]) CopyTo(dest *Buffer[T], n int) error {
+	if b.n == 0 {
+		return nil
+	}
+	return b.writeTo(dest, min(n, b.n))
+}
+
+// writeTo writes the first n elements to dest in up to two parts, so that moving data between
+// buffers never has to rotate the source.
+func (b *RingBuffer[T]) writeTo(dest *Buffer[T], n int) error {
+	b.settle()
+	end := b.head + n
+	if end <= len(b.buf) {
+		return dest.WriteSlice(b.buf[b.head:end])
+	}
+	if err := dest.WriteSlice(b.buf[b.head:]); err != nil {
+		return err
+	}
+	return dest.WriteSlice(b.buf[:end-len(b.buf)])
+}
+
+// index returns the array index of the element at position i.
+func (b *RingBuffer[T]) index(i int) int {
+	i += b.head
+	if i >= len(b.buf) {
+		i -= len(b.buf)
+	}
+	return i
+}
+
+// drop removes n elements from the front.
+func (b *RingBuffer[T]) drop(n int) {
+	b.n -= n
+	if b.n == 0 {
+		b.head = 0
+		return
+	}
+	b.head = b.index(n)
+}
+
+// view returns a contiguous slice of n elements starting at position at. If the range wraps
+// around, the part at the start of the array is copied behind its end, extending the array
+// beyond the capacity the first time, and settle copies it back.
+func (b *RingBuffer[T]) view(at, n int) []T {
+	b.settle()
+	start := b.head + at
+	if start >= len(b.buf) {
+		start -= len(b.buf)
+	}
+	size := len(b.buf)
+	if start+n <= size {
+		return b.buf[start : start+n]
+	}
+
+	spill := start + n - size
+	if cap(b.buf) < size+spill {
+		buf := make([]T, size, size+max(spill, size/2))
+		copy(buf, b.buf)
+		b.buf = buf
+	}
+	copy(b.buf[size:size+spill], b.buf[:spill])
+	b.spill = spill
+	return b.buf[start : start+n]
+}
+
+// settle copies the wrapped part of the last view back to the start of the array, keeping the
+// changes made through the view.
+func (b *RingBuffer[T]) settle() {
+	if b.spill == 0 {
+		return
+	}
+	size := len(b.buf)
+	copy(b.buf[:b.spill], b.buf[size:size+b.spill])
+	b.spill = 0
+}
+
+// copyOut copies n elements starting at position at to dst.
+func (b *RingBuffer[T]) copyOut(dst []T, at, n int) {
+	start := b.index(at)
+	m := copy(dst[:n], b.buf[start:min(start+n, len(b.buf))])
+	copy(dst[m:n], b.buf[:n-m])
+}
@@ -0,0 +1,181 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonic
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"testing"
+)
+
+// wrapped returns a ring buffer of capacity 8 holding 1..6 with the data wrapping around the end.
+func wrapped(t *testing.T) *RingBuffer[int16] {
+	b := NewRingBuffer[int16](8)
+	_ = b.WriteSlice([]int16{0, 0, 0, 0, 0})
+	if err := b.DropSlice(4); err != nil {
+		t.Fatal(err)
+	}
+	_ = b.WriteSlice([]int16{1, 2, 3, 4, 5, 6})
+	_ = b.DropSlice(1)
+	if b.head+b.n <= len(b.buf) {
+		t.Fatal("data does not wrap")
+	}
+	return b
+}
+
+func TestRingBufferViews(t *testing.T) {
+	b := wrapped(t)
+	if v, _ := b.At(4); v != 5 {
+		t.Errorf("At(4) = %d, want 5", v)
+	}
+	if got, _ := b.GetSliceAtN(1, 2); !slices.Equal(got, []int16{2, 3}) {
+		t.Errorf("GetSliceAtN(1, 2) = %v", got)
+	}
+	if got := b.Buffer(); !slices.Equal(got, []int16{1, 2, 3, 4, 5, 6}) {
+		t.Errorf("Buffer() = %v", got)
+	}
+
+	b = wrapped(t)
+	tail, _ := b.ReadSliceAt(3)
+	for i := range tail {
+		tail[i] *= 10
+	}
+	_ = b.WriteSlice(tail)
+	if got := b.Buffer(); !slices.Equal(got, []int16{1, 2, 3, 40, 50, 60}) {
+		t.Errorf("after ReadSliceAt write-back: %v", got)
+	}
+
+	// A wrapped view is written through in place, as overlapAdd does, without moving the data.
+	b = wrapped(t)
+	head := b.head
+	view, _ := b.GetSliceAtN(1, 4)
+	for i := range view {
+		view[i] = -view[i]
+	}
+	if got := b.Buffer(); !slices.Equal(got, []int16{1, -2, -3, -4, -5, 6}) || b.head != head {
+		t.Errorf("after writing through a wrapped view: %v, head %d", got, b.head)
+	}
+
+	b = wrapped(t)
+	b.WriteZero(2)
+	_ = b.Write(7)
+	if got := b.Buffer(); !slices.Equal(got, []int16{1, 2, 3, 4, 5, 6, 0, 0, 7}) {
+		t.Errorf("after growing: %v", got)
+	}
+}
+
+func TestRingBufferMove(t *testing.T) {
+	for _, dest := range []*Buffer[int16]{NewBuffer[int16](0), NewBufferWithStorage[int16](NewRingBuffer[int16](4))} {
+		b := wrapped(t)
+		if err := b.CopyTo(dest, 2); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.MoveTo(dest, 5); err != nil {
+			t.Fatal(err)
+		}
+		if got := dest.Buffer(); !slices.Equal(got, []int16{1, 2, 1, 2, 3, 4, 5}) {
+			t.Errorf("%T: moved %v", dest.store, got)
+		}
+		if v, err := b.Read(); err != nil || v != 6 || b.Len() != 0 {
+			t.Errorf("%T: left %d, %v", dest.store, v, err)
+		}
+	}
+}
+
+func TestRingBackend(t *testing.T) {
+	w, sampleRate, channels, err := readWAV("./testdata/OSR_us_000_0010_8k.wav")
+	if err != nil {
+		t.Fatalf("reading error: %v", err)
+	}
+	for _, cfg := range steadyStateConfigs {
+		t.Run(cfg.name, func(t *testing.T) {
+			var outputs [2][]int16
+			for i, backend := range []Backend{SliceBackend, RingBackend} {
+				stream := NewSonicStreamWithBackend(sampleRate, channels, backend)
+				cfg.setup(stream)
+				for off := 0; off < len(w); off += 777 {
+					if err := stream.Write(w[off:min(off+777, len(w))]); err != nil {
+						t.Fatal(err)
+					}
+					got, _ := stream.ReadAll()
+					outputs[i] = append(outputs[i], got...)
+				}
+				if err := stream.Flush(); err != nil {
+					t.Fatal(err)
+				}
+				got, _ := stream.ReadAll()
+				outputs[i] = append(outputs[i], got...)
+			}
+			if !slices.Equal(outputs[0], outputs[1]) {
+				t.Errorf("ring backend output differs: %d vs %d samples", len(outputs[1]), len(outputs[0]))
+			}
+		})
+	}
+}
+
+func TestRingBackendAllocs(t *testing.T) {
+	stream := NewSonicStreamWithBackend(48000, 2, RingBackend)
+	stream.SetSpeed(1.7)
+	frame := make([]int16, 960*2)
+	for i := range frame {
+		frame[i] = int16(8000 * math.Sin(float64(i/2)*0.05))
+	}
+	out := make([]int16, len(frame))
+	for i := 0; i < 100; i++ {
+		if err := steadyStateFrame(stream, frame, out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	allocs := testing.AllocsPerRun(200, func() {
+		if err := steadyStateFrame(stream, frame, out); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("%v allocations per frame, want 0", allocs)
+	}
+}
+
+func BenchmarkBackend(b *testing.B) {
+	for _, cfg := range steadyStateConfigs {
+		for _, backend := range []Backend{SliceBackend, RingBackend} {
+			name := "slice"
+			if backend == RingBackend {
+				name = "ring"
+			}
+			b.Run(fmt.Sprintf("%s/%s", cfg.name, name), func(b *testing.B) {
+				stream := NewSonicStreamWithBackend(48000, 1, backend)
+				cfg.setup(stream)
+				frame := make([]int16, 960)
+				for i := range frame {
+					frame[i] = int16(8000 * math.Sin(float64(i)*0.05))
+				}
+				out := make([]int16, len(frame))
+				for i := 0; i < 100; i++ {
+					_ = steadyStateFrame(stream, frame, out)
+				}
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := steadyStateFrame(stream, frame, out); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
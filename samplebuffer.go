@@ -23,9 +23,8 @@ var ErrChannels = errors.New("incompatible number of elements for the specified
 
 // SampleBuffer represents a buffer for audio samples. Built upon a sonic.Buffer implementation
 type SampleBuffer struct {
-	*Buffer[int16]         // Embedding Buffer[int16] to inherit its methods and fields
-	ch             int     // Number of channels
-	empty          []int16 // Slice of empty samples for efficient use in WriteEmpty
+	*Buffer[int16]     // Embedding Buffer[int16] to inherit its methods and fields
+	ch             int // Number of channels
 }
 
 // NewSampleBuffer creates a new SampleBuffer with the specified number of channels and capacity.
@@ -42,7 +41,15 @@ func NewSampleBuffer(ch, capacity int) *SampleBuffer {
 	return &SampleBuffer{
 		Buffer: NewBuffer[int16](capacity * ch),
 		ch:     ch,
-		empty:  make([]int16, 4096),
+	}
+}
+
+// NewRingSampleBuffer creates a new SampleBuffer backed by a RingBuffer with the specified
+// number of channels and capacity.
+func NewRingSampleBuffer(ch, capacity int) *SampleBuffer {
+	return &SampleBuffer{
+		Buffer: NewBufferWithStorage[int16](NewRingBuffer[int16](capacity * ch)),
+		ch:     ch,
 	}
 }
 
@@ -107,14 +114,24 @@ func (b *SampleBuffer) GetChannel(at, ch int) (int16, error) {
 //	at: The position in the SampleBuffer from which scaling starts.
 //	factor: The scaling factor to be applied to each sample.
 func (b *SampleBuffer) Scale(at, factor int) error {
+	_, err := b.scale(at, factor)
+	return err
+}
+
+// scale is Scale returning the number of samples clamped to the int16 range.
+func (b *SampleBuffer) scale(at, factor int) (uint64, error) {
 	slice, err := b.ReadSliceAt(at)
-	if err == nil {
-		for i := range slice {
-			slice[i] = scaleInt16(factor, slice[i])
+	if err != nil {
+		return 0, err
+	}
+	var clips uint64
+	for i := range slice {
+		var clipped bool
+		if slice[i], clipped = scaleInt16(factor, slice[i]); clipped {
+			clips++
 		}
-		return b.WriteSlice(slice)
 	}
-	return err
+	return clips, b.WriteSlice(slice)
 }
 
 // WriteSlice writes a slice of samples to the SampleBuffer.
@@ -130,6 +147,7 @@ func (b *SampleBuffer) WriteSlice(s []int16) error {
 }
 
 // Flush reads and returns a slice containing all samples from the SampleBuffer.
+// The slice is not a copy: it shares the buffer's storage and is overwritten by later writes.
 func (b *SampleBuffer) Flush() ([]int16, error) {
 	return b.Buffer.ReadSlice(b.Buffer.Len())
 }
@@ -147,12 +165,8 @@ func (b *SampleBuffer) WriteEmpty(n int) (int, error) {
 	cur := b.Len()
 
 	num := n * b.ch
-	if len(b.empty) < num {
-		b.empty = make([]int16, num+1024)
-	}
-
-	err := b.Buffer.WriteSlice(b.empty[:num])
-	return cur, err
+	b.Buffer.WriteZero(num)
+	return cur, nil
 }
 
 // GetSlice gets and returns a slice of audio samples from the current SampleBuffer
@@ -241,7 +255,7 @@ func (b *SampleBuffer) AddFloatSamples(s []float64) error {
 	if len(s)%b.ch != 0 {
 		return ErrChannels
 	}
-	b.Buffer.Grow(len(s) / b.ch)
+	b.Buffer.Grow(len(s))
 	for i := range s {
 		if err := b.Buffer.Write(int16(s[i] * 32767.0)); err != nil {
 			return err
@@ -257,7 +271,7 @@ func (b *SampleBuffer) AddByteSamples(s []uint8) error {
 	if len(s)%b.ch != 0 {
 		return ErrChannels
 	}
-	b.Buffer.Grow(len(s) / b.ch)
+	b.Buffer.Grow(len(s))
 	for i := range s {
 		if err := b.Buffer.Write((int16(s[i]) - 128) << 8); err != nil {
 			return err
@@ -273,14 +287,14 @@ func (b *SampleBuffer) AddSamples(s []int16) error {
 }
 
 // scaleInt16 scales the given int16 sample by the specified volume factor.
-// The result is clamped to the valid int16 range.
+// The result is clamped to the valid int16 range, and clipped reports whether it had to be.
 // This function is used internally for scaling audio samples in the SampleBuffer.
-func scaleInt16(volume int, sample int16) int16 {
+func scaleInt16(volume int, sample int16) (scaled int16, clipped bool) {
 	val := (volume * int(sample)) >> 8
 	if val > ShrtMax {
-		val = ShrtMax
+		return ShrtMax, true
 	} else if val < ShrtMin {
-		val = ShrtMin
+		return ShrtMin, true
 	}
-	return int16(val)
+	return int16(val), false
 }
@@ -0,0 +1,239 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonic
+
+import (
+	"math"
+	"slices"
+)
+
+// seekFadeRate sets the crossfade of Seek and Discard to 1/seekFadeRate of a second.
+const seekFadeRate = 100
+
+// SeekPreroll returns the number of frames before a new position Seek runs through the stream.
+func (stream *Stream) SeekPreroll() int {
+	return stream.maxRequired
+}
+
+// Seek prepares the stream for input from a new position of the source. It drops the pending
+// input and output but, unlike Reset, keeps the pitch period and rate converter state. It then
+// runs preroll, the frames just before the new position, through the stream and drops their
+// output, so that the input written next starts without a transient. Only the last SeekPreroll
+// frames of preroll are used. The first 10ms of the new output are crossfaded from the output
+// it drops, continued by repeating the last pitch period of the output where that is shorter.
+func (stream *Stream) Seek(preroll []int16) error {
+	ch := stream.numChannels
+	if len(preroll)%ch != 0 {
+		return ErrChannels
+	}
+	preroll = preroll[max(len(preroll)-stream.SeekPreroll()*ch, 0):]
+
+	if err := stream.startOver(); err != nil {
+		return err
+	}
+	stream.inputBuffer.Reset()
+	stream.inputPlaytime = 0
+	stream.discard = 0
+	stream.seekSkip = stream.outputFrames(len(preroll) / ch)
+
+	// The pre-roll bypasses AddSamples, so that it does not count as input for the timestamps
+	// and markers.
+	if err := stream.reserve(len(preroll)); err != nil {
+		return err
+	}
+	if err := stream.inputBuffer.AddSamples(preroll); err != nil {
+		return err
+	}
+	stream.inputPlaytime = float64(stream.inputSamplesLen()) * stream.samplePeriod / (stream.speed / stream.pitch)
+	return stream.processStreamInput()
+}
+
+// Discard drops the next n frames of input: first the ones the stream holds and then the ones
+// written next, for example to skip ahead in a live source. Like Seek, it drops the pending output,
+// keeps the pitch period and rate converter state, pre-rolls the stream with the last discarded
+// frames and crossfades into the new output.
+func (stream *Stream) Discard(n int) error {
+	if n <= 0 {
+		return nil
+	}
+	if err := stream.startOver(); err != nil {
+		return err
+	}
+	preroll := min(n, stream.SeekPreroll())
+	stream.discard = n - preroll
+	stream.seekSkip = stream.outputFrames(preroll)
+	return stream.skipInput()
+}
+
+// outputFrames returns the number of output frames the stream makes of n input frames.
+func (stream *Stream) outputFrames(n int) int {
+	return int(math.Round(float64(n) / (stream.speed * stream.rate)))
+}
+
+// startOver keeps the output the stream would continue with for the crossfade and drops it
+// together with the samples held by the stages after the time stretch. The continuation is the
+// output still in the output buffer, extended by repeating the last pitch period of the output
+// if it is shorter than the crossfade.
+func (stream *Stream) startOver() error {
+	ch := stream.numChannels
+	fade := stream.sampleRate / seekFadeRate
+	dropped := stream.outputBuffer.Len()
+	stream.seekTail, stream.seekFaded = stream.seekTail[:0], 0
+	if dropped > 0 {
+		tail, err := stream.outputBuffer.GetSlice(min(dropped, fade))
+		if err != nil {
+			return err
+		}
+		stream.seekTail = append(stream.seekTail, tail...)
+	}
+	if history := stream.seekHistory; len(stream.seekTail) < fade*ch && len(history) >= 2*stream.minPeriod*ch {
+		// The repeated period is tilted so that it ends on the last frame of the output, so that
+		// it joins both the output and its own repetitions without a step.
+		period := stream.historyPeriod()
+		from := len(history) - period*ch
+		for k := 0; len(stream.seekTail) < fade*ch; k = (k + 1) % period {
+			w := float64(period-1-k) / float64(period)
+			for c := 0; c < ch; c++ {
+				d := float64(history[len(history)-ch+c]) - float64(history[from-ch+c])
+				stream.seekTail = append(stream.seekTail, clampInt16(math.Round(float64(history[from+k*ch+c])+d*w)))
+			}
+		}
+	}
+	stream.seekHistory = stream.seekHistory[:len(stream.seekHistory)-min(dropped*ch, len(stream.seekHistory))]
+
+	// The dropped output and the jumps in the timestamps of the input it drops do not count.
+	stream.produced -= dropped
+	stream.ptsJumps = slices.DeleteFunc(stream.ptsJumps, func(j ptsJump) bool { return j.at > stream.produced })
+	// Markers in the dropped output move to the seam.
+	for i := range stream.markersOut {
+		stream.markersOut[i].Pos = min(stream.markersOut[i].Pos, stream.produced)
+	}
+	stream.outputBuffer.Reset()
+	stream.timeError = 0
+	if stream.tune != nil {
+		stream.tune.reset()
+	}
+	if stream.harmony != nil {
+		stream.harmony.reset()
+	}
+	if stream.loudness != nil {
+		stream.loudness.resetLimiter()
+	}
+	return nil
+}
+
+// historyPeriod returns the pitch period of the end of the output history: the period, between
+// the minimum and the maximum one the history holds twice, whose last two repetitions differ
+// least on average.
+func (stream *Stream) historyPeriod() int {
+	ch := stream.numChannels
+	h := stream.seekHistory
+	frames := len(h) / ch
+	best, bestDiff := stream.minPeriod, math.Inf(1)
+	for p := stream.minPeriod; p <= min(stream.maxPeriod, frames/2); p++ {
+		diff := 0
+		for i := (frames - p) * ch; i < len(h); i++ {
+			diff += abs(int(h[i]) - int(h[i-p*ch]))
+		}
+		if d := float64(diff) / float64(p); d < bestDiff {
+			best, bestDiff = p, d
+		}
+	}
+	return best
+}
+
+// keepOutput appends the last n frames of the output buffer to the output history, keeping as
+// many of the last frames as it has room for. A negative n drops frames from its end.
+func (stream *Stream) keepOutput(n int) {
+	ch := stream.numChannels
+	h := stream.seekHistory
+	if n < 0 {
+		stream.seekHistory = h[:len(h)-min(-n*ch, len(h))]
+		return
+	}
+	n = min(n, stream.outputBuffer.Len(), cap(h)/ch)
+	if n == 0 {
+		return
+	}
+	frames, err := stream.outputBuffer.Buffer.GetSliceAtN((stream.outputBuffer.Len()-n)*ch, n*ch)
+	if err != nil {
+		return
+	}
+	if keep := min(len(h), cap(h)-n*ch); keep < len(h) {
+		h = h[:copy(h, h[len(h)-keep:])]
+	}
+	stream.seekHistory = append(h, frames...)
+}
+
+// pending reports whether the stream holds samples that are not output yet.
+func (stream *Stream) pending() bool {
+	n := stream.inputBuffer.Len() + stream.outputBuffer.Len() + stream.pitchBuffer.Len()
+	if stream.tune != nil {
+		n += stream.tune.pending()
+	}
+	if stream.harmony != nil {
+		n += stream.harmony.pending()
+	}
+	if stream.loudness != nil {
+		n += stream.loudness.pending()
+	}
+	return n > 0
+}
+
+// skipInput drops the input frames Discard still has to drop.
+func (stream *Stream) skipInput() error {
+	n := min(stream.discard, stream.inputBuffer.Len())
+	if n == 0 {
+		return nil
+	}
+	if err := stream.inputBuffer.DropSlice(n); err != nil {
+		return err
+	}
+	stream.discard -= n
+	stream.inputPlaytime = float64(stream.inputSamplesLen()) * stream.samplePeriod / (stream.speed / stream.pitch)
+	return nil
+}
+
+// continueOutput drops the pre-roll output of Seek and Discard from the output produced since
+// position at and crossfades the output after it from the old output they cut off.
+func (stream *Stream) continueOutput(at int) error {
+	if (stream.seekSkip == 0 && len(stream.seekTail) == 0) || at >= stream.outputBuffer.Len() {
+		return nil
+	}
+	slice, err := stream.outputBuffer.ReadSliceAt(at)
+	if err != nil {
+		return err
+	}
+
+	ch := stream.numChannels
+	skip := min(stream.seekSkip, len(slice)/ch)
+	stream.seekSkip -= skip
+	slice = slice[skip*ch:]
+
+	fade := float64(len(stream.seekTail) / ch)
+	i := 0
+	for ; i < len(slice) && stream.seekFaded*ch < len(stream.seekTail); i += ch {
+		x := (float64(stream.seekFaded) + 0.5) / fade
+		for c := 0; c < ch; c++ {
+			v := x*float64(slice[i+c]) + (1-x)*float64(stream.seekTail[stream.seekFaded*ch+c])
+			slice[i+c] = clampInt16(math.Round(v))
+		}
+		stream.seekFaded++
+	}
+	if stream.seekFaded*ch >= len(stream.seekTail) {
+		stream.seekTail, stream.seekFaded = stream.seekTail[:0], 0
+	}
+	return stream.outputBuffer.WriteSlice(slice)
+}
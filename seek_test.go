@@ -0,0 +1,159 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonic
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+// writeChunks writes samples to a stream in chunks and returns the output read so far.
+func writeChunks(t *testing.T, stream *Stream, samples []int16, chunk int) []int16 {
+	t.Helper()
+	var out []int16
+	for off := 0; off < len(samples); off += chunk {
+		if err := stream.Write(samples[off:min(off+chunk, len(samples))]); err != nil {
+			t.Fatal(err)
+		}
+		got, _ := stream.ReadAll()
+		out = append(out, got...)
+	}
+	return out
+}
+
+// seamStep returns the largest step between neighbouring samples within 2ms of the seam at
+// index at, relative to the largest step elsewhere.
+func seamStep(out []int16, at, sampleRate int) float64 {
+	r := sampleRate / 500
+	seam := maxStep(out[max(at-r, 0):min(at+r, len(out))])
+	rest := max(maxStep(out[:max(at-r, 1)]), maxStep(out[min(at+r, len(out)-1):]))
+	return float64(seam) / float64(rest)
+}
+
+// seekSource is a tone with a few harmonics and a slow vibrato, so that neighbouring samples
+// are close and a jump in the source shows as a step.
+func seekSource(sampleRate, n int) []int16 {
+	w := make([]int16, n)
+	phase := 0.0
+	for i := range w {
+		f := 180 * (1 + 0.05*math.Sin(2*math.Pi*3*float64(i)/float64(sampleRate)))
+		phase += 2 * math.Pi * f / float64(sampleRate)
+		w[i] = int16(5000*math.Sin(phase) + 2500*math.Sin(2*phase+1) + 1200*math.Sin(3*phase+2))
+	}
+	return w
+}
+
+func TestSeekContinuity(t *testing.T) {
+	const sampleRate = 16000
+	w := seekSource(sampleRate, 2*sampleRate)
+	jump := sampleRate * 13 / 10
+
+	for _, speed := range []float64{1, 1.3, 0.8} {
+		stream := NewSonicStream(sampleRate, 1)
+		stream.SetSpeed(speed)
+		before := writeChunks(t, stream, w[:sampleRate/2], 320)
+		pending := stream.NumOutputSamples()
+		if err := stream.Seek(w[:jump]); err != nil {
+			t.Fatal(err)
+		}
+		after := writeChunks(t, stream, w[jump:], 320)
+		_ = stream.Flush()
+		rest, _ := stream.ReadAll()
+		after = append(after, rest...)
+		if pending != 0 {
+			t.Fatalf("speed %v: %d output frames pending before the seek", speed, pending)
+		}
+
+		out := append(before, after...)
+		if step := seamStep(out, len(before), sampleRate); step > 1.2 {
+			t.Errorf("speed %v: step at the seam %.2f times the largest elsewhere", speed, step)
+		}
+		if want := float64(len(w)-jump) / speed; math.Abs(float64(len(after))-want) > float64(sampleRate/MinPitch) {
+			t.Errorf("speed %v: %d frames after the seek, want about %.0f", speed, len(after), want)
+		}
+	}
+}
+
+func TestDiscardNormalized(t *testing.T) {
+	const sampleRate = 16000
+	w := seekSource(sampleRate, 2*sampleRate)
+
+	// The old output held in the limiter delay line is dropped with the rest of the output.
+	stream := NewSonicStream(sampleRate, 1)
+	stream.SetSpeed(1.3)
+	stream.SetNormalization(-20, DefaultTruePeak)
+	before := writeChunks(t, stream, w[:sampleRate/2], 320)
+	if err := stream.Discard(sampleRate / 4); err != nil {
+		t.Fatal(err)
+	}
+	if n := stream.loudness.pending(); n != 0 {
+		t.Errorf("%d frames left in the limiter delay line", n)
+	}
+	after := writeChunks(t, stream, w[sampleRate/2:], 320)
+	if step := seamStep(append(before, after...), len(before), sampleRate); step > 1.2 {
+		t.Errorf("step at the seam %.2f times the largest elsewhere", step)
+	}
+}
+
+func TestDiscard(t *testing.T) {
+	const sampleRate = 16000
+	w := seekSource(sampleRate, 2*sampleRate)
+	maxPeriod := sampleRate / MinPitch
+
+	stream := NewSonicStream(sampleRate, 1)
+	stream.SetSpeed(1.5)
+	before := writeChunks(t, stream, w[:sampleRate/2], 500)
+	held := stream.NumInputSamples()
+	if err := stream.Discard(sampleRate / 2); err != nil {
+		t.Fatal(err)
+	}
+	if stream.NumInputSamples() != 0 || stream.NumOutputSamples() != 0 {
+		t.Errorf("%d input and %d output frames left", stream.NumInputSamples(), stream.NumOutputSamples())
+	}
+	after := writeChunks(t, stream, w[sampleRate/2:], 500)
+	_ = stream.Flush()
+	rest, _ := stream.ReadAll()
+	after = append(after, rest...)
+
+	out := append(before, after...)
+	if step := seamStep(out, len(before), sampleRate); step > 1.2 {
+		t.Errorf("step at the seam %.2f times the largest elsewhere", step)
+	}
+	// The discarded frames started with the ones the stream held.
+	played := len(w) - sampleRate/2 - (sampleRate/2 - held)
+	if want := float64(played) / 1.5; math.Abs(float64(len(after))-want) > float64(maxPeriod) {
+		t.Errorf("%d frames after discarding, want about %.0f", len(after), want)
+	}
+
+	// The state of a crossfade in progress survives a snapshot.
+	stream.Reset()
+	writeChunks(t, stream, w[:sampleRate/2], 500)
+	_ = stream.Discard(1000)
+	_ = stream.Write(w[sampleRate/2 : sampleRate/2+1100])
+	data, _ := stream.MarshalBinary()
+	restored := &Stream{}
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	clone := stream.Clone(true)
+	var outs [3][]int16
+	for i, s := range []*Stream{stream, restored, clone} {
+		outs[i] = processChunks(t, s, w[sampleRate/2+1100:], 500)
+	}
+	if !slices.Equal(outs[0], outs[1]) || !slices.Equal(outs[0], outs[2]) {
+		t.Error("restored or cloned stream output differs")
+	}
+}
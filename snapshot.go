@@ -0,0 +1,473 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonic
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// snapshotMagic identifies a serialized Stream and snapshotVersion its layout.
+const (
+	snapshotMagic   = "SNIC"
+	snapshotVersion = 1
+)
+
+// The largest format UnmarshalBinary accepts. They bound the memory a snapshot can make it allocate.
+const (
+	maxSnapshotSampleRate = 768000
+	maxSnapshotChannels   = 64
+)
+
+// ErrSnapshot is returned by UnmarshalBinary for malformed or unsupported data.
+var ErrSnapshot = errors.New("invalid stream snapshot")
+
+// MarshalBinary encodes the complete state of the stream: its parameters, the samples held in
+// its buffers, the state of the pitch period search, rate converter, timestamps, markers, a seek
+// in progress and the auto-tune, harmony and loudness stages, and the processing counters.
+// A stream restored with UnmarshalBinary produces the same output as the original would have.
+// Streams above 768 kHz or 64 channels cannot be restored.
+func (stream *Stream) MarshalBinary() ([]byte, error) {
+	w := &snapshotWriter{}
+	w.buf.WriteString(snapshotMagic)
+	w.put(uint16(snapshotVersion))
+
+	w.ints(stream.sampleRate, stream.numChannels)
+	w.put([]float64{stream.speed, stream.pitch, stream.rate, stream.volume})
+	w.put(stream.volumeDB)
+	w.put(stream.quality)
+	w.ints(int(stream.clipMode))
+	w.ints(stream.maxInput, stream.maxOutput)
+	w.ints(int(stream.window))
+
+	w.put([]float64{stream.inputPlaytime, stream.timeError})
+	w.ints(stream.oldRatePosition, stream.newRatePosition, stream.prevPeriod, stream.prevMinDiff)
+	w.put(stream.pitchTracking)
+	w.ints(stream.trackMinDiff, stream.trackMaxDiff, stream.tracked)
+
+	for _, b := range stream.buffers() {
+		w.samples(b.Buffer.Buffer())
+	}
+
+	w.put(stream.loudness != nil)
+	if stream.loudness != nil {
+		stream.loudness.marshal(w)
+	}
+
+	w.put(stream.harmony != nil)
+	if stream.harmony != nil {
+		stream.harmony.marshal(w)
+	}
+
+	w.put(stream.tune != nil)
+	if stream.tune != nil {
+		t := stream.tune.tuner
+		w.ints(t.Key, int(t.Scale), int(t.Speed))
+		t.marshal(w)
+		stream.tune.marshal(w)
+	}
+
+	w.ints(stream.seekFaded, stream.seekSkip, stream.discard)
+	w.samples(stream.seekTail)
+	w.samples(stream.seekHistory)
+
+	w.ints(int(stream.ptsBase), int(stream.ptsIn), stream.ptsInFrames, stream.produced, len(stream.ptsJumps))
+	for _, j := range stream.ptsJumps {
+		w.ints(j.at, int(j.shift))
+	}
+	w.put(stream.timed)
+
+	w.ints(stream.written)
+	for _, markers := range [][]Marker{stream.markersIn, stream.markersOut} {
+		w.ints(len(markers))
+		for _, m := range markers {
+			w.ints(m.Pos, m.ID)
+		}
+	}
+
+	w.put(stream.stats)
+	w.put(stream.pitchSum)
+	w.ints(stream.pitchCount, stream.consumed)
+	return w.buf.Bytes(), nil
+}
+
+// UnmarshalBinary restores a stream from data produced by MarshalBinary. The storage backend, the
+// pitch estimator and the observer are not part of the snapshot; the stream keeps the ones it has.
+func (stream *Stream) UnmarshalBinary(data []byte) error {
+	if !bytes.HasPrefix(data, []byte(snapshotMagic)) {
+		return ErrSnapshot
+	}
+	r := &snapshotReader{r: bytes.NewReader(data[len(snapshotMagic):])}
+	var version uint16
+	r.get(&version)
+	if r.err == nil && version != snapshotVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrSnapshot, version)
+	}
+
+	sampleRate, numChannels := r.int(), r.int()
+	if r.err != nil || sampleRate < MaxPitch || sampleRate > maxSnapshotSampleRate || numChannels < 1 || numChannels > maxSnapshotChannels {
+		return ErrSnapshot
+	}
+	s := NewSonicStreamWithBackend(sampleRate, numChannels, stream.backend)
+	s.SetPitchEstimator(stream.estimator)
+	s.observer = stream.observer
+
+	params := make([]float64, 4)
+	r.get(params)
+	s.speed, s.pitch, s.rate, s.volume = params[0], params[1], params[2], params[3]
+	r.get(&s.volumeDB)
+	r.get(&s.quality)
+	s.clipMode = ClipMode(r.int())
+	s.maxInput, s.maxOutput = r.int(), r.int()
+	s.window = Window(r.int())
+	if r.err == nil && (!validFactor(s.speed) || !validFactor(s.pitch) || !validFactor(s.rate) || !validVolume(s.volume) || !s.clipMode.valid()) {
+		r.err = errors.New("parameters out of range")
+	}
+
+	timing := make([]float64, 2)
+	r.get(timing)
+	s.inputPlaytime, s.timeError = timing[0], timing[1]
+	s.oldRatePosition, s.newRatePosition = r.int(), r.int()
+	s.prevPeriod, s.prevMinDiff = r.int(), r.int()
+	r.get(&s.pitchTracking)
+	s.trackMinDiff, s.trackMaxDiff, s.tracked = r.int(), r.int(), r.int()
+	if r.err == nil && (s.maxInput < 0 || s.maxOutput < 0 || s.oldRatePosition < 0 || s.newRatePosition < 0 || s.prevPeriod < 0 || s.tracked < 0) {
+		r.err = errors.New("stream state out of range")
+	}
+
+	for _, b := range s.buffers() {
+		if samples := r.samples(); r.err == nil {
+			if err := b.WriteSlice(samples); err != nil {
+				return fmt.Errorf("%w: %v", ErrSnapshot, err)
+			}
+		}
+	}
+
+	var loudness bool
+	r.get(&loudness)
+	if loudness {
+		s.loudness = newLoudnessStage(sampleRate, numChannels, 0, 0)
+		s.loudness.unmarshal(r)
+	}
+
+	var harmony bool
+	r.get(&harmony)
+	if harmony {
+		s.harmony = newHarmonyStage(sampleRate, numChannels)
+		s.harmony.unmarshal(r)
+	}
+
+	var tune bool
+	r.get(&tune)
+	if tune {
+		t := AutoTune{Key: r.int(), Scale: Scale(r.int()), Speed: time.Duration(r.int())}
+		if r.err == nil && !t.valid() {
+			r.err = errors.New("auto-tune settings out of range")
+		}
+		s.tune = newTuneStage(sampleRate, numChannels, t)
+		s.tune.tuner.unmarshal(r)
+		s.tune.unmarshal(r)
+	}
+
+	s.seekFaded, s.seekSkip, s.discard = r.int(), r.int(), r.int()
+	s.seekTail = r.samples()
+	history := r.samples()
+	if r.err == nil && (len(s.seekTail)%numChannels != 0 || s.seekFaded < 0 || s.seekFaded*numChannels > len(s.seekTail) || s.seekSkip < 0 || s.discard < 0 ||
+		len(history)%numChannels != 0 || len(history) > cap(s.seekHistory)) {
+		r.err = errors.New("seek state out of range")
+	}
+	s.seekHistory = append(s.seekHistory, history...)
+
+	s.ptsBase, s.ptsIn, s.ptsInFrames, s.produced = time.Duration(r.int()), time.Duration(r.int()), r.int(), r.int()
+	jumps := r.int()
+	if r.err == nil && (jumps < 0 || jumps*16 > r.r.Len()) {
+		r.err = errors.New("timestamp jumps exceed data")
+	}
+	for i := 0; i < jumps && r.err == nil; i++ {
+		s.ptsJumps = append(s.ptsJumps, ptsJump{r.int(), time.Duration(r.int())})
+	}
+	r.get(&s.timed)
+	if r.err == nil && (s.ptsInFrames < 0 || s.produced < s.outputBuffer.Len()) {
+		r.err = errors.New("timestamp state out of range")
+	}
+
+	s.written = r.int()
+	s.markersIn, s.markersOut = r.markers(), r.markers()
+	if r.err == nil && (s.written < 0 || !slices.IsSortedFunc(s.markersIn, func(a, b Marker) int { return cmp.Compare(a.Pos, b.Pos) })) {
+		r.err = errors.New("markers out of range")
+	}
+
+	r.get(&s.stats)
+	r.get(&s.pitchSum)
+	s.pitchCount, s.consumed = r.int(), r.int()
+
+	if r.err != nil {
+		return fmt.Errorf("%w: %v", ErrSnapshot, r.err)
+	}
+	if r.r.Len() != 0 {
+		return fmt.Errorf("%w: %d trailing bytes", ErrSnapshot, r.r.Len())
+	}
+	*stream = *s
+	return nil
+}
+
+// buffers returns the sample buffers of the stream in snapshot order.
+func (stream *Stream) buffers() []*SampleBuffer {
+	return []*SampleBuffer{stream.inputBuffer, stream.outputBuffer, stream.pitchBuffer, stream.downSampleBuffer}
+}
+
+// marshal encodes the loudness measurement and limiter state.
+func (l *loudnessStage) marshal(w *snapshotWriter) {
+	w.put([]float64{l.target, l.ceiling})
+	for c := 0; c < l.ch; c++ {
+		w.put([]float64{l.shelfS[c].z1, l.shelfS[c].z2, l.highPassS[c].z1, l.highPassS[c].z2})
+	}
+	w.ints(l.hopPos, l.hopCount)
+	w.put(l.hopEnergy)
+	w.put(l.hops)
+	w.put(l.binCount)
+	w.put(l.binEnergy)
+	w.put([]float64{l.gain, l.targetGain})
+
+	w.put(l.hist)
+	for _, idx := range l.minIdx {
+		w.ints(idx)
+	}
+	w.put(l.minVal)
+	w.ints(l.minHead, l.minLen, l.frameIdx, l.avgPos, l.delayPos)
+	w.put([]float64{l.held, l.avgSum})
+	w.put(l.avg)
+	w.put(l.delay)
+	w.put(l.valid)
+}
+
+// unmarshal restores the state written by marshal into a stage of the same format.
+func (l *loudnessStage) unmarshal(r *snapshotReader) {
+	levels := make([]float64, 2)
+	r.get(levels)
+	l.target, l.ceiling = levels[0], levels[1]
+	state := make([]float64, 4)
+	for c := 0; c < l.ch; c++ {
+		r.get(state)
+		l.shelfS[c] = biquadState{state[0], state[1]}
+		l.highPassS[c] = biquadState{state[2], state[3]}
+	}
+	l.hopPos, l.hopCount = r.int(), r.int()
+	r.get(&l.hopEnergy)
+	r.get(&l.hops)
+	r.get(l.binCount)
+	r.get(l.binEnergy)
+	r.get(levels)
+	l.gain, l.targetGain = levels[0], levels[1]
+
+	r.get(l.hist)
+	for i := range l.minIdx {
+		l.minIdx[i] = r.int()
+	}
+	r.get(l.minVal)
+	l.minHead, l.minLen, l.frameIdx, l.avgPos, l.delayPos = r.int(), r.int(), r.int(), r.int(), r.int()
+	r.get(levels)
+	l.held, l.avgSum = levels[0], levels[1]
+	r.get(l.avg)
+	r.get(l.delay)
+	r.get(l.valid)
+
+	if r.err == nil && (l.minHead < 0 || l.minHead >= len(l.minIdx) || l.minLen < 0 || l.minLen > len(l.minIdx) || l.frameIdx < 0 ||
+		l.avgPos < 0 || l.avgPos >= len(l.avg) || l.delayPos < 0 || l.delayPos >= len(l.valid) ||
+		l.hopPos < 0 || l.hopPos >= l.hopLen || l.hopCount < 0 || l.hopCount > loudnessBlockHops) {
+		r.err = errors.New("loudness state out of range")
+	}
+}
+
+// marshal encodes the correction and the pitch periods placed in the auto-tune stage.
+func (p *pitchCorrector) marshal(w *snapshotWriter) {
+	w.put(p.cents)
+	w.ints(len(p.periods))
+	for _, t := range p.periods {
+		w.ints(t.pos)
+		w.put(t.period)
+		w.put(t.voiced)
+	}
+}
+
+// unmarshal restores the state written by marshal.
+func (p *pitchCorrector) unmarshal(r *snapshotReader) {
+	r.get(&p.cents)
+	n := r.int()
+	if r.err == nil && (n < 0 || n*17 > r.r.Len()) {
+		r.err = errors.New("auto-tune periods exceed data")
+		return
+	}
+	p.periods = make([]tunePeriod, n)
+	for i := range p.periods {
+		t := &p.periods[i]
+		t.pos = r.int()
+		r.get(&t.period)
+		r.get(&t.voiced)
+		if r.err == nil && (!(t.period > 0 && t.period <= float64(p.sampleRate)) || (i > 0 && t.pos < p.periods[i-1].pos)) {
+			r.err = errors.New("auto-tune periods out of range")
+		}
+	}
+}
+
+// marshal encodes the mix, the buffered input, the analysis marks and the voice accumulators.
+func (h *harmonyStage) marshal(w *snapshotWriter) {
+	w.put(h.dry)
+	w.ints(len(h.voices))
+	for _, v := range h.voices {
+		w.put([]float64{v.Semitones, v.Detune, v.Gain, v.next})
+	}
+	w.samples(h.in)
+	w.ints(h.start, h.done, len(h.marks))
+	for _, m := range h.marks {
+		w.ints(m.pos, m.period)
+		w.put(m.ratio)
+	}
+	for _, v := range h.voices {
+		w.put(v.acc)
+		w.put(v.weight)
+	}
+}
+
+// unmarshal restores the state written by marshal into a stage of the same format.
+func (h *harmonyStage) unmarshal(r *snapshotReader) {
+	r.get(&h.dry)
+	n := r.int()
+	if r.err == nil && (n < 0 || n*32 > r.r.Len()) {
+		r.err = errors.New("harmony voices exceed data")
+		return
+	}
+	voices := make([]Voice, n)
+	next := make([]float64, n)
+	params := make([]float64, 4)
+	for i := range voices {
+		r.get(params)
+		voices[i] = Voice{Semitones: params[0], Detune: params[1], Gain: params[2]}
+		next[i] = params[3]
+	}
+	h.setVoices(h.dry, voices)
+
+	h.in = r.samples()
+	h.start, h.done = r.int(), r.int()
+	marks := r.int()
+	if r.err == nil && (len(h.in)%h.ch != 0 || marks < 0 || marks*16 > r.r.Len()) {
+		r.err = errors.New("harmony state exceeds data")
+		return
+	}
+	h.marks = make([]pitchMark, marks)
+	for i := range h.marks {
+		h.marks[i] = pitchMark{r.int(), r.int(), 1}
+		r.get(&h.marks[i].ratio)
+		if m := h.marks[i]; r.err == nil && (!(m.ratio >= 0.5 && m.ratio <= 2) || m.period < h.minPeriod || m.period > h.maxPeriod || (i > 0 && m.pos != h.marks[i-1].pos+h.marks[i-1].period)) {
+			r.err = errors.New("harmony marks out of range")
+		}
+	}
+	frames := len(h.in) / h.ch
+	for i := range h.voices {
+		v := &h.voices[i]
+		v.next = next[i]
+		if r.err == nil && !(v.next-float64(h.reach) >= float64(h.start)) {
+			r.err = errors.New("harmony voice out of range")
+		}
+		v.acc = make([]float64, frames*h.ch)
+		v.weight = make([]float64, frames)
+		r.get(v.acc)
+		r.get(v.weight)
+	}
+
+	if r.err == nil && (h.start < 0 || h.start > h.done || h.done > h.end() || (len(h.marks) > 0 && h.marks[0].pos-h.reach < h.start)) {
+		r.err = errors.New("harmony state out of range")
+	}
+}
+
+// snapshotWriter encodes little-endian values into a buffer.
+type snapshotWriter struct {
+	buf bytes.Buffer
+}
+
+// put writes a fixed-size value or a slice of them. Writing to a bytes.Buffer cannot fail.
+func (w *snapshotWriter) put(v any) {
+	_ = binary.Write(&w.buf, binary.LittleEndian, v)
+}
+
+// ints writes ints as int64 values.
+func (w *snapshotWriter) ints(v ...int) {
+	for _, n := range v {
+		w.put(int64(n))
+	}
+}
+
+// samples writes a length-prefixed slice of samples.
+func (w *snapshotWriter) samples(s []int16) {
+	w.put(uint32(len(s)))
+	w.put(s)
+}
+
+// snapshotReader decodes values written by snapshotWriter, keeping the first error.
+type snapshotReader struct {
+	r   *bytes.Reader
+	err error
+}
+
+// get reads a fixed-size value or fills a slice of them.
+func (r *snapshotReader) get(v any) {
+	if r.err == nil {
+		r.err = binary.Read(r.r, binary.LittleEndian, v)
+	}
+}
+
+// int reads an int written by snapshotWriter.ints.
+func (r *snapshotReader) int() int {
+	var n int64
+	r.get(&n)
+	return int(n)
+}
+
+// markers reads a length-prefixed slice of markers.
+func (r *snapshotReader) markers() []Marker {
+	n := r.int()
+	if r.err == nil && (n < 0 || n*16 > r.r.Len()) {
+		r.err = errors.New("markers exceed data")
+	}
+	if r.err != nil || n == 0 {
+		return nil
+	}
+	markers := make([]Marker, n)
+	for i := range markers {
+		markers[i] = Marker{r.int(), r.int()}
+	}
+	return markers
+}
+
+// samples reads a length-prefixed slice of samples.
+func (r *snapshotReader) samples() []int16 {
+	var n uint32
+	r.get(&n)
+	if r.err != nil {
+		return nil
+	}
+	if int64(n)*2 > int64(r.r.Len()) {
+		r.err = errors.New("sample buffer exceeds data")
+		return nil
+	}
+	s := make([]int16, n)
+	r.get(s)
+	return s
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonic
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	w, sampleRate, channels, err := readWAV("./testdata/OSR_us_000_0010_8k.wav")
+	if err != nil {
+		t.Fatalf("reading error: %v", err)
+	}
+
+	newStream := func() *Stream {
+		stream := NewSonicStream(sampleRate, channels)
+		stream.SetSpeed(1.7)
+		stream.SetPitch(1.1)
+		stream.SetRate(0.9)
+		stream.SetVolume(1.3)
+		stream.SetNormalization(-16, DefaultTruePeak)
+		return stream
+	}
+	run := func(stream *Stream, in []int16) []int16 {
+		var out []int16
+		for off := 0; off < len(in); off += 1000 {
+			if err := stream.Write(in[off:min(off+1000, len(in))]); err != nil {
+				t.Fatal(err)
+			}
+			got, _ := stream.ReadAll()
+			out = append(out, got...)
+		}
+		return out
+	}
+	finish := func(stream *Stream) []int16 {
+		if err := stream.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		got, _ := stream.ReadAll()
+		return got
+	}
+
+	// Split in the middle of a chunk so that samples are pending in the buffers.
+	half := len(w)/2 + 333
+	original := newStream()
+	head := run(original, w[:half])
+
+	data, err := original.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := &Stream{}
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	tail := append(run(restored, w[half:]), finish(restored)...)
+	got := append(head, tail...)
+
+	uninterrupted := newStream()
+	want := append(run(uninterrupted, w), finish(uninterrupted)...)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("restored stream produced different output (%d vs %d samples)", len(got), len(want))
+	}
+
+	if restored.GetSpeed() != 1.7 || restored.GetLoudness() != uninterrupted.GetLoudness() {
+		t.Error("restored stream lost its parameters")
+	}
+}
+
+func TestSnapshotInvalid(t *testing.T) {
+	stream := NewSonicStream(16000, 2)
+	if err := stream.Write([]int16{1, 2, 3, 4}); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := stream.MarshalBinary()
+
+	bad := map[string][]byte{
+		"empty":     nil,
+		"magic":     append([]byte("XXXX"), data[4:]...),
+		"version":   append(append([]byte{}, data[:4]...), append([]byte{99, 0}, data[6:]...)...),
+		"truncated": data[:len(data)-3],
+		"trailing":  append(append([]byte{}, data...), 0),
+	}
+	// A huge format must be rejected before the buffers for it are allocated.
+	for name, at := range map[string]int{"sample rate": 6, "channels": 14} {
+		b := append([]byte{}, data...)
+		binary.LittleEndian.PutUint64(b[at:], 1<<50)
+		bad[name] = b
+	}
+	// Parameters the setters would not accept and negative positions written by a corrupted
+	// stream are rejected rather than used.
+	for name, corrupt := range map[string]func(*Stream){
+		"NaN speed":       func(s *Stream) { s.speed = math.NaN() },
+		"zero pitch":      func(s *Stream) { s.pitch = 0 },
+		"negative rate":   func(s *Stream) { s.rate = -1 },
+		"NaN volume":      func(s *Stream) { s.volume = math.NaN() },
+		"negative volume": func(s *Stream) { s.volume = -0.5 },
+		"clip mode":       func(s *Stream) { s.clipMode = ClipCubic + 1 },
+		"rate position":   func(s *Stream) { s.oldRatePosition = -1 },
+		"loudness delay":  func(s *Stream) { s.loudness.delayPos = -1 },
+		"loudness min":    func(s *Stream) { s.loudness.minHead = -1 },
+		"loudness avg":    func(s *Stream) { s.loudness.avgPos = -2 },
+		"harmony start": func(s *Stream) {
+			_ = s.SetHarmony(1)
+			s.harmony.start, s.harmony.done = -1, s.harmony.done-1
+		},
+	} {
+		s := NewSonicStream(16000, 2)
+		s.SetNormalization(-16, -1)
+		corrupt(s)
+		bad[name], _ = s.MarshalBinary()
+	}
+
+	for name, b := range bad {
+		if err := (&Stream{}).UnmarshalBinary(b); !errors.Is(err, ErrSnapshot) {
+			t.Errorf("%s: expected ErrSnapshot, got %v", name, err)
+		}
+	}
+}
@@ -61,6 +61,9 @@ import "C"
 
 import (
 	"math"
+	"time"
+
+	"github.com/alttagil/sonic-go/internal/simd"
 )
 
 const (
@@ -85,6 +88,8 @@ const (
 
 	// UseSinOverlap - set UseSinOverlap to true to use sin-wav based overlap add which in theory can improve
 	// sound quality slightly, at the expense of lots of floating point math.
+	//
+	// Deprecated: UseSinOverlap only sets the default window of new streams. Use Stream.SetWindow.
 	UseSinOverlap = false
 )
 
@@ -183,6 +188,12 @@ type Stream struct {
 	// volume is the volume adjustment factor.
 	volume float64
 
+	// volumeDB is set while the volume was given in decibels, which applies it in floating point.
+	volumeDB bool
+
+	// clipMode selects how the volume stage handles overdriven samples.
+	clipMode ClipMode
+
 	// pitch is the pitch adjustment factor.
 	pitch float64
 
@@ -235,14 +246,92 @@ type Stream struct {
 
 	// prevMinDiff is the previous minimum difference.
 	prevMinDiff int
+
+	// pitchTracking enables the narrow pitch period search around prevPeriod. trackMinDiff and
+	// trackMaxDiff are the minimum difference and the maximum difference over the whole pitch
+	// range of the last full search, and tracked counts the narrow searches since.
+	pitchTracking bool
+	trackMinDiff  int
+	trackMaxDiff  int
+	tracked       int
+
+	// estimator finds the pitch periods of the coarse search.
+	estimator PitchEstimator
+
+	// window is the crossfade window of overlapAdd.
+	window Window
+
+	// conv is a scratch buffer used to convert foreign sample formats to int16.
+	conv []int16
+
+	// tune is the optional auto-tune stage, harmony the optional harmony stage.
+	tune    *harmonyStage
+	harmony *harmonyStage
+
+	// loudness is the optional loudness normalization stage.
+	loudness *loudnessStage
+
+	// seekTail holds the old output Seek and Discard crossfade the new output from, and seekFaded
+	// the frames of it crossfaded so far. seekSkip is the number of pre-roll output frames still
+	// to drop and discard the number of input frames Discard still has to drop.
+	seekTail  []int16
+	seekFaded int
+	seekSkip  int
+	discard   int
+
+	// seekHistory holds the last maxRequired frames of output, whose last pitch period Seek and
+	// Discard repeat when the output they drop is shorter than the crossfade.
+	seekHistory []int16
+
+	// ptsBase is the presentation time of output frame 0, moved by the timestamp jumps the output
+	// reached, and produced the number of output frames produced. ptsJumps are the jumps the output
+	// did not reach yet. The next input frame is expected at ptsInFrames frames after ptsIn. timed
+	// is set by the first WritePTS.
+	ptsBase     time.Duration
+	ptsIn       time.Duration
+	ptsInFrames int
+	ptsJumps    []ptsJump
+	produced    int
+	timed       bool
+
+	// markersIn are the markers at input frames not written yet, in order, and markersOut the
+	// markers at output frames not read by ReadMarkers yet. written is the number of input frames
+	// written.
+	markersIn  []Marker
+	markersOut []Marker
+	written    int
+
+	// stats are the processing counters, pitchSum and pitchCount the sum and number of the pitches
+	// found outside silence and consumed the number of input samples the time stretch processed.
+	// event is the step of the time stretch reported to observer next.
+	stats      Stats
+	pitchSum   float64
+	pitchCount int
+	consumed   int
+	event      PeriodEvent
+	observer   Observer
+
+	// maxInput and maxOutput limit the buffered samples per channel; 0 means no limit.
+	maxInput  int
+	maxOutput int
+
+	// backend is the storage used by the sample buffers.
+	backend Backend
 }
 
 // NewSonicStream creates a new sonic Stream.
 func NewSonicStream(sampleRate, numChannels int) *Stream {
-	minPeriod := sampleRate / MaxPitch
-	maxPeriod := sampleRate / MinPitch
-	maxRequired := 2 * maxPeriod
+	return NewSonicStreamWithBackend(sampleRate, numChannels, SliceBackend)
+}
 
+// NewSonicStreamWithBackend creates a new sonic Stream whose sample buffers use the given storage backend.
+func NewSonicStreamWithBackend(sampleRate, numChannels int, backend Backend) *Stream {
+	newBuffer := NewSampleBuffer
+	if backend == RingBackend {
+		newBuffer = NewRingSampleBuffer
+	}
+
+	maxRequired := 2 * (sampleRate / MinPitch)
 	bufferSize := (maxRequired + (maxRequired >> 2)) * numChannels
 
 	skip := 1
@@ -252,38 +341,64 @@ func NewSonicStream(sampleRate, numChannels int) *Stream {
 	downSamplerBufferSize := (maxRequired + skip - 1) / skip
 
 	stream := &Stream{
-		sampleRate:       sampleRate,
-		numChannels:      numChannels,
-		minPeriod:        minPeriod,
-		maxPeriod:        maxPeriod,
-		maxRequired:      maxRequired,
-		inputBuffer:      NewSampleBuffer(numChannels, bufferSize),
-		outputBuffer:     NewSampleBuffer(numChannels, bufferSize),
-		pitchBuffer:      NewSampleBuffer(numChannels, bufferSize),
-		downSampleBuffer: NewSampleBuffer(1, downSamplerBufferSize),
-		samplePeriod:     1.0 / float64(sampleRate),
-
-		speed:   1.0,
-		pitch:   1.0,
-		volume:  1.0,
-		rate:    1.0,
-		quality: false,
-
-		prevPeriod:      0,
-		oldRatePosition: 0,
-		newRatePosition: 0,
+		inputBuffer:      newBuffer(numChannels, bufferSize),
+		outputBuffer:     newBuffer(numChannels, bufferSize),
+		pitchBuffer:      newBuffer(numChannels, bufferSize),
+		downSampleBuffer: newBuffer(1, downSamplerBufferSize),
+		backend:          backend,
+		seekHistory:      make([]int16, 0, maxRequired*numChannels),
 	}
+	stream.setDefaults(sampleRate, numChannels)
 	return stream
 }
 
+// setDefaults sets the format of a stream and the parameters it starts with. All other fields
+// start at their zero values.
+func (stream *Stream) setDefaults(sampleRate, numChannels int) {
+	stream.sampleRate = sampleRate
+	stream.numChannels = numChannels
+	stream.minPeriod = sampleRate / MaxPitch
+	stream.maxPeriod = sampleRate / MinPitch
+	stream.maxRequired = 2 * stream.maxPeriod
+	stream.samplePeriod = 1.0 / float64(sampleRate)
+	stream.speed, stream.pitch, stream.volume, stream.rate = 1.0, 1.0, 1.0, 1.0
+	stream.estimator = AMDFEstimator{}
+	if UseSinOverlap {
+		stream.window = WindowSine
+	}
+}
+
+// resetDefaults returns the stream to the state NewSonicStreamWithBackend creates it in, keeping
+// its storage backend. It keeps the sample buffers and scratch slices.
+func (stream *Stream) resetDefaults() {
+	stream.Reset()
+	sampleRate, numChannels := stream.sampleRate, stream.numChannels
+	*stream = Stream{
+		inputBuffer:      stream.inputBuffer,
+		outputBuffer:     stream.outputBuffer,
+		pitchBuffer:      stream.pitchBuffer,
+		downSampleBuffer: stream.downSampleBuffer,
+		backend:          stream.backend,
+		conv:             stream.conv[:0],
+		seekTail:         stream.seekTail[:0],
+		seekHistory:      stream.seekHistory[:0],
+		ptsJumps:         stream.ptsJumps[:0],
+		markersIn:        stream.markersIn[:0],
+		markersOut:       stream.markersOut[:0],
+	}
+	stream.setDefaults(sampleRate, numChannels)
+}
+
 // GetSpeed returns the speed of the stream.
 func (stream *Stream) GetSpeed() float64 {
 	return stream.speed
 }
 
-// SetSpeed sets the speed of the stream.
+// SetSpeed sets the speed of the stream. Speeds that are not positive and finite are ignored.
 func (stream *Stream) SetSpeed(speed float64) {
-	stream.speed = speed
+	if validFactor(speed) {
+		stream.speed = speed
+	}
 }
 
 // GetVolume returns the scaling factor of the stream.
@@ -291,9 +406,12 @@ func (stream *Stream) GetVolume() float64 {
 	return stream.volume
 }
 
-// SetVolume sets the volume
+// SetVolume sets the volume. 0 mutes the stream; negative and infinite volumes are ignored.
 func (stream *Stream) SetVolume(volume float64) {
-	stream.volume = volume
+	if validVolume(volume) {
+		stream.volume = volume
+		stream.volumeDB = false
+	}
 }
 
 // GetPitch returns the pitch of the stream.
@@ -301,9 +419,31 @@ func (stream *Stream) GetPitch() float64 {
 	return stream.pitch
 }
 
-// SetPitch sets the pitch of the stream.
+// SetPitch sets the pitch of the stream. Pitches that are not positive and finite are ignored.
 func (stream *Stream) SetPitch(pitch float64) {
-	stream.pitch = pitch
+	if validFactor(pitch) {
+		stream.pitch = pitch
+	}
+}
+
+// GetPitchSemitones returns the pitch of the stream in semitones.
+func (stream *Stream) GetPitchSemitones() float64 {
+	return 12 * math.Log2(stream.pitch)
+}
+
+// SetPitchSemitones sets the pitch of the stream in semitones, e.g. 7 for a fifth up.
+func (stream *Stream) SetPitchSemitones(semitones float64) {
+	stream.pitch = math.Exp2(semitones / 12)
+}
+
+// GetPitchCents returns the pitch of the stream in cents.
+func (stream *Stream) GetPitchCents() float64 {
+	return 1200 * math.Log2(stream.pitch)
+}
+
+// SetPitchCents sets the pitch of the stream in cents, hundredths of a semitone.
+func (stream *Stream) SetPitchCents(cents float64) {
+	stream.pitch = math.Exp2(cents / 1200)
 }
 
 // GetRate returns the rate of the stream.
@@ -322,12 +462,26 @@ func (stream *Stream) GetNumChannels() int {
 }
 
 // SetRate sets the playback rate of the stream. This scales pitch and speed at the same time.
+// Rates that are not positive and finite are ignored.
 func (stream *Stream) SetRate(rate float64) {
+	if !validFactor(rate) {
+		return
+	}
 	stream.rate = rate
 	stream.oldRatePosition = 0
 	stream.newRatePosition = 0
 }
 
+// validFactor reports whether v can be used as a speed, pitch or rate.
+func validFactor(v float64) bool {
+	return v > 0 && !math.IsInf(v, 1)
+}
+
+// validVolume reports whether v can be used as a volume.
+func validVolume(v float64) bool {
+	return v >= 0 && !math.IsInf(v, 1)
+}
+
 // GetQuality returns the quality setting.
 func (stream *Stream) GetQuality() bool {
 	return stream.quality
@@ -338,6 +492,18 @@ func (stream *Stream) SetQuality(quality bool) {
 	stream.quality = quality
 }
 
+// GetPitchTracking reports whether the pitch period search tracks the previous period.
+func (stream *Stream) GetPitchTracking() bool {
+	return stream.pitchTracking
+}
+
+// SetPitchTracking enables searching for the pitch period only in a narrow window around the
+// previous one while the matches stay confident, instead of over the whole pitch range. This
+// saves most of the search time at high sample rates, where the full search dominates.
+func (stream *Stream) SetPitchTracking(enabled bool) {
+	stream.pitchTracking = enabled
+}
+
 // computeSkip computes the number of samples to skip to down-sample the input.
 func (stream *Stream) computeSkip() int {
 	skip := 1
@@ -355,9 +521,40 @@ func (stream *Stream) inputSamplesLen() int {
 // moveInputToOutput moves all inputBuffer to outputBuffer
 func (stream *Stream) moveInputToOutput() error {
 	stream.inputPlaytime = 0
+	stream.consumed += stream.inputBuffer.Len()
 	return stream.inputBuffer.MoveAllTo(stream.outputBuffer)
 }
 
+// copyInput moves the input to the output unmodified while the auto-tune stage needs the pitch
+// periods of it: period by period as far as the pitch search reaches, keeping the rest for the
+// next call.
+func (stream *Stream) copyInput() error {
+	playtime := stream.inputPlaytime
+	samplesNum := stream.inputBuffer.Len()
+	moved, err := stream.copyPeriods(samplesNum)
+	stream.consumed += moved
+	stream.inputPlaytime = playtime * float64(stream.inputBuffer.Len()) / float64(samplesNum)
+	return err
+}
+
+// copyPeriods moves up to n input samples to the output unmodified, one pitch period at a time,
+// as long as there is input to search the next period in, and returns the number moved.
+func (stream *Stream) copyPeriods(n int) (int, error) {
+	moved := 0
+	for moved < n && stream.inputBuffer.Len() >= stream.maxRequired {
+		period, err := stream.tunePitchPeriod()
+		if err != nil {
+			return moved, err
+		}
+		period = min(period, n-moved)
+		if err := stream.inputBuffer.MoveTo(stream.outputBuffer, period); err != nil {
+			return moved, err
+		}
+		moved += period
+	}
+	return moved, nil
+}
+
 // moveInputToOutput moves samples sohould be left unmodified from inputBuffer to outputBuffer
 func (stream *Stream) moveUnmodifiedSamples(speed float64) error {
 	inputToCopyFloat := math.Round(1 - stream.timeError*speed/(stream.samplePeriod*(speed-1.0)))
@@ -365,11 +562,21 @@ func (stream *Stream) moveUnmodifiedSamples(speed float64) error {
 
 	var err error
 	if inputToCopy > stream.inputBuffer.Len() {
-		inputToCopyFloat = float64(stream.inputBuffer.Len())
+		inputToCopy = stream.inputBuffer.Len()
+		inputToCopyFloat = float64(inputToCopy)
+	}
+	if stream.tune != nil {
+		// The auto-tune stage needs the pitch of the copied input too.
+		var moved int
+		if moved, err = stream.copyPeriods(inputToCopy); err == nil {
+			err = stream.inputBuffer.MoveTo(stream.outputBuffer, inputToCopy-moved)
+		}
+	} else if inputToCopy == stream.inputBuffer.Len() {
 		err = stream.inputBuffer.MoveAllTo(stream.outputBuffer)
 	} else {
 		err = stream.inputBuffer.MoveTo(stream.outputBuffer, inputToCopy)
 	}
+	stream.noteStep(PeriodCopied, inputToCopy, inputToCopy)
 
 	stream.timeError += inputToCopyFloat * stream.samplePeriod * (speed - 1.0) / speed
 	return err
@@ -377,6 +584,9 @@ func (stream *Stream) moveUnmodifiedSamples(speed float64) error {
 
 // processStreamInput proccesses inputBuffer sampled changing its speed, rate, pitch, volume
 func (stream *Stream) processStreamInput() error {
+	if err := stream.skipInput(); err != nil {
+		return err
+	}
 	InputLen := stream.inputBuffer.Len()
 	if InputLen == 0 {
 		return nil
@@ -391,6 +601,10 @@ func (stream *Stream) processStreamInput() error {
 		if err := stream.changeSpeed(speed); err != nil {
 			return err
 		}
+	} else if stream.tune != nil {
+		if err := stream.copyInput(); err != nil {
+			return err
+		}
 	} else {
 		if err := stream.moveInputToOutput(); err != nil {
 			return err
@@ -407,9 +621,43 @@ func (stream *Stream) processStreamInput() error {
 		}
 	}
 
-	if stream.volume != 1.0 && OutputLen < stream.outputBuffer.Len() {
-		fixedPointVolume := int(stream.volume * 256.0)
-		if err := stream.outputBuffer.Scale(OutputLen, fixedPointVolume); err != nil {
+	if stream.tune != nil {
+		stream.tune.tuner.place(stream.tune.end(), OutputLen, rate)
+		if OutputLen < stream.outputBuffer.Len() {
+			if err := stream.harmonize(stream.tune, OutputLen); err != nil {
+				return err
+			}
+		}
+	}
+
+	if stream.harmony != nil && OutputLen < stream.outputBuffer.Len() {
+		if err := stream.harmonize(stream.harmony, OutputLen); err != nil {
+			return err
+		}
+	}
+
+	if err := stream.finishOutput(OutputLen); err != nil {
+		return err
+	}
+	if err := stream.continueOutput(OutputLen); err != nil {
+		return err
+	}
+	stream.keepOutput(stream.outputBuffer.Len() - OutputLen)
+	stream.produced += stream.outputBuffer.Len() - OutputLen
+	stream.noteOutput()
+	return nil
+}
+
+// finishOutput runs the output produced since position at through the volume and loudness stages.
+func (stream *Stream) finishOutput(at int) error {
+	if stream.volume != 1.0 && at < stream.outputBuffer.Len() {
+		if err := stream.scaleOutput(at); err != nil {
+			return err
+		}
+	}
+
+	if stream.loudness != nil && at < stream.outputBuffer.Len() {
+		if err := stream.normalize(at); err != nil {
 			return err
 		}
 	}
@@ -481,8 +729,10 @@ func (stream *Stream) interpolatePitchValue(n, c, old, new int) int16 {
 
 	// It is better to clip than to wrap if there was an overflow.
 	if overflowCount > 0 {
+		stream.stats.RateClips++
 		return ShrtMax
 	} else if overflowCount < 0 {
+		stream.stats.RateClips++
 		return ShrtMin
 	}
 
@@ -537,6 +787,7 @@ func (stream *Stream) changeSpeed(speed float64) error {
 				if err != nil {
 					return err
 				}
+				stream.noteStep(PeriodSkipped, newSamples+period, newSamples)
 				if speed < 2 {
 					stream.timeError += float64(newSamples)*stream.samplePeriod - float64(period+newSamples)*playtime/float64(samplesNum)
 				}
@@ -545,6 +796,7 @@ func (stream *Stream) changeSpeed(speed float64) error {
 				if err != nil {
 					return err
 				}
+				stream.noteStep(PeriodInserted, newSamples, newSamples)
 				if speed > 0.5 {
 					stream.timeError += float64(period+newSamples)*stream.samplePeriod - float64(newSamples)*playtime/float64(samplesNum)
 				}
@@ -607,38 +859,84 @@ func (stream *Stream) insertPitchPeriod(speed float64, period int) (int, error)
 // overlapAdd overlaps two sound segments, ramp the volume of one down, while ramping the
 // other one from zero up, and add them, storing the result at the output.
 func (stream *Stream) overlapAdd(numSamples int, period int) error {
+	ch := stream.numChannels
 	cur, _ := stream.outputBuffer.WriteEmpty(numSamples)
+	out, err := stream.outputBuffer.Buffer.GetSliceAtN(cur*ch, numSamples*ch)
+	if err != nil {
+		return err
+	}
+	in, err := stream.inputBuffer.GetSlice(period + numSamples)
+	if err != nil {
+		return err
+	}
+	down, up := in[:numSamples*ch], in[period*ch:]
 
-	for i := 0; i < numSamples; i++ {
-		for c := 0; c < stream.numChannels; c++ {
-			dv, _ := stream.inputBuffer.GetChannel(i, c)
-			uv, _ := stream.inputBuffer.GetChannel(i+period, c)
-
-			if UseSinOverlap == true {
-				ratio := math.Sin(float64(i) * math.Pi / (2 * float64(numSamples)))
-				stream.outputBuffer.SetChannel(cur+i, c, int16(float64(dv)*(1.0-ratio)+float64(uv)*ratio))
-			} else {
-				stream.outputBuffer.SetChannel(cur+i, c, int16((int(dv)*(numSamples-i)+int(uv)*i)/numSamples))
-			}
-		}
+	if stream.window > WindowLinear && int(stream.window) < len(windowTables) {
+		overlapAddWindow(windowTables[stream.window], out, down, up, ch, numSamples)
+		return nil
 	}
+	simd.OverlapAdd(out, down, up, ch, numSamples)
 	return nil
 }
 
 func (stream *Stream) findPitchPeriod(preferNewPeriod bool) (int, error) {
-	var period, minDiff, maxDiff, ret int
+	var ret int
+
+	period, minDiff, maxDiff, err := stream.measurePitchPeriod()
+	if err != nil {
+		return 0, err
+	}
+
+	previous := stream.prevPeriodBetter(minDiff, maxDiff, preferNewPeriod)
+	if previous {
+		ret = stream.prevPeriod
+	} else {
+		ret = period
+	}
+	stream.notePeriod(period, ret, minDiff, maxDiff, previous)
+	stream.noteTunePeriod(ret, minDiff, maxDiff)
+
+	stream.prevMinDiff = minDiff
+	stream.prevPeriod = period
+
+	return ret, nil
+}
+
+// measurePitchPeriod finds the pitch period at the start of the input near the previous period
+// while the tracking search is confident, and in the whole pitch range otherwise.
+func (stream *Stream) measurePitchPeriod() (int, int, int, error) {
+	period, minDiff, maxDiff, ok, err := stream.trackPitchPeriod()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if !ok {
+		if period, minDiff, maxDiff, err = stream.searchPitchPeriod(); err != nil {
+			return 0, 0, 0, err
+		}
+		stream.trackMinDiff = minDiff
+		stream.tracked = 0
+	}
+	return period, minDiff, maxDiff, nil
+}
+
+// searchPitchPeriod searches the whole pitch range with the pitch estimator, first on down-sampled
+// input and then with AMDF around the result at the full rate.
+func (stream *Stream) searchPitchPeriod() (int, int, int, error) {
+	var period, minDiff, maxDiff int
 
 	minPeriod := stream.minPeriod
 	maxPeriod := stream.maxPeriod
 	skip := stream.computeSkip()
 
 	if stream.numChannels == 1 && skip == 1 {
-		period, minDiff, maxDiff = findPitchPeriodInRange(stream.inputBuffer, minPeriod, maxPeriod)
+		period, minDiff, maxDiff = stream.estimatePeriod(stream.inputBuffer, minPeriod, maxPeriod)
+		stream.trackMaxDiff = maxDiff
 	} else {
 		if err := stream.downSampleInput(skip); err != nil {
-			return 0, err
+			return 0, 0, 0, err
 		}
-		period, minDiff, maxDiff = findPitchPeriodInRange(stream.downSampleBuffer, minPeriod/skip, maxPeriod/skip)
+		period, minDiff, maxDiff = stream.estimatePeriod(stream.downSampleBuffer, minPeriod/skip, maxPeriod/skip)
+		stream.trackMaxDiff = maxDiff
 
 		if skip != 1 {
 			period *= skip
@@ -654,23 +952,75 @@ func (stream *Stream) findPitchPeriod(preferNewPeriod bool) (int, error) {
 				period, minDiff, maxDiff = findPitchPeriodInRange(stream.inputBuffer, minPeriod, maxPeriod)
 			} else {
 				if err := stream.downSampleInput(1); err != nil {
-					return 0, err
+					return 0, 0, 0, err
 				}
 				period, minDiff, maxDiff = findPitchPeriodInRange(stream.downSampleBuffer, minPeriod, maxPeriod)
 			}
 		}
 	}
+	return period, minDiff, maxDiff, nil
+}
 
-	if stream.prevPeriodBetter(minDiff, maxDiff, preferNewPeriod) {
-		ret = stream.prevPeriod
-	} else {
-		ret = period
+const (
+	// trackWindow sets the half width of the tracking search to 1/trackWindow of the previous
+	// period. Voiced speech rarely moves more than that from one period to the next.
+	trackWindow = 32
+	// trackRefresh is how many tracked periods run between full searches, so that the
+	// confidence reference stays current and octave jumps are picked up.
+	trackRefresh = 16
+)
+
+// trackPitchPeriod searches at the full rate in a window around the previous period, widening it
+// once if the best match lies on its edge. The match is accepted while it stays confident: its
+// minimum difference is well below the maximum difference over the whole pitch range found by the
+// last full search, or not much above that search's minimum difference. A match whose half period
+// fits as well is rejected, so that the search does not lock onto a multiple of the period.
+// trackPitchPeriod reports false when tracking is off, the estimator is not AMDF or the match is
+// rejected; the caller then runs the full search.
+func (stream *Stream) trackPitchPeriod() (int, int, int, bool, error) {
+	prev := stream.prevPeriod
+	if !stream.pitchTracking || prev == 0 || stream.tracked >= trackRefresh {
+		return 0, 0, 0, false, nil
+	}
+	if _, ok := stream.estimator.(AMDFEstimator); !ok {
+		return 0, 0, 0, false, nil
 	}
 
-	stream.prevMinDiff = minDiff
-	stream.prevPeriod = period
+	buf := stream.inputBuffer
+	if stream.numChannels > 1 {
+		if err := stream.downSampleInput(1); err != nil {
+			return 0, 0, 0, false, err
+		}
+		buf = stream.downSampleBuffer
+	}
 
-	return ret, nil
+	// Where the last full search found no clear period either, as in noise, a minimum on the
+	// edge of the window is not worth widening for.
+	noisy := stream.trackMaxDiff <= 3*stream.trackMinDiff
+
+	half := prev/trackWindow + 2
+	for widen := 0; widen < 2; widen++ {
+		minPeriod := max(prev-half, stream.minPeriod)
+		maxPeriod := min(prev+half, stream.maxPeriod)
+		period, minDiff, maxDiff := findPitchPeriodInRange(buf, minPeriod, maxPeriod)
+		if !noisy && ((period == minPeriod && minPeriod > stream.minPeriod) || (period == maxPeriod && maxPeriod < stream.maxPeriod)) {
+			half *= 2
+			continue
+		}
+
+		confident := !noisy && minDiff*3 < stream.trackMaxDiff
+		if !confident && minDiff*4 > stream.trackMinDiff*5 {
+			break
+		}
+		if half := period / 2; half-2 >= stream.minPeriod {
+			if _, halfDiff, _ := findPitchPeriodInRange(buf, half-2, half+2); halfDiff <= minDiff {
+				break
+			}
+		}
+		stream.tracked++
+		return period, minDiff, max(maxDiff, stream.trackMaxDiff), true, nil
+	}
+	return 0, 0, 0, false, nil
 }
 
 // prevPeriodBetter detects At abrupt ends of voiced words, we can have pitch periods that are better
@@ -728,21 +1078,73 @@ func (stream *Stream) downSampleInput(skip int) error {
 	return nil
 }
 
+// estimatePeriod runs the pitch estimator of the stream on a mono buffer.
+func (stream *Stream) estimatePeriod(b *SampleBuffer, minP, maxP int) (int, int, int) {
+	samples, _ := b.GetSlice(2 * maxP)
+	return stream.estimator.EstimatePeriod(samples, minP, maxP)
+}
+
 // findPitchPeriodInRange finds the best frequency match in the range, and given a sample skip multiple.
 // For now, just find the pitch of the first channel.
 func findPitchPeriodInRange(b *SampleBuffer, minP, maxP int) (int, int, int) {
 	samples, _ := b.GetSlice(2 * maxP)
+	return AMDFEstimator{}.EstimatePeriod(samples, minP, maxP)
+}
+
+// findPitchPeriodC runs the scalar C pitch period search.
+func findPitchPeriodC(samples []int16, minP, maxP int) (int, int, int) {
 	result := C.findPitchPeriod((*C.int16_t)(&samples[0]), C.int(minP), C.int(maxP))
 	return int(result.bestPeriod), int(result.minDiff), int(result.maxDiff)
 }
 
+// findPitchPeriodAMDF is the C findPitchPeriod written around simd.AMDF.
+func findPitchPeriodAMDF(samples []int16, minP, maxP int) (int, int, int) {
+	bestPeriod, worstPeriod := 0, 255
+	minDiff, maxDiff := 1, 0
+
+	for period := minP; period <= maxP; period++ {
+		diff := simd.AMDF(samples[:period], samples[period:2*period])
+
+		if bestPeriod == 0 || diff*bestPeriod < minDiff*period {
+			minDiff = diff
+			bestPeriod = period
+		}
+
+		if diff*worstPeriod > maxDiff*period {
+			maxDiff = diff
+			worstPeriod = period
+		}
+	}
+
+	return bestPeriod, minDiff / bestPeriod, maxDiff / worstPeriod
+}
+
 // Flush forces the sonic stream to generate output using whatever data it currently has.
 // No extra delay will be added to the output, but flushing in the middle of words could introduce distortion.
 func (stream *Stream) Flush() error {
+	// A Discard that is still waiting for input ends here.
+	if err := stream.skipInput(); err != nil {
+		return err
+	}
+	if stream.discard > 0 {
+		stream.discard, stream.seekSkip = 0, 0
+	}
+	stream.noteInput(stream.produced+stream.pendingOutput(), 0)
+
 	maxReq := stream.maxRequired
 	speed := stream.speed / stream.pitch
 	rate := stream.rate * stream.pitch
 	expOutput := stream.outputBuffer.Len() + int(math.Round((float64(stream.inputBuffer.Len())/speed+float64(stream.pitchBuffer.Len()))/rate+0.5))
+	if stream.tune != nil {
+		expOutput += stream.tune.pending()
+	}
+	if stream.harmony != nil {
+		expOutput += stream.harmony.pending()
+	}
+	if stream.loudness != nil {
+		expOutput += stream.loudness.pending()
+	}
+	expOutput = max(expOutput-stream.seekSkip, stream.outputBuffer.Len())
 
 	if err := stream.AddEmptySamples(2 * maxReq * stream.numChannels); err != nil {
 		return err
@@ -751,10 +1153,52 @@ func (stream *Stream) Flush() error {
 	if err := stream.processStreamInput(); err != nil {
 		return err
 	}
+	drained := stream.outputBuffer.Len()
+
+	if stream.tune != nil {
+		at := stream.outputBuffer.Len()
+		if err := stream.outputBuffer.WriteSlice(stream.tune.drain()); err != nil {
+			return err
+		}
+		if stream.harmony != nil {
+			if err := stream.harmonize(stream.harmony, at); err != nil {
+				return err
+			}
+		}
+		if err := stream.finishOutput(at); err != nil {
+			return err
+		}
+	}
+
+	if stream.harmony != nil {
+		at := stream.outputBuffer.Len()
+		if err := stream.outputBuffer.WriteSlice(stream.harmony.drain()); err != nil {
+			return err
+		}
+		if err := stream.finishOutput(at); err != nil {
+			return err
+		}
+	}
+
+	if stream.loudness != nil {
+		if err := stream.outputBuffer.WriteSlice(stream.loudness.drain()); err != nil {
+			return err
+		}
+	}
+
+	if err := stream.continueOutput(drained); err != nil {
+		return err
+	}
 
 	if stream.outputBuffer.Len() > expOutput {
 		stream.outputBuffer.Truncate(expOutput)
 	}
+	stream.keepOutput(stream.outputBuffer.Len() - drained)
+	stream.produced += stream.outputBuffer.Len() - drained
+	stream.noteOutput()
+	for i := range stream.markersOut {
+		stream.markersOut[i].Pos = min(stream.markersOut[i].Pos, stream.produced)
+	}
 
 	stream.inputPlaytime = 0
 	stream.timeError = 0
@@ -764,27 +1208,48 @@ func (stream *Stream) Flush() error {
 
 // AddSamples adds int16 samples to the inputBuffer
 func (stream *Stream) AddSamples(samples []int16) error {
+	if err := stream.reserve(len(samples)); err != nil {
+		return err
+	}
+	at := stream.produced + stream.pendingOutput()
 	if err := stream.inputBuffer.AddSamples(samples); err != nil {
 		return err
 	}
+	stream.ptsInFrames += len(samples) / stream.numChannels
+	stream.noteInput(at, len(samples)/stream.numChannels)
+	stream.noteWrite()
 	stream.inputPlaytime = float64(stream.inputSamplesLen()) * stream.samplePeriod / (stream.speed / stream.pitch)
 	return nil
 }
 
 // AddSamples coverts float64 samples to the int16 samples and add them to the inputBuffer
 func (stream *Stream) AddFloatSamples(samples []float64) error {
+	if err := stream.reserve(len(samples)); err != nil {
+		return err
+	}
+	at := stream.produced + stream.pendingOutput()
 	if err := stream.inputBuffer.AddFloatSamples(samples); err != nil {
 		return err
 	}
+	stream.ptsInFrames += len(samples) / stream.numChannels
+	stream.noteInput(at, len(samples)/stream.numChannels)
+	stream.noteWrite()
 	stream.inputPlaytime = float64(stream.inputSamplesLen()) * stream.samplePeriod / (stream.speed / stream.pitch)
 	return nil
 }
 
 // AddSamples coverts uint8 samples to the int16 samples and add them to the inputBuffer
 func (stream *Stream) AddByteSamples(samples []uint8) error {
+	if err := stream.reserve(len(samples)); err != nil {
+		return err
+	}
+	at := stream.produced + stream.pendingOutput()
 	if err := stream.inputBuffer.AddByteSamples(samples); err != nil {
 		return err
 	}
+	stream.ptsInFrames += len(samples) / stream.numChannels
+	stream.noteInput(at, len(samples)/stream.numChannels)
+	stream.noteWrite()
 	stream.inputPlaytime = float64(stream.inputSamplesLen()) * stream.samplePeriod / (stream.speed / stream.pitch)
 	return nil
 }
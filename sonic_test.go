@@ -12,16 +12,21 @@
 package sonic
 
 import (
+	"errors"
 	"fmt"
 	"github.com/go-audio/audio"
 	"github.com/go-audio/wav"
 	"log"
 	"math"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"slices"
 	"testing"
 	"time"
 	"unsafe"
+
+	"github.com/alttagil/sonic-go/internal/simd"
 )
 
 func TestSpeed(t *testing.T) {
@@ -68,6 +73,246 @@ func TestSpeed2(t *testing.T) {
 	}
 }
 
+func TestParameterRanges(t *testing.T) {
+	stream := NewSonicStream(8000, 1)
+	for _, v := range []float64{0, -1, math.NaN(), math.Inf(1)} {
+		stream.SetSpeed(v)
+		stream.SetPitch(v)
+		stream.SetRate(v)
+	}
+	stream.SetVolume(-1)
+	stream.SetVolumeDB(math.NaN())
+	stream.SetClipMode(ClipCubic + 1)
+	if stream.GetSpeed() != 1 || stream.GetPitch() != 1 || stream.GetRate() != 1 || stream.GetVolume() != 1 || stream.GetClipMode() != ClipHard {
+		t.Error("out of range parameters were accepted")
+	}
+
+	// A volume of 0 mutes.
+	stream.SetVolume(0)
+	if stream.GetVolume() != 0 {
+		t.Errorf("volume %v, want 0", stream.GetVolume())
+	}
+}
+
+func TestChangeSpeedToDuration(t *testing.T) {
+	w, sampleRate, channels, err := readWAV("./testdata/OSR_us_000_0010_8k.wav")
+	if err != nil {
+		t.Fatalf("reading error: %v", err)
+	}
+	maxPeriod := sampleRate / MinPitch
+
+	for _, tt := range []struct {
+		target      time.Duration
+		pitch, rate float64
+		wantFrames  int
+		wantPasses  int
+	}{
+		{target: 10 * time.Second, pitch: 1, rate: 1, wantFrames: 80000, wantPasses: 2},
+		{target: 45 * time.Second, pitch: 1, rate: 1, wantFrames: 360000, wantPasses: 1},
+		{target: 12500 * time.Millisecond, pitch: 1.2, rate: 1.1, wantFrames: 100000, wantPasses: 1},
+		{target: 3750 * time.Millisecond, pitch: 1.2, rate: 1.1, wantFrames: 30000, wantPasses: 2},
+	} {
+		// Before the trim or padding the output is within a pitch period of the target.
+		fitted, passes, err := fitLength(sampleRate, channels, tt.pitch, tt.rate, 1, append([]int16(nil), w...), tt.wantFrames)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := abs(len(fitted)/channels - tt.wantFrames); d > maxPeriod || passes != tt.wantPasses {
+			t.Errorf("target %v: %d frames off after %d passes, want at most %d after %d", tt.target, d, passes, maxPeriod, tt.wantPasses)
+		}
+
+		in := append([]int16(nil), w...)
+		out, err := ChangeSpeedToDuration(sampleRate, channels, tt.pitch, tt.rate, 1, in, tt.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out) != tt.wantFrames*channels {
+			t.Errorf("target %v: got %d samples, want %d", tt.target, len(out), tt.wantFrames*channels)
+		}
+		if m := min(len(fitted), len(out)); !slices.Equal(out[:m], fitted[:m]) || slices.ContainsFunc(out[m:], func(v int16) bool { return v != 0 }) {
+			t.Errorf("target %v: the output is not the fitted output trimmed or padded with silence", tt.target)
+		}
+	}
+
+	if _, err := ChangeSpeedToDuration(sampleRate, channels, 1, 1, 1, w, 0); err != ErrDuration {
+		t.Errorf("expected ErrDuration for a zero target, got %v", err)
+	}
+	for _, tt := range []struct {
+		target time.Duration
+		rate   float64
+	}{
+		{10 * time.Second, 0},
+		{10 * time.Second, -1},
+		{10 * time.Second, math.NaN()},
+		{10 * time.Second, math.Inf(1)},
+		{time.Millisecond, 1},
+		{time.Hour, 1},
+	} {
+		if _, err := ChangeSpeedToDuration(sampleRate, channels, 1, tt.rate, 1, w, tt.target); !errors.Is(err, ErrDuration) {
+			t.Errorf("target %v, rate %v: expected ErrDuration, got %v", tt.target, tt.rate, err)
+		}
+	}
+}
+
+// steadyStateConfigs are the stream settings the allocation tests run with.
+var steadyStateConfigs = []struct {
+	name  string
+	setup func(*Stream)
+}{
+	{"passthrough", func(s *Stream) {}},
+	{"speedup", func(s *Stream) { s.SetSpeed(1.7) }},
+	{"slowdown", func(s *Stream) { s.SetSpeed(0.6) }},
+	{"fast", func(s *Stream) { s.SetSpeed(3.2) }},
+	{"pitch", func(s *Stream) { s.SetPitch(1.3) }},
+	{"rate", func(s *Stream) { s.SetRate(0.8); s.SetSpeed(1.2) }},
+	{"quality", func(s *Stream) { s.SetQuality(true); s.SetSpeed(1.5) }},
+	{"tracking", func(s *Stream) { s.SetPitchTracking(true); s.SetSpeed(1.5) }},
+	{"yin", func(s *Stream) { s.SetPitchEstimator(YINEstimator{}); s.SetSpeed(1.5) }},
+	{"nacf", func(s *Stream) { s.SetPitchEstimator(NACFEstimator{}); s.SetSpeed(0.7) }},
+	{"window", func(s *Stream) { s.SetWindow(WindowHann); s.SetSpeed(1.5) }},
+	{"harmony", func(s *Stream) {
+		_ = s.SetHarmony(0.7, Voice{Semitones: 4, Gain: 0.5}, Voice{Semitones: 7, Detune: 5, Gain: 0.4})
+		s.SetSpeed(1.5)
+	}},
+	{"autotune", func(s *Stream) {
+		_ = s.SetAutoTune(AutoTune{Scale: ScaleMajor, Speed: 20 * time.Millisecond})
+		s.SetSpeed(1.2)
+	}},
+	{"volume", func(s *Stream) { s.SetVolumeDB(4); s.SetClipMode(ClipTanh) }},
+	{"normalize", func(s *Stream) { s.SetSpeed(1.4); s.SetNormalization(-16, DefaultTruePeak) }},
+}
+
+func TestReadAllCopies(t *testing.T) {
+	stream := NewSonicStream(8000, 1)
+	frame := make([]int16, 160)
+	var outs [][]int16
+	for i := 0; i < 8; i++ {
+		for j := range frame {
+			frame[j] = int16(i)
+		}
+		if err := stream.Write(frame); err != nil {
+			t.Fatal(err)
+		}
+		out, err := stream.ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		outs = append(outs, out)
+	}
+	for i, out := range outs {
+		if len(out) != len(frame) || slices.ContainsFunc(out, func(v int16) bool { return v != int16(i) }) {
+			t.Errorf("ReadAll result %d changed by later writes", i)
+		}
+	}
+}
+
+// steadyStateFrame writes a 20ms frame and reads all output into out.
+func steadyStateFrame(stream *Stream, frame, out []int16) error {
+	if err := stream.Write(frame); err != nil {
+		return err
+	}
+	for {
+		if _, err := stream.ReadTo(out); err != nil {
+			return nil
+		}
+	}
+}
+
+func TestSteadyStateAllocs(t *testing.T) {
+	for _, channels := range []int{1, 2} {
+		for _, cfg := range steadyStateConfigs {
+			t.Run(fmt.Sprintf("%s/%dch", cfg.name, channels), func(t *testing.T) {
+				stream := NewSonicStream(48000, channels)
+				cfg.setup(stream)
+				frame := make([]int16, 960*channels)
+				for i := range frame {
+					frame[i] = int16(8000 * math.Sin(float64(i/channels)*0.05))
+				}
+				out := make([]int16, len(frame))
+
+				// Warm up until the buffers reach their working size.
+				for i := 0; i < 100; i++ {
+					if err := steadyStateFrame(stream, frame, out); err != nil {
+						t.Fatal(err)
+					}
+				}
+				allocs := testing.AllocsPerRun(200, func() {
+					if err := steadyStateFrame(stream, frame, out); err != nil {
+						t.Fatal(err)
+					}
+				})
+				if allocs != 0 {
+					t.Errorf("%v allocations per frame, want 0", allocs)
+				}
+			})
+		}
+	}
+}
+
+func TestSteadyStateAllocsConverted(t *testing.T) {
+	stream := NewSonicStream(16000, 1)
+	stream.SetSpeed(1.5)
+	floats := make([]float64, 320)
+	bytes := make([]uint8, 320)
+	ints := &audio.IntBuffer{Format: &audio.Format{NumChannels: 1, SampleRate: 16000}, Data: make([]int, 320)}
+	for i := range floats {
+		floats[i] = 0.3 * math.Sin(float64(i)*0.1)
+		bytes[i] = uint8(128 + 40*math.Sin(float64(i)*0.1))
+		ints.Data[i] = int(10000 * math.Sin(float64(i)*0.1))
+	}
+	out := make([]int16, 320)
+	read := func() {
+		for {
+			if _, err := stream.ReadTo(out); err != nil {
+				return
+			}
+		}
+	}
+	run := func() {
+		if err := stream.WriteFloats(floats); err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.WriteBytes(bytes); err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.WriteAudioBuffer(ints); err != nil {
+			t.Fatal(err)
+		}
+		read()
+	}
+	for i := 0; i < 100; i++ {
+		run()
+	}
+	if allocs := testing.AllocsPerRun(200, run); allocs != 0 {
+		t.Errorf("%v allocations per frame, want 0", allocs)
+	}
+}
+
+func BenchmarkSteadyState(b *testing.B) {
+	for _, cfg := range steadyStateConfigs {
+		b.Run(cfg.name, func(b *testing.B) {
+			stream := NewSonicStream(48000, 1)
+			cfg.setup(stream)
+			frame := make([]int16, 960)
+			for i := range frame {
+				frame[i] = int16(8000 * math.Sin(float64(i)*0.05))
+			}
+			out := make([]int16, len(frame))
+			for i := 0; i < 100; i++ {
+				_ = steadyStateFrame(stream, frame, out)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := steadyStateFrame(stream, frame, out); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
 func BenchmarkSonic(b *testing.B) {
 	w, sampleRate, channels, err := readWAV("./testdata/OSR_us_000_0010_8k.wav")
 	if err != nil {
@@ -185,6 +430,27 @@ func dumpPCM(samplerate, channels int, pcm []int16, filename string) error {
 	return nil
 }
 
+func FuzzFindPitchPeriod(f *testing.F) {
+	f.Add(int64(1), 20, 80, int16(30000))
+	f.Add(int64(2), 120, 180, int16(200))
+	f.Fuzz(func(t *testing.T, seed int64, minP, maxP int, amp int16) {
+		// Keep the periods small enough for the int arithmetic of the C code not to overflow.
+		if minP < 1 || maxP < minP || maxP > 160 || amp <= 0 {
+			return
+		}
+		r := rand.New(rand.NewSource(seed))
+		samples := make([]int16, 2*maxP)
+		for i := range samples {
+			samples[i] = int16(r.Intn(2*int(amp)+1) - int(amp))
+		}
+		p, minDiff, maxDiff := findPitchPeriodAMDF(samples, minP, maxP)
+		cp, cMinDiff, cMaxDiff := findPitchPeriodC(samples, minP, maxP)
+		if p != cp || minDiff != cMinDiff || maxDiff != cMaxDiff {
+			t.Errorf("got (%d, %d, %d), C code (%d, %d, %d)", p, minDiff, maxDiff, cp, cMinDiff, cMaxDiff)
+		}
+	})
+}
+
 func BenchmarkFindPitchPeriod(b *testing.B) {
 	Period := []int16{-16, -15, -13, -15, -16, -17, -16, -16, -14, -11, -9, -9, -9, -6, -9, -10, -9, -8, -5, -5, -6,
 		-11, -14, -11, -9, -8, -7, -8, -11, -14, -16, -17, -19, -18, -14, -12, -10, -7, -8, -14, -16, -11, -7, -4, -3,
@@ -207,7 +473,12 @@ func BenchmarkFindPitchPeriod(b *testing.B) {
 
 	b.Run("cgo", func(b *testing.B) {
 		for i := 0; i < b.N; i++ {
-			findPitchPeriodInRange(B, 120, 180)
+			findPitchPeriodC(Period, 120, 180)
+		}
+	})
+	b.Run("simd", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			findPitchPeriodAMDF(Period, 120, 180)
 		}
 	})
 	b.Run("native", func(b *testing.B) {
@@ -380,3 +651,89 @@ func findPitchPeriodInRangeNativeUnsafe(b *SampleBuffer, minP, maxP int) (int, i
 
 	return bestPeriod, int(minDiff / uint64(bestPeriod)), int(maxDiff / uint64(worstPeriod))
 }
+
+// upsample resamples samples by an integer factor with linear interpolation.
+func upsample(samples []int16, factor int) []int16 {
+	out := make([]int16, 0, len(samples)*factor)
+	for i := 0; i+1 < len(samples); i++ {
+		for j := 0; j < factor; j++ {
+			out = append(out, int16((int(samples[i])*(factor-j)+int(samples[i+1])*j)/factor))
+		}
+	}
+	return out
+}
+
+func TestPitchTracking(t *testing.T) {
+	w, _, _, err := readWAV("./testdata/OSR_us_000_0010_8k.wav")
+	if err != nil {
+		t.Fatalf("reading error: %v", err)
+	}
+	in := upsample(w, 6)
+	full := NewSonicStream(48000, 1)
+	tracking := NewSonicStream(48000, 1)
+	tracking.SetPitchTracking(true)
+
+	// Walk through the input by the periods of the full search. At each position, the mismatch
+	// between a period and the next one is what overlap-add has to blend; tracking may pick a
+	// different period, but the total mismatch must stay close to that of the full search.
+	var mismatch [2]int
+	total, tracked := 0, 0
+	for pos := 0; pos+full.maxRequired <= len(in); total++ {
+		var periods [2]int
+		for i, stream := range []*Stream{full, tracking} {
+			stream.inputBuffer.Truncate(0)
+			_ = stream.inputBuffer.WriteSlice(in[pos : pos+stream.maxRequired])
+			if periods[i], err = stream.findPitchPeriod(true); err != nil {
+				t.Fatal(err)
+			}
+			p := periods[i]
+			mismatch[i] += simd.AMDF(in[pos:pos+p], in[pos+p:pos+2*p]) / p
+		}
+		if tracking.tracked > 0 {
+			tracked++
+		}
+		pos += periods[0]
+	}
+	if mismatch[1]*10 > mismatch[0]*11 {
+		t.Errorf("mismatch %d with tracking, %d without, want within 10%%", mismatch[1], mismatch[0])
+	}
+	if tracked*2 < total {
+		t.Errorf("only %d of %d periods were tracked", tracked, total)
+	}
+
+	data, _ := tracking.MarshalBinary()
+	restored := &Stream{}
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	clone := tracking.Clone(true)
+	for _, s := range []*Stream{restored, clone} {
+		if !s.GetPitchTracking() || s.tracked != tracking.tracked || s.trackMinDiff != tracking.trackMinDiff || s.trackMaxDiff != tracking.trackMaxDiff {
+			t.Error("tracking state was not copied")
+		}
+	}
+}
+
+func BenchmarkPitchTracking(b *testing.B) {
+	w, _, _, err := readWAV("./testdata/OSR_us_000_0010_8k.wav")
+	if err != nil {
+		b.Fatalf("reading error: %v", err)
+	}
+	in := upsample(w, 6)
+	for _, tracking := range []bool{false, true} {
+		b.Run(fmt.Sprintf("tracking=%v", tracking), func(b *testing.B) {
+			stream := NewSonicStream(48000, 1)
+			stream.SetSpeed(1.5)
+			stream.SetPitchTracking(tracking)
+			out := make([]int16, 960)
+			b.SetBytes(int64(2 * len(in)))
+			for i := 0; i < b.N; i++ {
+				for off := 0; off+960 <= len(in); off += 960 {
+					if err := steadyStateFrame(stream, in[off:off+960], out); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonic
+
+// Stats are counters of the processing of a stream since it was created or Reset. Sample counts
+// are per channel.
+type Stats struct {
+	// InputSamples is the number of samples written, not counting Seek pre-rolls, and
+	// OutputSamples the number of samples produced, not counting output dropped by Seek and
+	// Discard.
+	InputSamples  uint64
+	OutputSamples uint64
+
+	// SkippedPeriods and InsertedPeriods count the pitch periods, or parts of them at speeds of 2
+	// and more or 0.5 and less, that the time stretch dropped and repeated.
+	SkippedPeriods  uint64
+	InsertedPeriods uint64
+
+	// UnmodifiedCopies counts the runs of input the time stretch copied to the output unchanged
+	// between periods, and UnmodifiedSamples their samples.
+	UnmodifiedCopies  uint64
+	UnmodifiedSamples uint64
+
+	// Periods is the number of pitch period searches and AveragePitch the mean of the pitches
+	// they found in input that was not silent, in Hz. PreviousPeriods counts the searches whose result was replaced by the
+	// previous period, as at the abrupt end of a voiced sound.
+	Periods         uint64
+	AveragePitch    float64
+	PreviousPeriods uint64
+
+	// VolumeClips is the number of samples the volume stage drove past full scale, as reported
+	// by GetClipCount, and RateClips the number of samples the rate converter clipped because
+	// its sum overflowed, which only happens where int has 32 bits.
+	VolumeClips uint64
+	RateClips   uint64
+
+	// MaxInputSamples and MaxOutputSamples are the most samples the input and output buffers held.
+	MaxInputSamples  uint64
+	MaxOutputSamples uint64
+}
+
+// PeriodAction is what the time stretch did with a stretch of input.
+type PeriodAction int
+
+const (
+	// PeriodSkipped means a pitch period was dropped, crossfading the one before into the one after.
+	PeriodSkipped PeriodAction = iota
+	// PeriodInserted means a pitch period was repeated, crossfading it into its repetition.
+	PeriodInserted
+	// PeriodCopied means input was copied to the output unchanged.
+	PeriodCopied
+)
+
+// String returns the name of the action.
+func (a PeriodAction) String() string {
+	switch a {
+	case PeriodSkipped:
+		return "skipped"
+	case PeriodInserted:
+		return "inserted"
+	case PeriodCopied:
+		return "copied"
+	}
+	return "unknown"
+}
+
+// PeriodEvent describes a step of the time stretch.
+type PeriodEvent struct {
+	Action PeriodAction
+	// Pos is the input sample the step starts at, counted over all input the time stretch
+	// processed, including Seek pre-rolls and the silence Flush pads the input with.
+	Pos int
+	// Samples is the number of samples the step crossfaded or copied.
+	Samples int
+	// Period is the pitch period used and MinDiff and MaxDiff the mismatches of the search that
+	// found it, on the scale of the pitch estimator. Previous is set if the previous period was
+	// used instead of the one found. They are zero for PeriodCopied.
+	Period   int
+	MinDiff  int
+	MaxDiff  int
+	Previous bool
+}
+
+// Observer receives the steps of the time stretch, for tracing. It is called synchronously
+// from Write and Flush and must not use the stream.
+type Observer interface {
+	ObservePeriod(e PeriodEvent)
+}
+
+// ObserverFunc adapts a function to an Observer.
+type ObserverFunc func(e PeriodEvent)
+
+// ObservePeriod implements Observer.
+func (f ObserverFunc) ObservePeriod(e PeriodEvent) {
+	f(e)
+}
+
+// Stats returns the processing counters of the stream.
+func (stream *Stream) Stats() Stats {
+	s := stream.stats
+	s.InputSamples = uint64(stream.written)
+	s.OutputSamples = uint64(stream.produced)
+	if stream.pitchCount > 0 {
+		s.AveragePitch = stream.pitchSum / float64(stream.pitchCount)
+	}
+	return s
+}
+
+// GetObserver returns the observer of the stream, or nil.
+func (stream *Stream) GetObserver() Observer {
+	return stream.observer
+}
+
+// SetObserver sets an observer that receives every step of the time stretch. nil removes it.
+// Clones do not inherit the observer.
+func (stream *Stream) SetObserver(o Observer) {
+	stream.observer = o
+}
+
+// notePeriod counts a pitch period search that found period and used the previous period instead
+// if previous is set.
+func (stream *Stream) notePeriod(period, used, minDiff, maxDiff int, previous bool) {
+	stream.stats.Periods++
+	if maxDiff > 0 {
+		stream.pitchSum += float64(stream.sampleRate) / float64(period)
+		stream.pitchCount++
+	}
+	if previous {
+		stream.stats.PreviousPeriods++
+	}
+	stream.event = PeriodEvent{Period: used, MinDiff: minDiff, MaxDiff: maxDiff, Previous: previous}
+}
+
+// noteStep counts a step of the time stretch that consumed input samples and crossfaded or
+// copied samples, and passes it to the observer. For skipped and inserted periods it completes
+// the event of the last search.
+func (stream *Stream) noteStep(action PeriodAction, consumed, samples int) {
+	switch action {
+	case PeriodSkipped:
+		stream.stats.SkippedPeriods++
+	case PeriodInserted:
+		stream.stats.InsertedPeriods++
+	case PeriodCopied:
+		stream.stats.UnmodifiedCopies++
+		stream.stats.UnmodifiedSamples += uint64(samples)
+		stream.event = PeriodEvent{}
+	}
+	pos := stream.consumed
+	stream.consumed += consumed
+	if stream.observer == nil {
+		return
+	}
+	e := stream.event
+	e.Action, e.Pos, e.Samples = action, pos, samples
+	stream.observer.ObservePeriod(e)
+}
+
+// noteWrite records the number of samples held by the input buffer.
+func (stream *Stream) noteWrite() {
+	stream.stats.MaxInputSamples = max(stream.stats.MaxInputSamples, uint64(stream.inputBuffer.Len()))
+}
+
+// noteOutput records the number of samples held by the output buffer.
+func (stream *Stream) noteOutput() {
+	stream.stats.MaxOutputSamples = max(stream.stats.MaxOutputSamples, uint64(stream.outputBuffer.Len()))
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonic
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	w, sampleRate, _, err := readWAV("./testdata/OSR_us_000_0010_8k.wav")
+	if err != nil {
+		t.Fatalf("reading error: %v", err)
+	}
+	w = w[:len(w)/4]
+
+	for _, speed := range []float64{1.5, 0.7} {
+		stream := NewSonicStream(sampleRate, 1)
+		stream.SetSpeed(speed)
+		var events []PeriodEvent
+		stream.SetObserver(ObserverFunc(func(e PeriodEvent) { events = append(events, e) }))
+		out := processChunks(t, stream, w, 1000)
+
+		s := stream.Stats()
+		if s.InputSamples != uint64(len(w)) || s.OutputSamples != uint64(len(out)) {
+			t.Errorf("speed %v: %d samples in and %d out, want %d and %d", speed, s.InputSamples, s.OutputSamples, len(w), len(out))
+		}
+		if s.MaxInputSamples < 1000 || s.MaxOutputSamples == 0 {
+			t.Errorf("speed %v: high-water marks %d and %d", speed, s.MaxInputSamples, s.MaxOutputSamples)
+		}
+		if s.AveragePitch < MinPitch || s.AveragePitch > MaxPitch {
+			t.Errorf("speed %v: average pitch %.1f Hz", speed, s.AveragePitch)
+		}
+		if s.Periods != s.SkippedPeriods+s.InsertedPeriods || s.UnmodifiedCopies == 0 || s.PreviousPeriods > s.Periods {
+			t.Errorf("speed %v: %+v", speed, s)
+		}
+		if (speed > 1) != (s.SkippedPeriods > 0) || (speed < 1) != (s.InsertedPeriods > 0) {
+			t.Errorf("speed %v: %d periods skipped and %d inserted", speed, s.SkippedPeriods, s.InsertedPeriods)
+		}
+
+		// The events add up to the counters and follow each other through the input.
+		var counts [3]uint64
+		var previous uint64
+		for i, e := range events {
+			counts[e.Action]++
+			if e.Previous {
+				previous++
+			}
+			consumed := e.Samples
+			if e.Action == PeriodSkipped {
+				consumed += e.Period
+			}
+			if i+1 < len(events) && events[i+1].Pos != e.Pos+consumed {
+				t.Fatalf("speed %v: event %d %+v followed by %+v", speed, i, e, events[i+1])
+			}
+		}
+		if counts != [3]uint64{s.SkippedPeriods, s.InsertedPeriods, s.UnmodifiedCopies} || previous != s.PreviousPeriods {
+			t.Errorf("speed %v: events %v and %d previous, stats %+v", speed, counts, previous, s)
+		}
+	}
+}
+
+func TestStatsCounters(t *testing.T) {
+	const sampleRate = 16000
+
+	// The average pitch of a steady tone is its pitch.
+	stream := NewSonicStream(sampleRate, 1)
+	stream.SetSpeed(1.3)
+	processChunks(t, stream, harmonic(sampleRate, 200, 1, 1000, 0, sampleRate), 500)
+	if got := stream.Stats().AveragePitch; math.Abs(got-200) > 4 {
+		t.Errorf("average pitch %.1f Hz, want 200 Hz", got)
+	}
+
+	// A full-scale square wave overshoots in the rate converter, which overflows a 32-bit int,
+	// and in the volume stage.
+	square := make([]int16, sampleRate)
+	for i := range square {
+		square[i] = math.MaxInt16
+		if i/40%2 == 1 {
+			square[i] = math.MinInt16
+		}
+	}
+	stream = NewSonicStream(sampleRate, 1)
+	stream.SetRate(1.3)
+	stream.SetVolume(1.5)
+	processChunks(t, stream, square, 500)
+	s := stream.Stats()
+	if (strconv.IntSize == 32) != (s.RateClips > 0) || s.VolumeClips == 0 || s.VolumeClips != stream.GetClipCount() {
+		t.Errorf("%d rate and %d volume clips", s.RateClips, s.VolumeClips)
+	}
+
+	data, _ := stream.MarshalBinary()
+	restored := &Stream{}
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Stats() != s || stream.Clone(true).Stats() != s {
+		t.Error("restored or cloned stream counters differ")
+	}
+	stream.Reset()
+	if stream.Stats() != (Stats{}) {
+		t.Errorf("counters after Reset %+v", stream.Stats())
+	}
+}
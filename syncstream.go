@@ -0,0 +1,136 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonic
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrClosed is returned by a SyncStream after Close.
+var ErrClosed = errors.New("stream is closed")
+
+// SyncStream wraps a Stream for use by a producer and a consumer running in different goroutines.
+// When the stream has capacity limits, Write blocks until the consumer has read enough output
+// instead of failing with ErrBufferFull.
+type SyncStream struct {
+	mu     sync.Mutex
+	stream *Stream
+	closed bool
+
+	// changed is closed and replaced whenever space may have been freed
+	// while waiting writers are blocked.
+	changed chan struct{}
+	waiting int
+}
+
+// NewSyncStream wraps stream. The stream must not be used directly afterwards.
+func NewSyncStream(stream *Stream) *SyncStream {
+	return &SyncStream{stream: stream, changed: make(chan struct{})}
+}
+
+// Write writes samples to the stream, blocking while they do not fit into its capacity limits.
+// It returns ErrBufferFull right away if the samples could not fit even into empty buffers.
+func (s *SyncStream) Write(samples []int16) error {
+	return s.WriteContext(context.Background(), samples)
+}
+
+// WriteContext is like Write, but gives up when ctx is done.
+func (s *SyncStream) WriteContext(ctx context.Context, samples []int16) error {
+	s.mu.Lock()
+	for {
+		if s.closed {
+			s.mu.Unlock()
+			return ErrClosed
+		}
+		err := s.stream.Write(samples)
+		if err != ErrBufferFull || !s.stream.fits(len(samples)) {
+			s.mu.Unlock()
+			return err
+		}
+
+		changed := s.changed
+		s.waiting++
+		s.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+		}
+		s.mu.Lock()
+		s.waiting--
+		if err := ctx.Err(); err != nil {
+			s.mu.Unlock()
+			return err
+		}
+	}
+}
+
+// ReadTo reads output into s like Stream.ReadTo and wakes up a blocked writer.
+func (s *SyncStream) ReadTo(out []int16) ([]int16, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out, err := s.stream.ReadTo(out)
+	if len(out) > 0 {
+		s.notify()
+	}
+	return out, err
+}
+
+// Flush flushes the stream like Stream.Flush.
+func (s *SyncStream) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	return s.stream.Flush()
+}
+
+// Writable returns how many samples per channel the stream can currently accept.
+func (s *SyncStream) Writable() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stream.Writable()
+}
+
+// Do calls fn with the stream locked, for example to change its parameters. The stream must not
+// be retained after fn returns.
+func (s *SyncStream) Do(fn func(stream *Stream)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(s.stream)
+	s.notify()
+}
+
+// Close makes blocked and later writes fail with ErrClosed. Output still buffered can be read.
+func (s *SyncStream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		s.notify()
+	}
+	return nil
+}
+
+// notify wakes up writers waiting for space. It must be called with mu held.
+func (s *SyncStream) notify() {
+	if s.waiting == 0 {
+		return
+	}
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
@@ -0,0 +1,139 @@
+/* Copyright (c) 2023 Alexander Khudich
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License. */
+
+/* refgen writes the output of the reference C Sonic library for the conformance tests.
+
+     refgen in.wav out.raw frames speed pitch rate volume quality
+
+   It processes the first frames frames of a 16-bit PCM WAV file in a single write followed by a
+   flush, and writes the output as raw interleaved 16-bit little-endian samples. Build it against
+   a checkout of https://github.com/waywardgeek/sonic:
+
+     cc -O2 -o refgen refgen.c $SONIC/sonic.c -I$SONIC -lm
+*/
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+
+#include "sonic.h"
+
+static unsigned readLE(const unsigned char* p, int n) {
+  unsigned v = 0;
+  int i;
+  for (i = n - 1; i >= 0; i--) {
+    v = (v << 8) | p[i];
+  }
+  return v;
+}
+
+/* readWAV reads the samples of a 16-bit PCM WAV file, skipping chunks other than fmt and data. */
+static short* readWAV(const char* path, int* sampleRate, int* numChannels, int* numFrames) {
+  FILE* f = fopen(path, "rb");
+  unsigned char hdr[12], chunk[8], fmt[16];
+  short* samples = NULL;
+  int haveFmt = 0;
+  if (f == NULL) {
+    return NULL;
+  }
+  if (fread(hdr, 1, 12, f) != 12 || memcmp(hdr, "RIFF", 4) || memcmp(hdr + 8, "WAVE", 4)) {
+    fclose(f);
+    return NULL;
+  }
+  while (fread(chunk, 1, 8, f) == 8) {
+    unsigned size = readLE(chunk + 4, 4);
+    if (!memcmp(chunk, "fmt ", 4) && size >= 16) {
+      if (fread(fmt, 1, 16, f) != 16) {
+        break;
+      }
+      if (readLE(fmt, 2) != 1 || readLE(fmt + 14, 2) != 16) {
+        break;
+      }
+      *numChannels = readLE(fmt + 2, 2);
+      *sampleRate = readLE(fmt + 4, 4);
+      haveFmt = 1;
+      fseek(f, size - 16 + (size & 1), SEEK_CUR);
+    } else if (!memcmp(chunk, "data", 4) && haveFmt) {
+      unsigned i, n = size / 2;
+      unsigned char* raw = malloc(size);
+      samples = malloc(n * sizeof(short));
+      if (raw == NULL || samples == NULL || fread(raw, 1, size, f) != size) {
+        free(raw);
+        free(samples);
+        samples = NULL;
+        break;
+      }
+      for (i = 0; i < n; i++) {
+        samples[i] = (short)readLE(raw + 2 * i, 2);
+      }
+      free(raw);
+      *numFrames = n / *numChannels;
+      break;
+    } else {
+      fseek(f, size + (size & 1), SEEK_CUR);
+    }
+  }
+  fclose(f);
+  return samples;
+}
+
+int main(int argc, char** argv) {
+  int sampleRate, numChannels, numFrames, frames, n, i;
+  short* samples;
+  short buf[4096];
+  unsigned char out[sizeof(buf)];
+  sonicStream stream;
+  FILE* f;
+
+  if (argc != 9) {
+    fprintf(stderr, "usage: refgen in.wav out.raw frames speed pitch rate volume quality\n");
+    return 2;
+  }
+  samples = readWAV(argv[1], &sampleRate, &numChannels, &numFrames);
+  if (samples == NULL) {
+    fprintf(stderr, "refgen: cannot read %s\n", argv[1]);
+    return 1;
+  }
+  frames = atoi(argv[3]);
+  if (frames > numFrames) {
+    frames = numFrames;
+  }
+
+  stream = sonicCreateStream(sampleRate, numChannels);
+  sonicSetSpeed(stream, atof(argv[4]));
+  sonicSetPitch(stream, atof(argv[5]));
+  sonicSetRate(stream, atof(argv[6]));
+  sonicSetVolume(stream, atof(argv[7]));
+  sonicSetQuality(stream, atoi(argv[8]));
+  if (!sonicWriteShortToStream(stream, samples, frames) || !sonicFlushStream(stream)) {
+    fprintf(stderr, "refgen: out of memory\n");
+    return 1;
+  }
+
+  f = fopen(argv[2], "wb");
+  if (f == NULL) {
+    fprintf(stderr, "refgen: cannot create %s\n", argv[2]);
+    return 1;
+  }
+  while ((n = sonicReadShortFromStream(stream, buf, sizeof(buf) / sizeof(short) / numChannels)) > 0) {
+    for (i = 0; i < n * numChannels; i++) {
+      out[2 * i] = (unsigned char)buf[i];
+      out[2 * i + 1] = (unsigned char)((unsigned short)buf[i] >> 8);
+    }
+    fwrite(out, 2, n * numChannels, f);
+  }
+  sonicDestroyStream(stream);
+  free(samples);
+  return fclose(f) != 0;
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonic
+
+import "math"
+
+// ClipMode selects how the volume stage handles samples driven past full scale.
+type ClipMode int
+
+const (
+	// ClipHard clamps samples to the int16 range. It is the default.
+	ClipHard ClipMode = iota
+	// ClipTanh passes samples below the knee unchanged and saturates louder ones with a tanh curve.
+	ClipTanh
+	// ClipCubic is like ClipTanh with a cheaper cubic curve that reaches full scale at 1.5 times
+	// the headroom above the knee.
+	ClipCubic
+)
+
+// clipKnee is the level, relative to full scale, above which the soft clippers start to bend.
+// At -1 dBFS it leaves all but the loudest peaks of a signal untouched.
+const clipKnee = 0.891
+
+// valid reports whether m is one of the clip modes above.
+func (m ClipMode) valid() bool {
+	return m >= ClipHard && m <= ClipCubic
+}
+
+// String returns the name of the clip mode.
+func (m ClipMode) String() string {
+	switch m {
+	case ClipHard:
+		return "hard"
+	case ClipTanh:
+		return "tanh"
+	case ClipCubic:
+		return "cubic"
+	}
+	return "unknown"
+}
+
+// GetVolumeDB returns the volume of the stream in decibels.
+func (stream *Stream) GetVolumeDB() float64 {
+	return 20 * math.Log10(stream.volume)
+}
+
+// SetVolumeDB sets the volume in decibels. 0 leaves the volume unchanged, -6 halves it.
+// Unlike a volume set with SetVolume, it is applied in floating point, so that even small
+// volumes keep their precision. -Inf mutes the stream; NaN and +Inf are ignored.
+func (stream *Stream) SetVolumeDB(db float64) {
+	if volume := math.Pow(10, db/20); validVolume(volume) {
+		stream.volume = volume
+		stream.volumeDB = true
+	}
+}
+
+// GetClipMode returns how samples exceeding full scale after the volume stage are handled.
+func (stream *Stream) GetClipMode() ClipMode {
+	return stream.clipMode
+}
+
+// SetClipMode sets how samples exceeding full scale after the volume stage are handled. Unknown
+// modes are ignored.
+func (stream *Stream) SetClipMode(mode ClipMode) {
+	if mode.valid() {
+		stream.clipMode = mode
+	}
+}
+
+// GetClipCount returns the number of samples the volume stage drove past full scale since the
+// stream was created or Reset. With a soft clip mode they were saturated rather than clamped.
+func (stream *Stream) GetClipCount() uint64 {
+	return stream.stats.VolumeClips
+}
+
+// scaleOutput applies the volume to the output produced since position at. A volume set with
+// SetVolume is hard clipped in 8-bit fixed point as before; a volume in decibels and the soft
+// clip modes work in floating point, rounding to the nearest sample.
+func (stream *Stream) scaleOutput(at int) error {
+	if !stream.volumeDB && stream.clipMode == ClipHard {
+		clips, err := stream.outputBuffer.scale(at, int(stream.volume*256.0))
+		stream.stats.VolumeClips += clips
+		return err
+	}
+
+	slice, err := stream.outputBuffer.ReadSliceAt(at)
+	if err != nil {
+		return err
+	}
+
+	volume := stream.volume
+	for i, s := range slice {
+		v := volume * float64(s)
+		if v > ShrtMax || v < ShrtMin {
+			stream.stats.VolumeClips++
+		}
+		switch stream.clipMode {
+		case ClipTanh:
+			v = softClip(v/32768, tanhCurve) * 32768
+		case ClipCubic:
+			v = softClip(v/32768, cubicCurve) * 32768
+		}
+		slice[i] = clampInt16(math.Round(v))
+	}
+	return stream.outputBuffer.WriteSlice(slice)
+}
+
+// softClip leaves x unchanged up to clipKnee and maps the range above it through curve, which
+// takes and returns values normalized to the headroom above the knee.
+func softClip(x float64, curve func(float64) float64) float64 {
+	a := math.Abs(x)
+	if a <= clipKnee {
+		return x
+	}
+	y := clipKnee + (1-clipKnee)*curve((a-clipKnee)/(1-clipKnee))
+	return math.Copysign(y, x)
+}
+
+// tanhCurve is a tanh saturator with unity slope at zero.
+func tanhCurve(u float64) float64 {
+	return math.Tanh(u)
+}
+
+// cubicCurve is u - 4/27 u³, which has unity slope at zero and flattens out at 1 for u = 1.5.
+func cubicCurve(u float64) float64 {
+	if u >= 1.5 {
+		return 1
+	}
+	return u - 4.0/27.0*u*u*u
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonic
+
+import (
+	"math"
+	"testing"
+)
+
+func scaled(t *testing.T, stream *Stream, in []int16) []int16 {
+	t.Helper()
+	if err := stream.Write(in); err != nil {
+		t.Fatal(err)
+	}
+	out, err := stream.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestVolumeRounding(t *testing.T) {
+	in := []int16{0, 1, -1, 3, -3, 255, -255, 1000, -1000, 12345, -12345, 32767, -32768}
+	for _, factor := range []int{1, 77, 128, 300, 512, 1000} {
+		// A linear volume with hard clipping keeps the 8-bit fixed-point scaling.
+		stream := NewSonicStream(8000, 1)
+		stream.SetVolume(float64(factor) / 256)
+		out := scaled(t, stream, in)
+		for i, v := range in {
+			if want := clampInt16(float64(factor * int(v) >> 8)); out[i] != want {
+				t.Errorf("volume %d/256: sample %d scaled to %d, want %d", factor, v, out[i], want)
+			}
+		}
+
+		// The soft clip modes scale in floating point and round to the nearest sample.
+		stream = NewSonicStream(8000, 1)
+		stream.SetVolume(float64(factor) / 256)
+		stream.SetClipMode(ClipCubic)
+		out = scaled(t, stream, in[:9])
+		for i, v := range in[:9] {
+			if want := clampInt16(math.Round(float64(factor) * float64(v) / 256)); out[i] != want {
+				t.Errorf("volume %d/256 with soft clipping: sample %d scaled to %d, want %d", factor, v, out[i], want)
+			}
+		}
+	}
+}
+
+func TestVolumeDB(t *testing.T) {
+	stream := NewSonicStream(8000, 1)
+	stream.SetVolumeDB(-60)
+	if got := stream.GetVolumeDB(); math.Abs(got+60) > 1e-9 {
+		t.Errorf("GetVolumeDB %v, want -60", got)
+	}
+	// A 1/256 fixed-point volume would silence this entirely.
+	out := scaled(t, stream, []int16{30000, -30000})
+	if out[0] != 30 || out[1] != -30 {
+		t.Errorf("got %v, want [30 -30]", out)
+	}
+}
+
+func TestClipModes(t *testing.T) {
+	in := make([]int16, 2001)
+	for i := range in {
+		in[i] = int16((i - 1000) * 32)
+	}
+
+	for _, mode := range []ClipMode{ClipHard, ClipTanh, ClipCubic} {
+		t.Run(mode.String(), func(t *testing.T) {
+			stream := NewSonicStream(8000, 1)
+			stream.SetVolume(3)
+			stream.SetClipMode(mode)
+			out := scaled(t, stream, in)
+
+			// Samples past 32767/3 overdrive the stage.
+			if got := stream.GetClipCount(); got != 1318 {
+				t.Errorf("clip count %d, want 1318", got)
+			}
+			for i := 1; i < len(out); i++ {
+				if out[i] < out[i-1] {
+					t.Fatalf("output not monotonic at %d: %d < %d", i, out[i], out[i-1])
+				}
+			}
+			if mode != ClipHard {
+				// Below the knee at -1 dBFS the signal is untouched, and it approaches full
+				// scale smoothly.
+				if out[1000+100] != 9600 || out[1000+300] != 28800 {
+					t.Errorf("samples below the knee changed to %d and %d", out[1000+100], out[1000+300])
+				}
+				if out[1000+351] >= ShrtMax {
+					t.Errorf("soft clipper saturated at 1.03 times full scale")
+				}
+			}
+
+			stream.Reset()
+			if stream.GetClipCount() != 0 {
+				t.Error("Reset did not clear the clip count")
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonic
+
+import "math"
+
+// Window selects the crossfade curves overlap-add uses to blend one pitch period into the next.
+type Window int
+
+const (
+	// WindowLinear ramps the volumes linearly. It is the default and the fastest window.
+	WindowLinear Window = iota
+	// WindowSine ramps the new period up along a quarter sine and the old one down by the rest,
+	// like the original Sonic with USE_SIN_OVERLAP.
+	WindowSine
+	// WindowHann crossfades with the two halves of a Hann window, which start and end smoothly.
+	WindowHann
+	// WindowEqualPower crossfades along a quarter sine and cosine. It keeps the power of
+	// uncorrelated periods constant but boosts correlated ones by up to 3 dB in the middle.
+	WindowEqualPower
+	// WindowRaisedCosine holds the old period for the first quarter, crossfades with a Hann curve
+	// over the middle half and holds the new period for the last quarter: a Tukey window with a
+	// roll-off of one half.
+	WindowRaisedCosine
+)
+
+// String returns the name of the window.
+func (w Window) String() string {
+	switch w {
+	case WindowLinear:
+		return "linear"
+	case WindowSine:
+		return "sine"
+	case WindowHann:
+		return "hann"
+	case WindowEqualPower:
+		return "equal-power"
+	case WindowRaisedCosine:
+		return "raised-cosine"
+	}
+	return "unknown"
+}
+
+// weights returns the volumes of the old and the new period at x in [0, 1] of the crossfade.
+func (w Window) weights(x float64) (float64, float64) {
+	switch w {
+	case WindowSine:
+		up := math.Sin(x * math.Pi / 2)
+		return 1 - up, up
+	case WindowHann:
+		up := 0.5 - 0.5*math.Cos(x*math.Pi)
+		return 1 - up, up
+	case WindowEqualPower:
+		return math.Cos(x * math.Pi / 2), math.Sin(x * math.Pi / 2)
+	case WindowRaisedCosine:
+		x = min(max(2*x-0.5, 0), 1)
+		up := 0.5 - 0.5*math.Cos(x*math.Pi)
+		return 1 - up, up
+	}
+	return 1 - x, x
+}
+
+const (
+	// windowTableBits sets the number of steps in the window tables. A crossfade uses the step at
+	// or before its position, which is off the exact curve by less than -60 dB.
+	windowTableBits = 12
+	windowTableSize = 1 << windowTableBits
+	// windowOne is the fixed-point value of a weight of 1.0.
+	windowOne = 1 << 15
+)
+
+// windowTable holds the weights of the old and the new period in Q15 fixed point.
+type windowTable struct {
+	down, up [windowTableSize + 1]int32
+}
+
+// windowTables holds the tables of the windows other than WindowLinear, indexed by Window.
+var windowTables = func() []*windowTable {
+	tables := make([]*windowTable, WindowRaisedCosine+1)
+	for w := WindowSine; w <= WindowRaisedCosine; w++ {
+		t := &windowTable{}
+		for k := range t.up {
+			down, up := w.weights(float64(k) / windowTableSize)
+			t.down[k] = int32(math.Round(down * windowOne))
+			t.up[k] = int32(math.Round(up * windowOne))
+		}
+		tables[w] = t
+	}
+	return tables
+}()
+
+// overlapAddWindow is overlapAdd with the table of a non-linear window. The position in the table
+// advances in 16.16 fixed point so that the inner loop does not divide.
+func overlapAddWindow(t *windowTable, out, down, up []int16, ch, n int) {
+	down, up = down[:len(out)], up[:len(out)]
+	step := (windowTableSize << 16) / n
+	pos := 0
+	for j := 0; j < len(out); j += ch {
+		k := pos >> 16
+		wd, wu := int(t.down[k]), int(t.up[k])
+		for c := j; c < j+ch; c++ {
+			v := (int(down[c])*wd + int(up[c])*wu + windowOne/2) >> 15
+			out[c] = int16(min(max(v, ShrtMin), ShrtMax))
+		}
+		pos += step
+	}
+}
+
+// GetWindow returns the crossfade window of overlap-add.
+func (stream *Stream) GetWindow() Window {
+	return stream.window
+}
+
+// SetWindow sets the crossfade window of overlap-add. It can be changed at any time.
+func (stream *Stream) SetWindow(w Window) {
+	stream.window = w
+}
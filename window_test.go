@@ -0,0 +1,141 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sonic
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+var windows = []Window{WindowLinear, WindowSine, WindowHann, WindowEqualPower, WindowRaisedCosine}
+
+// windowFade runs the overlap-add of a stream with the given window on down and up.
+func windowFade(w Window, down, up []int16) []int16 {
+	stream := NewSonicStream(8000, 1)
+	stream.SetWindow(w)
+	n := len(down)
+	_ = stream.inputBuffer.WriteSlice(append(append([]int16{}, down...), up...))
+	_ = stream.overlapAdd(n, n)
+	out, _ := stream.outputBuffer.Flush()
+	return out
+}
+
+func TestWindowTables(t *testing.T) {
+	for _, w := range windows {
+		worst := 0.0
+		for _, n := range []int{3, 20, 123, 738, 1000, 5000} {
+			ones := make([]int16, n)
+			zeros := make([]int16, n)
+			for i := range ones {
+				ones[i] = ShrtMax
+			}
+			fadeOut, fadeIn := windowFade(w, ones, zeros), windowFade(w, zeros, ones)
+			for i := 0; i < n; i++ {
+				down, up := w.weights(float64(i) / float64(n))
+				worst = max(worst, math.Abs(float64(fadeOut[i])/ShrtMax-down), math.Abs(float64(fadeIn[i])/ShrtMax-up))
+			}
+		}
+		t.Logf("%s: weights within %.1f dB", w, 20*math.Log10(worst))
+		if worst > 1e-3 {
+			t.Errorf("%s: weight error %g, want below 1e-3", w, worst)
+		}
+	}
+}
+
+// TestWindowQuality compares the windows on the two kinds of period pairs overlap-add blends:
+// correlated periods, as in steady voiced speech, should keep their level, and uncorrelated ones,
+// as in noise, should keep their power.
+func TestWindowQuality(t *testing.T) {
+	const n = 1000
+	rng := rand.New(rand.NewSource(1))
+	same := make([]int16, n)
+	noise := [2][]int16{make([]int16, n), make([]int16, n)}
+	for i := 0; i < n; i++ {
+		same[i] = 10000
+		noise[0][i] = int16(4000 * rng.NormFloat64())
+		noise[1][i] = int16(4000 * rng.NormFloat64())
+	}
+
+	for _, w := range windows {
+		// Largest deviation from the input level of a crossfade between identical periods.
+		gain := 0.0
+		for _, v := range windowFade(w, same, same) {
+			gain = max(gain, math.Abs(20*math.Log10(float64(v)/10000)))
+		}
+
+		// Power in the middle of a crossfade between independent noise periods.
+		out := windowFade(w, noise[0], noise[1])
+		var in, mid float64
+		for i := n*4/10 - 1; i < n*6/10; i++ {
+			in += (float64(noise[0][i])*float64(noise[0][i]) + float64(noise[1][i])*float64(noise[1][i])) / 2
+			mid += float64(out[i]) * float64(out[i])
+		}
+		power := 10 * math.Log10(mid/in)
+		t.Logf("%-13s correlated: %4.2f dB off, uncorrelated: %5.2f dB", w, gain, power)
+
+		if w == WindowEqualPower {
+			if gain < 2.5 || math.Abs(power) > 1 {
+				t.Errorf("%s: %.2f dB off for correlated, %.2f dB for uncorrelated input", w, gain, power)
+			}
+		} else if gain > 0.01 || power > -1 {
+			t.Errorf("%s: %.2f dB off for correlated, %.2f dB for uncorrelated input", w, gain, power)
+		}
+	}
+}
+
+func TestWindowState(t *testing.T) {
+	stream := NewSonicStream(16000, 1)
+	stream.SetWindow(WindowHann)
+	restored := &Stream{}
+	data, _ := stream.MarshalBinary()
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []*Stream{restored, stream.Clone(false)} {
+		if s.GetWindow() != WindowHann {
+			t.Errorf("window %s, want %s", s.GetWindow(), WindowHann)
+		}
+	}
+	if got := Window(99).String(); got != "unknown" {
+		t.Errorf("Window(99) is %q", got)
+	}
+}
+
+func BenchmarkWindow(b *testing.B) {
+	for _, w := range windows {
+		b.Run(w.String(), func(b *testing.B) {
+			stream := NewSonicStream(48000, 1)
+			stream.SetWindow(w)
+			stream.SetSpeed(1.5)
+			frame := make([]int16, 960)
+			for i := range frame {
+				frame[i] = int16(8000 * math.Sin(float64(i)*0.05))
+			}
+			out := make([]int16, len(frame))
+			for i := 0; i < 100; i++ {
+				_ = steadyStateFrame(stream, frame, out)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := steadyStateFrame(stream, frame, out); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,419 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package wsstream serves sonic streams over WebSocket for real-time clients
+// such as browsers.
+//
+// A session starts with a JSON text message negotiating the audio format and
+// the initial parameters:
+//
+//	{"sample_rate": 16000, "channels": 1, "format": "s16le", "speed": 1.5}
+//
+// The server answers with {"type": "ready"}. After that the client sends
+// interleaved PCM in binary messages and receives processed PCM in binary
+// messages of the same format. Text messages control the session:
+//
+//	{"type": "params", "speed": 2, "pitch": 1, "rate": 1, "volume": 1}
+//	{"type": "flush"}
+//
+// A flush pushes out everything buffered by the stream and is acknowledged
+// with {"type": "flushed"}. Errors are reported with {"type": "error",
+// "error": "..."} right before the connection is closed.
+package wsstream
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/alttagil/sonic-go"
+	"github.com/gorilla/websocket"
+)
+
+// Sample formats accepted in the initial message.
+const (
+	FormatS16LE = "s16le"
+	FormatF32LE = "f32le"
+)
+
+var (
+	// ErrBadFormat is reported when the initial message describes an unsupported format.
+	ErrBadFormat = errors.New("wsstream: unsupported audio format")
+	// ErrBadParams is reported when speed, pitch, rate or volume are out of range.
+	ErrBadParams = errors.New("wsstream: invalid stream parameters")
+	// ErrBadMessage is reported for malformed control or audio messages.
+	ErrBadMessage = errors.New("wsstream: malformed message")
+)
+
+// Config is the initial message of a session.
+type Config struct {
+	SampleRate int    `json:"sample_rate"`
+	Channels   int    `json:"channels"`
+	Format     string `json:"format"`
+	Params
+}
+
+// Params are the processing parameters. Absent (nil) fields leave the current setting unchanged.
+type Params struct {
+	Speed   *float64 `json:"speed,omitempty"`
+	Pitch   *float64 `json:"pitch,omitempty"`
+	Rate    *float64 `json:"rate,omitempty"`
+	Volume  *float64 `json:"volume,omitempty"`
+	Quality *bool    `json:"quality,omitempty"`
+}
+
+// control is a text message exchanged after the session has started.
+type control struct {
+	Type  string `json:"type"`
+	Error string `json:"error,omitempty"`
+	Params
+}
+
+// Handler upgrades HTTP requests to WebSocket sessions backed by a sonic Stream.
+type Handler struct {
+	// Upgrader performs the WebSocket handshake. Set CheckOrigin to accept cross-origin browsers.
+	Upgrader websocket.Upgrader
+
+	// MaxMessageSize limits the size of a single client message in bytes.
+	MaxMessageSize int64
+
+	// FrameSamples is the maximum number of samples per channel in a single output message.
+	FrameSamples int
+
+	// OutputQueue is the number of output messages that may wait to be sent.
+	// Once it is full the handler stops reading from the client until the
+	// client consumes output, which propagates backpressure over TCP.
+	OutputQueue int
+
+	// HandshakeTimeout bounds the time to receive the initial message.
+	HandshakeTimeout time.Duration
+
+	// WriteTimeout bounds the time to send a single message.
+	WriteTimeout time.Duration
+}
+
+// NewHandler creates a Handler with default limits.
+func NewHandler() *Handler {
+	return &Handler{
+		MaxMessageSize:   1 << 20,
+		FrameSamples:     1024,
+		OutputQueue:      32,
+		HandshakeTimeout: 10 * time.Second,
+		WriteTimeout:     10 * time.Second,
+	}
+}
+
+// ServeHTTP upgrades the connection and runs the session until either side closes it.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := h.Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already replied to the client.
+		return
+	}
+	defer conn.Close()
+
+	if h.MaxMessageSize > 0 {
+		conn.SetReadLimit(h.MaxMessageSize)
+	}
+
+	s := &session{h: h, conn: conn}
+	s.run()
+}
+
+// outMessage is a message queued for the writer goroutine.
+type outMessage struct {
+	kind int
+	data []byte
+}
+
+// session is a single WebSocket connection.
+type session struct {
+	h      *Handler
+	conn   *websocket.Conn
+	stream *sonic.Stream
+	format string
+	frame  int
+
+	out  chan outMessage
+	done chan struct{}
+	werr error
+}
+
+// run negotiates the session and pumps messages until the connection ends.
+func (s *session) run() {
+	cfg, err := s.handshake()
+	if err != nil {
+		s.closeWithError(err)
+		return
+	}
+
+	s.stream = sonic.NewSonicStream(cfg.SampleRate, cfg.Channels)
+	s.format = cfg.Format
+	s.frame = s.h.FrameSamples
+	if s.frame <= 0 {
+		s.frame = 1024
+	}
+	applyParams(s.stream, cfg.Params)
+
+	queue := s.h.OutputQueue
+	if queue <= 0 {
+		queue = 1
+	}
+	s.out = make(chan outMessage, queue)
+	s.done = make(chan struct{})
+	go s.writer()
+
+	err = s.reader()
+	close(s.out)
+	<-s.done
+
+	if err != nil && !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+		s.closeWithError(err)
+		return
+	}
+	s.close(websocket.CloseNormalClosure, "")
+}
+
+// handshake reads and validates the initial message.
+func (s *session) handshake() (Config, error) {
+	var cfg Config
+	if s.h.HandshakeTimeout > 0 {
+		_ = s.conn.SetReadDeadline(time.Now().Add(s.h.HandshakeTimeout))
+	}
+	kind, data, err := s.conn.ReadMessage()
+	if err != nil {
+		return cfg, err
+	}
+	_ = s.conn.SetReadDeadline(time.Time{})
+
+	if kind != websocket.TextMessage || json.Unmarshal(data, &cfg) != nil {
+		return cfg, ErrBadMessage
+	}
+	if cfg.Format == "" {
+		cfg.Format = FormatS16LE
+	}
+	if cfg.Format != FormatS16LE && cfg.Format != FormatF32LE {
+		return cfg, fmt.Errorf("%w %q", ErrBadFormat, cfg.Format)
+	}
+	if cfg.SampleRate < 1000 || cfg.SampleRate > 384000 || cfg.Channels < 1 || cfg.Channels > 32 {
+		return cfg, ErrBadFormat
+	}
+	if err := validateParams(cfg.Params); err != nil {
+		return cfg, err
+	}
+
+	if err := s.writeNow(websocket.TextMessage, mustJSON(control{Type: "ready"})); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// reader processes client messages until the connection fails or is closed.
+func (s *session) reader() error {
+	for {
+		kind, data, err := s.conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		switch kind {
+		case websocket.BinaryMessage:
+			if err := s.writeAudio(data); err != nil {
+				return err
+			}
+		case websocket.TextMessage:
+			var msg control
+			if err := json.Unmarshal(data, &msg); err != nil {
+				return ErrBadMessage
+			}
+			if err := s.handleControl(msg); err != nil {
+				return err
+			}
+		}
+
+		if err := s.drain(); err != nil {
+			return err
+		}
+	}
+}
+
+// handleControl applies a control message.
+func (s *session) handleControl(msg control) error {
+	switch msg.Type {
+	case "params":
+		if err := validateParams(msg.Params); err != nil {
+			return err
+		}
+		applyParams(s.stream, msg.Params)
+	case "flush":
+		if err := s.stream.Flush(); err != nil {
+			return err
+		}
+		if err := s.drain(); err != nil {
+			return err
+		}
+		return s.send(websocket.TextMessage, mustJSON(control{Type: "flushed"}))
+	default:
+		return fmt.Errorf("%w: unknown type %q", ErrBadMessage, msg.Type)
+	}
+	return nil
+}
+
+// writeAudio decodes a binary message and feeds it to the stream.
+func (s *session) writeAudio(data []byte) error {
+	ch := s.stream.GetNumChannels()
+	switch s.format {
+	case FormatF32LE:
+		if len(data)%(4*ch) != 0 {
+			return ErrBadMessage
+		}
+		samples := make([]float64, len(data)/4)
+		for i := range samples {
+			samples[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:])))
+		}
+		return s.stream.WriteFloats(samples)
+	default:
+		if len(data)%(2*ch) != 0 {
+			return ErrBadMessage
+		}
+		samples := make([]int16, len(data)/2)
+		for i := range samples {
+			samples[i] = int16(binary.LittleEndian.Uint16(data[2*i:]))
+		}
+		return s.stream.Write(samples)
+	}
+}
+
+// drain queues all available output. It blocks while the output queue is full.
+func (s *session) drain() error {
+	for s.stream.NumOutputSamples() > 0 {
+		samples, err := s.stream.Read(s.frame)
+		if err != nil {
+			return err
+		}
+		if err := s.send(websocket.BinaryMessage, s.encode(samples)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encode converts samples to the negotiated wire format.
+func (s *session) encode(samples []int16) []byte {
+	if s.format == FormatF32LE {
+		data := make([]byte, 4*len(samples))
+		for i, v := range samples {
+			binary.LittleEndian.PutUint32(data[4*i:], math.Float32bits(float32(v)/32767.0))
+		}
+		return data
+	}
+	data := make([]byte, 2*len(samples))
+	for i, v := range samples {
+		binary.LittleEndian.PutUint16(data[2*i:], uint16(v))
+	}
+	return data
+}
+
+// send queues a message for the writer goroutine.
+func (s *session) send(kind int, data []byte) error {
+	select {
+	case s.out <- outMessage{kind: kind, data: data}:
+		return nil
+	case <-s.done:
+		if s.werr != nil {
+			return s.werr
+		}
+		return websocket.ErrCloseSent
+	}
+}
+
+// writer sends queued messages to the client.
+func (s *session) writer() {
+	defer close(s.done)
+	for msg := range s.out {
+		if err := s.writeNow(msg.kind, msg.data); err != nil {
+			s.werr = err
+			// Unblock the reader and make it fail on its next read.
+			_ = s.conn.SetReadDeadline(time.Now())
+			return
+		}
+	}
+}
+
+// writeNow writes a message directly to the connection.
+func (s *session) writeNow(kind int, data []byte) error {
+	if s.h.WriteTimeout > 0 {
+		_ = s.conn.SetWriteDeadline(time.Now().Add(s.h.WriteTimeout))
+	}
+	return s.conn.WriteMessage(kind, data)
+}
+
+// closeWithError reports err to the client and closes the connection.
+func (s *session) closeWithError(err error) {
+	_ = s.writeNow(websocket.TextMessage, mustJSON(control{Type: "error", Error: err.Error()}))
+	code := websocket.CloseInternalServerErr
+	if errors.Is(err, ErrBadFormat) || errors.Is(err, ErrBadParams) || errors.Is(err, ErrBadMessage) {
+		code = websocket.CloseUnsupportedData
+	}
+	s.close(code, "")
+}
+
+// close sends a close frame.
+func (s *session) close(code int, text string) {
+	deadline := time.Now().Add(time.Second)
+	_ = s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), deadline)
+}
+
+// validateParams checks that the given parameters are in a usable range. Speed, pitch and rate
+// must be positive, the volume may be 0 to mute.
+func validateParams(p Params) error {
+	for _, v := range []*float64{p.Speed, p.Pitch, p.Rate, p.Volume} {
+		if v == nil {
+			continue
+		}
+		if math.IsNaN(*v) || math.IsInf(*v, 0) || *v < 0 || *v > 100 || (*v == 0 && v != p.Volume) {
+			return ErrBadParams
+		}
+	}
+	return nil
+}
+
+// applyParams sets all parameters present in p on the stream.
+func applyParams(stream *sonic.Stream, p Params) {
+	if p.Speed != nil {
+		stream.SetSpeed(*p.Speed)
+	}
+	if p.Pitch != nil {
+		stream.SetPitch(*p.Pitch)
+	}
+	if p.Rate != nil {
+		stream.SetRate(*p.Rate)
+	}
+	if p.Volume != nil {
+		stream.SetVolume(*p.Volume)
+	}
+	if p.Quality != nil {
+		stream.SetQuality(*p.Quality)
+	}
+}
+
+// mustJSON marshals a control message.
+func mustJSON(v control) []byte {
+	data, _ := json.Marshal(v)
+	return data
+}
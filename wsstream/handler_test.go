@@ -0,0 +1,213 @@
+// Copyright (c) 2023 Alexander Khudich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wsstream
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func dial(t *testing.T, h *Handler) *websocket.Conn {
+	t.Helper()
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	return conn
+}
+
+func sendJSON(t *testing.T, conn *websocket.Conn, v any) {
+	t.Helper()
+	data, _ := json.Marshal(v)
+	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectControl(t *testing.T, conn *websocket.Conn, typ string) (int, control) {
+	t.Helper()
+	binaryBytes := 0
+	for {
+		kind, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for %q: %v", typ, err)
+		}
+		if kind == websocket.BinaryMessage {
+			binaryBytes += len(data)
+			continue
+		}
+		var msg control
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type != typ {
+			t.Fatalf("got %+v, want %q", msg, typ)
+		}
+		return binaryBytes, msg
+	}
+}
+
+func ptr(v float64) *float64 {
+	return &v
+}
+
+func sine16(frames int) []byte {
+	data := make([]byte, 2*frames)
+	for i := 0; i < frames; i++ {
+		v := int16(8000 * math.Sin(2*math.Pi*220*float64(i)/16000))
+		binary.LittleEndian.PutUint16(data[2*i:], uint16(v))
+	}
+	return data
+}
+
+func TestSessionSpeedsUp(t *testing.T) {
+	conn := dial(t, NewHandler())
+	sendJSON(t, conn, Config{SampleRate: 16000, Channels: 1, Params: Params{Speed: ptr(2)}})
+	expectControl(t, conn, "ready")
+
+	in := sine16(16000)
+	for off := 0; off < len(in); off += 640 {
+		if err := conn.WriteMessage(websocket.BinaryMessage, in[off:off+640]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sendJSON(t, conn, control{Type: "flush"})
+	n, _ := expectControl(t, conn, "flushed")
+
+	ratio := float64(n) / float64(len(in))
+	if ratio < 0.45 || ratio > 0.55 {
+		t.Errorf("output/input ratio %.3f, want about 0.5", ratio)
+	}
+}
+
+func TestSessionParamsChange(t *testing.T) {
+	conn := dial(t, NewHandler())
+	sendJSON(t, conn, Config{SampleRate: 16000, Channels: 1, Format: FormatF32LE})
+	expectControl(t, conn, "ready")
+
+	sendJSON(t, conn, control{Type: "params", Params: Params{Speed: ptr(0.5)}})
+
+	frames := 8000
+	in := make([]byte, 4*frames)
+	for i := 0; i < frames; i++ {
+		v := float32(0.25 * math.Sin(2*math.Pi*220*float64(i)/16000))
+		binary.LittleEndian.PutUint32(in[4*i:], math.Float32bits(v))
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, in); err != nil {
+		t.Fatal(err)
+	}
+	sendJSON(t, conn, control{Type: "flush"})
+	n, _ := expectControl(t, conn, "flushed")
+
+	ratio := float64(n) / float64(len(in))
+	if ratio < 1.9 || ratio > 2.1 {
+		t.Errorf("output/input ratio %.3f, want about 2", ratio)
+	}
+}
+
+func TestSessionMute(t *testing.T) {
+	conn := dial(t, NewHandler())
+	sendJSON(t, conn, Config{SampleRate: 16000, Channels: 1})
+	expectControl(t, conn, "ready")
+
+	// A volume of 0 mutes; the speed stays at its initial value.
+	sendJSON(t, conn, control{Type: "params", Params: Params{Volume: ptr(0)}})
+	if err := conn.WriteMessage(websocket.BinaryMessage, sine16(4000)); err != nil {
+		t.Fatal(err)
+	}
+	sendJSON(t, conn, control{Type: "flush"})
+	var out []byte
+	for {
+		kind, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kind == websocket.TextMessage {
+			break
+		}
+		out = append(out, data...)
+	}
+	if len(out) < 2*3900 || len(out) > 2*4100 {
+		t.Errorf("%d bytes, want about %d", len(out), 2*4000)
+	}
+	for i, b := range out {
+		if b != 0 {
+			t.Fatalf("byte %d is %d after muting", i, b)
+		}
+	}
+
+	// A speed of 0 is rejected rather than ignored.
+	sendJSON(t, conn, control{Type: "params", Params: Params{Speed: ptr(0)}})
+	expectControl(t, conn, "error")
+}
+
+func TestSessionRejectsBadConfig(t *testing.T) {
+	conn := dial(t, NewHandler())
+	sendJSON(t, conn, Config{SampleRate: 16000, Channels: 1, Format: "mp3"})
+	_, msg := expectControl(t, conn, "error")
+	if !strings.Contains(msg.Error, "unsupported audio format") {
+		t.Errorf("unexpected error %q", msg.Error)
+	}
+
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseUnsupportedData) {
+		t.Errorf("expected unsupported data close, got %v", err)
+	}
+}
+
+func TestSessionBackpressure(t *testing.T) {
+	h := NewHandler()
+	h.OutputQueue = 1
+	h.FrameSamples = 64
+	conn := dial(t, h)
+	sendJSON(t, conn, Config{SampleRate: 16000, Channels: 1, Params: Params{Speed: ptr(0.5)}})
+	expectControl(t, conn, "ready")
+
+	// Write a lot without reading; the server must stop consuming input
+	// instead of buffering output without bound.
+	in := sine16(1600)
+	written := make(chan int)
+	go func() {
+		i := 0
+		for ; i < 5000; i++ {
+			_ = conn.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+			if err := conn.WriteMessage(websocket.BinaryMessage, in); err != nil {
+				break
+			}
+		}
+		written <- i
+	}()
+
+	select {
+	case n := <-written:
+		if n == 5000 {
+			t.Fatal("writes never blocked")
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("test timed out")
+	}
+}